@@ -1,6 +1,10 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/Heliodex/coputer/ast/parse"
+)
 
 const src = `local x = 'this is a "test"'
 local y = [[this is a "test"]]
@@ -17,7 +21,7 @@ local esc = "\a\b\f\n\r\t\v"
 `
 
 func main() {
-	ok, res := Parse(src, Options{})
+	ok, res := parse.Parse(src, parse.Options{})
 	if !ok {
 		fmt.Println("Parse failed with errors:")
 		for _, err := range res.Errors {
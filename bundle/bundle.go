@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 )
 
 const (
@@ -24,12 +23,31 @@ const (
 	ProgramsDir       = DataDir + "/programs"
 )
 
+// bundleSingle bundles a single file as the entrypoint of a program
+func bundleSingle(path string) (b []byte, err error) {
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	c, err := compress(EntrypointFilename, f)
+	if err != nil {
+		return
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(c.data)))
+	return append(b, c.data...), nil
+}
+
+// Bundle bundles a program directory, or a single file which becomes the program's entrypoint.
 func Bundle(path string) (b []byte, err error) {
-	var cFiles []File
+	if info, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return bundleSingle(path)
+	}
 
-	// count the number of file separators in path
-	fps := string(filepath.Separator)
-	depth := strings.Count(path, fps)
+	var cFiles []File
 
 	// walk through the directory
 	if err = filepath.WalkDir(path, func(p string, info os.DirEntry, err error) error {
@@ -37,7 +55,7 @@ func Bundle(path string) (b []byte, err error) {
 			return err
 		}
 
-		if bf, err := bundleFile(p, depth); err != nil {
+		if bf, err := bundleFile(p, path); err != nil {
 			return err
 		} else if bf.path == EntrypointFilename {
 			cFiles = append([]File{bf}, cFiles...) // entrypoint goes first
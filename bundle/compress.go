@@ -5,7 +5,6 @@ import (
 	"compress/gzip"
 	"os"
 	"path/filepath"
-	"strings"
 )
 
 const gzheaderLen = 10
@@ -51,19 +50,18 @@ func decompress(c []byte) (f File, err error) {
 	return File{r.Name, b.Bytes()}, nil
 }
 
-func bundleFile(p string, depth int) (bf File, err error) {
+func bundleFile(p, root string) (bf File, err error) {
 	// read
 	f, err := os.ReadFile(p)
 	if err != nil {
 		return
 	}
 
-	// trim ../ or ..\ from p
-	fps := string(filepath.Separator)
-	p = strings.TrimPrefix(p, ".."+fps)
-	// remove walked directory from p (everything before first /)
-	s := strings.Split(p, fps)
-	np := strings.Join(s[depth:], "/")
+	// path relative to the walked directory, with forward slashes
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return
+	}
 
-	return compress(np, f)
+	return compress(filepath.ToSlash(rel), f)
 }
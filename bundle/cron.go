@@ -0,0 +1,127 @@
+package bundle
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron schedule, with minute, hour, day of month, month, and day of week fields. Schedules are always in UTC.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64 // bitsets
+	// day of month and day of week are ORed if both are restricted, like in cron
+	domStar, dowStar bool
+}
+
+var shorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseField(f string, lo, hi int) (bits uint64, err error) {
+	for part := range strings.SplitSeq(f, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+
+		start, end := lo, hi
+		if rng != "*" {
+			s, e, isRange := strings.Cut(rng, "-")
+			if start, err = strconv.Atoi(s); err != nil {
+				return 0, fmt.Errorf("invalid value %q", s)
+			}
+
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(e); err != nil {
+					return 0, fmt.Errorf("invalid value %q", e)
+				}
+			} else if hasStep {
+				end = hi // 5/15 means from 5 onwards
+			}
+		}
+
+		if start < lo || end > hi || start > end {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, lo, hi)
+		}
+
+		for i := start; i <= end; i += step {
+			bits |= 1 << i
+		}
+	}
+	return
+}
+
+// ParseSchedule parses a cron expression with 5 fields, or a shorthand like "@hourly".
+func ParseSchedule(spec string) (s Schedule, err error) {
+	if sh, ok := shorthands[spec]; ok {
+		spec = sh
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return Schedule{}, errors.New("schedule must have 5 fields: minute hour day-of-month month day-of-week")
+	}
+
+	names := [...]string{"minute", "hour", "day of month", "month", "day of week"}
+	bits := [...]*uint64{&s.minute, &s.hour, &s.dom, &s.month, &s.dow}
+	ranges := [...][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+	for i, f := range fields {
+		if *bits[i], err = parseField(f, ranges[i][0], ranges[i][1]); err != nil {
+			return Schedule{}, fmt.Errorf("invalid %s field: %w", names[i], err)
+		}
+	}
+
+	// 7 is also Sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar, s.dowStar = fields[2] == "*", fields[4] == "*"
+	return
+}
+
+func (s Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<t.Weekday()) != 0
+
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first scheduled time after t, or the zero time if there isn't one in the next 5 years.
+func (s Schedule) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		y, m, d := t.Date()
+
+		switch {
+		case s.month&(1<<m) == 0:
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.dayMatches(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
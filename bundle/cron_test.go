@@ -0,0 +1,43 @@
+package bundle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	from := time.Date(2025, 1, 31, 10, 17, 30, 0, time.UTC) // a Friday
+
+	tests := [...]struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2025, 1, 31, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, 1, 31, 10, 30, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2025, 1, 31, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 9 * * 1-5", time.Date(2025, 2, 3, 9, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1 * 0", time.Date(2025, 2, 1, 12, 0, 0, 0, time.UTC)}, // 1st of the month or Sunday
+		{"5,10 10 * * 7", time.Date(2025, 2, 2, 10, 5, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		s, err := ParseSchedule(test.spec)
+		if err != nil {
+			t.Fatal(test.spec, err)
+		}
+
+		if next := s.Next(from); !next.Equal(test.next) {
+			t.Errorf("%s: expected %s, got %s", test.spec, test.next, next)
+		}
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	for _, spec := range [...]string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("expected error parsing %q", spec)
+		}
+	}
+}
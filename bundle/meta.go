@@ -0,0 +1,75 @@
+package bundle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MetaFilename is the optional file in a program's root directory that declares its metadata.
+const MetaFilename = "coputer.json"
+
+// Meta stores the metadata a program declares about itself.
+type Meta struct {
+	// Capabilities lists the optional libraries (or library functions, like "programs.call") the program needs.
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Schedule is a cron expression for scheduled programs, like "*/5 * * * *" or "@hourly".
+	Schedule string `json:"schedule,omitempty"`
+	// TTL is how long results of the program are cached for, like "10m", unless a web program's response says otherwise.
+	TTL string `json:"ttl,omitempty"`
+}
+
+// CacheTTL returns the program's TTL, or 0 if it doesn't have one.
+func (m Meta) CacheTTL() time.Duration {
+	ttl, _ := time.ParseDuration(m.TTL) // validated when parsed
+	return ttl
+}
+
+func parseMeta(b []byte) (m Meta, err error) {
+	if err = json.Unmarshal(b, &m); err != nil {
+		return Meta{}, fmt.Errorf("bad metadata: %w", err)
+	}
+
+	if m.Schedule != "" {
+		if _, err = ParseSchedule(m.Schedule); err != nil {
+			return Meta{}, fmt.Errorf("bad metadata schedule: %w", err)
+		}
+	}
+
+	if m.TTL != "" {
+		if ttl, err := time.ParseDuration(m.TTL); err != nil || ttl <= 0 {
+			return Meta{}, fmt.Errorf("bad metadata ttl %q, expected a positive duration like \"10m\"", m.TTL)
+		}
+	}
+	return
+}
+
+// ReadMeta reads the metadata of a stored program. Programs without a metadata file have empty metadata.
+func ReadMeta(hexhash string) (m Meta, err error) {
+	b, err := os.ReadFile(filepath.Join(ProgramsDir, hexhash, MetaFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return Meta{}, nil
+	} else if err != nil {
+		return
+	}
+
+	return parseMeta(b)
+}
+
+// MetaFromBundle reads the metadata of a bundled program, without storing it.
+func MetaFromBundle(b []byte) (m Meta, err error) {
+	fs, err := Unbundle(b)
+	if err != nil {
+		return
+	}
+
+	for _, f := range fs {
+		if f.path == MetaFilename {
+			return parseMeta(f.data)
+		}
+	}
+	return Meta{}, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+)
+
+// how much of the client's address is passed to web programs, set with the CLIENT_ADDR environment variable:
+// "full" passes the whole address, "anon" (the default) passes only its network, and "none" passes nothing
+// The client address is part of a request's input hash, so the more of it is passed, the less often results can be reused.
+var clientAddrPolicy = os.Getenv("CLIENT_ADDR")
+
+// anonymise keeps the first 24 bits of IPv4 addresses and 48 bits of IPv6 addresses
+func anonymise(addr netip.Addr) netip.Addr {
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+
+	p, _ := addr.Prefix(bits)
+	return p.Addr()
+}
+
+func clientAddr(r *http.Request) string {
+	if clientAddrPolicy == "none" {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+
+	if clientAddrPolicy != "full" {
+		addr = anonymise(addr)
+	}
+	return addr.String()
+}
@@ -40,26 +40,43 @@ func GetProfile(pk keys.PK) (programs []string, err error) {
 }
 
 // lel
-// but seriously, this is different to the StartWebProgram function in the communication system, even though it's identical, because it addresses the communication server instead of the execution server
-func StartWebProgram(pk keys.PK, name string, args WebArgs) (rets WebRets, err error) {
-	res, err := http.Post(addr+"/web/"+pk.EncodeNoPrefix()+"/"+url.PathEscape(name), "", bytes.NewReader(args.Encode()))
+// but seriously, this is different to the StartWebStream function in the communication system, even though it's identical, because it addresses the communication server instead of the execution server
+// A zero quorum runs the program with the communication server's default for it. On a bad status the response is returned with the error, its body closed, so its headers can still be read.
+func StartWebStream(pk keys.PK, name string, args WebArgs, q Quorum) (res *http.Response, err error) {
+	req, err := http.NewRequest(http.MethodPost, addr+"/webstream/"+pk.EncodeNoPrefix()+"/"+url.PathEscape(name), bytes.NewReader(args.Encode()))
 	if err != nil {
-		return WebRets{}, fmt.Errorf("start web program: %v", err)
+		return nil, fmt.Errorf("create web program request: %v", err)
+	}
+	if q != (Quorum{}) {
+		req.Header.Set(QuorumHeader, q.String())
 	}
 
-	// we need the body either way
-	b, err := io.ReadAll(res.Body)
-	if err != nil {
-		return WebRets{}, fmt.Errorf("read response body while starting web program: %v", err)
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		return nil, fmt.Errorf("start web program: %v", err)
 	}
 
 	if res.StatusCode != http.StatusOK {
-		return WebRets{}, fmt.Errorf("bad status from communication server while starting web program: %s, %s", res.Status, b)
+		defer res.Body.Close()
+
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("read response body while starting web program: %v", err)
+		}
+		err = fmt.Errorf("bad status from communication server while starting web program: %s, %s", res.Status, b)
+		return res, ClassifyError(ParseErrorClass(res.Header.Get(ErrorClassHeader)), err)
+	}
+	return
+}
+
+// GetScheduled gets the results of a scheduled program: a list of ticks if tick is empty, otherwise the result at that tick (or "latest").
+func GetScheduled(pk keys.PK, name, tick string) (res *http.Response, err error) {
+	path := addr + "/scheduled/" + pk.EncodeNoPrefix() + "/" + url.PathEscape(name)
+	if tick != "" {
+		path += "/" + url.PathEscape(tick)
 	}
 
-	// deserialise it
-	if rets, err = DecodeRets[WebRets](b); err != nil {
-		return WebRets{}, fmt.Errorf("decode response body while starting web program: %v", err)
+	if res, err = http.Get(path); err != nil {
+		return nil, fmt.Errorf("get scheduled results: %v", err)
 	}
 	return
 }
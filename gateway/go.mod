@@ -8,6 +8,8 @@ require (
 )
 
 require (
+	filippo.io/edwards25519 v1.2.0 // indirect
+	github.com/Heliodex/coputer/sig v0.0.0 // indirect
 	golang.org/x/crypto v0.48.0 // indirect
 	golang.org/x/sys v0.42.0 // indirect
 )
@@ -15,3 +17,5 @@ require (
 replace github.com/Heliodex/coputer/litecode => ../litecode
 
 replace github.com/Heliodex/coputer/wallflower => ../wallflower
+
+replace github.com/Heliodex/coputer/sig => ../sig
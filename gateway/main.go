@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -53,6 +55,7 @@ func serveMain(w http.ResponseWriter, _ *http.Request, host string) {
 	fmt.Fprintln(w, "This is a placeholder for the main page.")
 	fmt.Fprintf(w, "Profiles are accessible via subdomains like %s.%s\n", egPk, host)
 	fmt.Fprintf(w, "Programs are accessible via subdomains like example-%s.%s\n", egPk, host)
+	fmt.Fprintf(w, "Results of scheduled programs are accessible at %s/scheduled/%s/example/latest\n", host, egPk)
 }
 
 func serveProfile(w http.ResponseWriter, r *http.Request, pk keys.PK) {
@@ -79,6 +82,16 @@ func serveProfile(w http.ResponseWriter, r *http.Request, pk keys.PK) {
 }
 
 func serveWeb(w http.ResponseWriter, r *http.Request, pk keys.PK, name string) {
+	var q Quorum
+	if s := r.Header.Get(QuorumHeader); s != "" {
+		var err error
+		if q, err = ParseQuorum(s); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid quorum: %v", err), http.StatusBadRequest)
+			return
+		}
+		r.Header.Del(QuorumHeader) // it's for the network, not the program
+	}
+
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusBadRequest)
@@ -92,29 +105,116 @@ func serveWeb(w http.ResponseWriter, r *http.Request, pk keys.PK, name string) {
 		Query:    r.URL.Query(),
 	}
 
-	headers := make(map[string]string, len(r.Header))
-	for k := range r.Header {
-		headers[k] = r.Header.Get(k)
+	// every value, with lowercase names
+	headers := NewHeaders(r.Header)
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
 	}
 
 	args := WebArgs{
-		Url:     url,
-		Method:  r.Method,
-		Headers: headers,
-		Body:    body,
+		Url:      url,
+		Method:   r.Method,
+		Headers:  headers,
+		Body:     body,
+		Host:     r.Host,
+		Scheme:   scheme,
+		Protocol: r.Proto,
+		Program:  WebArgsProgram{Pk: pk.Encode(), Name: name},
+		Client:   clientAddr(r),
 	}
 
-	rets, err := StartWebProgram(pk, name, args)
+	res, err := StartWebStream(pk, name, args, q)
+	if res != nil {
+		if v := res.Header.Get(QuorumResultHeader); v != "" {
+			w.Header().Set(QuorumResultHeader, v)
+		}
+	}
+	if err != nil {
+		// a broken program isn't the network's fault
+		c := ErrorClassOf(err)
+		w.Header().Set(ErrorClassHeader, c.String())
+		http.Error(w, fmt.Sprintf("Failed to start web program: %v", err), c.Status())
+		return
+	}
+	defer res.Body.Close()
+
+	br := bufio.NewReader(res.Body)
+	head, err := ReadWebHead(br)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to start web program: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	for k, v := range rets.Headers {
-		w.Header().Set(k, v)
+	for k, vs := range head.Headers {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(head.StatusCode)
+
+	// send the body as it's written
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := br.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n])
+			rc.Flush()
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			fmt.Println("Web program stream failed:", err)
+			panic(http.ErrAbortHandler) // so the client doesn't think it got the whole response
+		}
+	}
+
+	if msg := res.Trailer.Get(WebStreamErrorTrailer); msg != "" {
+		fmt.Println("Web program failed while streaming:", msg)
+		panic(http.ErrAbortHandler)
 	}
-	w.WriteHeader(rets.StatusCode)
-	w.Write(rets.Body)
+}
+
+// results of scheduled programs are at /scheduled/{pk}/{name} (list of ticks) and /scheduled/{pk}/{name}/{tick or latest}
+func serveScheduled(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/scheduled/"), "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	pk, err := keys.DecodePKNoPrefix(parts[0])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode public key: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var tick string
+	if len(parts) == 3 {
+		tick = parts[2]
+	}
+
+	res, err := GetScheduled(pk, parts[1], tick)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get scheduled results: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer res.Body.Close()
+
+	for _, k := range [...]string{"Content-Type", "Coputer-Tick", "Coputer-Ran-By"} {
+		if v := res.Header.Get(k); v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
 }
 
 func handleRoute(w http.ResponseWriter, r *http.Request) {
@@ -126,6 +226,11 @@ func handleRoute(w http.ResponseWriter, r *http.Request) {
 
 	hn := u.Hostname()
 	if hn == host {
+		if strings.HasPrefix(r.URL.Path, "/scheduled/") {
+			serveScheduled(w, r)
+			return
+		}
+
 		// serve main page
 		serveMain(w, r, host)
 		return
@@ -153,6 +258,15 @@ func main() {
 	}
 
 	fmt.Println("Starting")
+	switch clientAddrPolicy {
+	case "", "anon":
+		fmt.Println("Passing anonymised client addresses to programs")
+	case "full", "none":
+		fmt.Println("Client addresses passed to programs:", clientAddrPolicy)
+	default:
+		fmt.Println("Invalid CLIENT_ADDR, expected full, anon, or none")
+		os.Exit(1)
+	}
 
 	// match any route as a subdomain of localhost
 	http.HandleFunc("/", handleRoute)
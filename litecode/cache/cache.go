@@ -0,0 +1,314 @@
+// Package cache stores the results of program runs, so runs with the same program and input don't have to be repeated.
+// The cache is bounded by entries and bytes, evicting the least recently used results first, and can be persisted to disk so it survives restarts.
+package cache
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Key identifies a result by the hash of the program and the hash of its input.
+type Key struct {
+	Program, Input [32]byte
+}
+
+func (k Key) filename() string {
+	return hex.EncodeToString(k.Program[:]) + "-" + hex.EncodeToString(k.Input[:])
+}
+
+// Result is the encoded output of a run, or the error it failed with.
+type Result struct {
+	Output []byte
+	Err    string
+}
+
+func (r Result) size() int64 {
+	return int64(len(r.Output) + len(r.Err))
+}
+
+// Config sets the limits of a cache.
+type Config struct {
+	// MaxEntries is the most results kept, or 0 for no limit.
+	MaxEntries int
+	// MaxBytes is the most bytes of results kept, or 0 for no limit.
+	MaxBytes int64
+	// TTL is how long results are kept if they're stored without one, or 0 to keep them until they're evicted.
+	TTL time.Duration
+	// Dir is where results are persisted, or empty to keep them only in memory.
+	Dir string
+}
+
+// Stats counts what a cache has done since it was created.
+type Stats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Evictions     uint64 `json:"evictions"`
+	Expirations   uint64 `json:"expirations"`
+	Invalidations uint64 `json:"invalidations"`
+	Entries       int    `json:"entries"`
+	Bytes         int64  `json:"bytes"`
+}
+
+type entry struct {
+	key     Key
+	res     Result
+	expires time.Time // zero if it doesn't expire
+}
+
+// Cache is a bounded LRU cache of program results. It's safe for concurrent use.
+type Cache struct {
+	cfg Config
+	// now is replaceable for testing
+	now func() time.Time
+
+	mu      sync.Mutex
+	ll      *list.List // most recently used first
+	entries map[Key]*list.Element
+	bytes   int64
+	stats   Stats
+}
+
+// New creates a cache, loading any results persisted in its directory.
+func New(cfg Config) (c *Cache, err error) {
+	c = &Cache{
+		cfg:     cfg,
+		now:     time.Now,
+		ll:      list.New(),
+		entries: make(map[Key]*list.Element),
+	}
+
+	if cfg.Dir != "" {
+		if err = c.load(); err != nil {
+			return nil, fmt.Errorf("load cache: %w", err)
+		}
+	}
+	return
+}
+
+// Get returns the result for a key, if there's one that hasn't expired.
+func (c *Cache) Get(k Key) (res Result, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[k]
+	if !ok {
+		c.stats.Misses++
+		return
+	}
+
+	e := el.Value.(*entry)
+	if !e.expires.IsZero() && !c.now().Before(e.expires) {
+		c.remove(el)
+		c.stats.Expirations++
+		c.stats.Misses++
+		return Result{}, false
+	}
+
+	c.ll.MoveToFront(el)
+	c.stats.Hits++
+	return e.res, true
+}
+
+// Put stores a result. A ttl of 0 uses the cache's TTL, and a negative ttl doesn't store the result.
+func (c *Cache) Put(k Key, res Result, ttl time.Duration) {
+	if ttl < 0 {
+		return
+	}
+	if ttl == 0 {
+		ttl = c.cfg.TTL
+	}
+
+	e := &entry{key: k, res: res}
+	if ttl > 0 {
+		e.expires = c.now().Add(ttl)
+	}
+
+	// too big to ever fit
+	if c.cfg.MaxBytes > 0 && res.size() > c.cfg.MaxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[k]; ok {
+		c.remove(el)
+	}
+	c.add(e)
+	c.evict()
+
+	if c.cfg.Dir != "" {
+		c.persist(e)
+	}
+}
+
+// Invalidate removes every result of a program, returning how many were removed. It's used when a name is pointed to a new version of a program, so the old version's results aren't kept around.
+func (c *Cache) Invalidate(program [32]byte) (n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, el := range c.entries {
+		if k.Program == program {
+			c.remove(el)
+			n++
+		}
+	}
+	c.stats.Invalidations += uint64(n)
+	return
+}
+
+// Stats returns the cache's statistics.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.stats
+	s.Entries, s.Bytes = c.ll.Len(), c.bytes
+	return s
+}
+
+func (c *Cache) add(e *entry) {
+	c.entries[e.key] = c.ll.PushFront(e)
+	c.bytes += e.res.size()
+}
+
+func (c *Cache) remove(el *list.Element) {
+	e := c.ll.Remove(el).(*entry)
+	delete(c.entries, e.key)
+	c.bytes -= e.res.size()
+
+	if c.cfg.Dir != "" {
+		os.Remove(filepath.Join(c.cfg.Dir, e.key.filename()))
+	}
+}
+
+func (c *Cache) full() bool {
+	return (c.cfg.MaxEntries > 0 && c.ll.Len() > c.cfg.MaxEntries) ||
+		(c.cfg.MaxBytes > 0 && c.bytes > c.cfg.MaxBytes)
+}
+
+func (c *Cache) evict() {
+	for c.full() {
+		c.remove(c.ll.Back())
+		c.stats.Evictions++
+	}
+}
+
+// persisted entries are expiry time (unix nanoseconds, 0 if none), error length, error, then output
+
+func (e *entry) encode() (b []byte) {
+	var expires int64
+	if !e.expires.IsZero() {
+		expires = e.expires.UnixNano()
+	}
+
+	b = binary.BigEndian.AppendUint64(b, uint64(expires))
+	b = binary.AppendUvarint(b, uint64(len(e.res.Err)))
+	b = append(b, e.res.Err...)
+	return append(b, e.res.Output...)
+}
+
+var errBadEntry = errors.New("bad cache entry")
+
+func decodeEntry(b []byte) (e entry, err error) {
+	if len(b) < 8 {
+		return entry{}, errBadEntry
+	}
+	if expires := int64(binary.BigEndian.Uint64(b)); expires != 0 {
+		e.expires = time.Unix(0, expires)
+	}
+	b = b[8:]
+
+	l, n := binary.Uvarint(b)
+	if n <= 0 || l > uint64(len(b)-n) {
+		return entry{}, errBadEntry
+	}
+	e.res.Err = string(b[n:][:l])
+	e.res.Output = b[n+int(l):]
+	return
+}
+
+func parseFilename(name string) (k Key, ok bool) {
+	if len(name) != 129 || name[64] != '-' {
+		return
+	}
+
+	p, err1 := hex.DecodeString(name[:64])
+	in, err2 := hex.DecodeString(name[65:])
+	if err1 != nil || err2 != nil {
+		return
+	}
+	return Key{[32]byte(p), [32]byte(in)}, true
+}
+
+// persist writes an entry to disk; failures only mean it won't survive a restart
+func (c *Cache) persist(e *entry) {
+	if err := os.MkdirAll(c.cfg.Dir, 0o755); err != nil {
+		return
+	}
+
+	path := filepath.Join(c.cfg.Dir, e.key.filename())
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, e.encode(), 0o644); err != nil {
+		return
+	}
+	os.Rename(tmp, path)
+}
+
+// load reads persisted entries, least recently written first so the most recent end up at the front
+func (c *Cache) load() error {
+	des, err := os.ReadDir(c.cfg.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	type file struct {
+		key     Key
+		modTime time.Time
+	}
+	var files []file
+	for _, de := range des {
+		k, ok := parseFilename(de.Name())
+		if !ok {
+			continue // leftover temp files, or something else entirely
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{k, info.ModTime()})
+	}
+	slices.SortFunc(files, func(a, b file) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	now := c.now()
+	for _, f := range files {
+		path := filepath.Join(c.cfg.Dir, f.key.filename())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		e, err := decodeEntry(b)
+		if err != nil || (!e.expires.IsZero() && !now.Before(e.expires)) {
+			os.Remove(path)
+			continue
+		}
+
+		e.key = f.key
+		c.add(&e)
+	}
+	c.evict()
+	return nil
+}
@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func key(p, in byte) Key {
+	return Key{[32]byte{p}, [32]byte{in}}
+}
+
+func TestLRU(t *testing.T) {
+	c, err := New(Config{MaxEntries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Put(key(1, 1), Result{Output: []byte("a")}, 0)
+	c.Put(key(1, 2), Result{Output: []byte("b")}, 0)
+	c.Get(key(1, 1)) // now more recently used than 1, 2
+	c.Put(key(1, 3), Result{Output: []byte("c")}, 0)
+
+	if _, ok := c.Get(key(1, 2)); ok {
+		t.Fatal("expected least recently used result to be evicted")
+	}
+	if res, ok := c.Get(key(1, 1)); !ok || string(res.Output) != "a" {
+		t.Fatal("expected recently used result to be kept")
+	}
+
+	if s := c.Stats(); s.Entries != 2 || s.Evictions != 1 || s.Hits != 2 || s.Misses != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	c, err := New(Config{MaxBytes: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Put(key(1, 1), Result{Output: []byte("123456")}, 0)
+	c.Put(key(1, 2), Result{Err: "78901"}, 0)
+	if s := c.Stats(); s.Entries != 1 || s.Bytes != 5 {
+		t.Fatalf("expected only the newest result to fit, got %+v", s)
+	}
+
+	c.Put(key(1, 3), Result{Output: make([]byte, 11)}, 0)
+	if _, ok := c.Get(key(1, 3)); ok {
+		t.Fatal("expected result bigger than the cache not to be stored")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	c, err := New(Config{TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	c.Put(key(1, 1), Result{}, 0)            // cache's TTL
+	c.Put(key(1, 2), Result{}, time.Hour)    // its own TTL
+	c.Put(key(1, 3), Result{}, -time.Second) // not stored
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.Get(key(1, 1)); ok {
+		t.Fatal("expected result to expire")
+	}
+	if _, ok := c.Get(key(1, 2)); !ok {
+		t.Fatal("expected result with longer TTL to be kept")
+	}
+	if _, ok := c.Get(key(1, 3)); ok {
+		t.Fatal("expected result with negative TTL not to be stored")
+	}
+	if s := c.Stats(); s.Expirations != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	c, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Put(key(1, 1), Result{}, 0)
+	c.Put(key(1, 2), Result{}, 0)
+	c.Put(key(2, 1), Result{}, 0)
+
+	if n := c.Invalidate([32]byte{1}); n != 2 {
+		t.Fatal("expected 2 results invalidated, got", n)
+	}
+	if _, ok := c.Get(key(2, 1)); !ok {
+		t.Fatal("expected other program's results to be kept")
+	}
+}
+
+func TestPersist(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := New(Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Put(key(1, 1), Result{Output: []byte("kept")}, 0)
+	c.Put(key(1, 2), Result{Err: "failed"}, time.Hour)
+	c.Put(key(1, 3), Result{Output: []byte("expired")}, time.Nanosecond)
+	c.Put(key(2, 1), Result{}, 0)
+	c.Invalidate([32]byte{2})
+
+	time.Sleep(time.Millisecond)
+
+	// as if restarted
+	c, err = New(Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res, ok := c.Get(key(1, 1)); !ok || string(res.Output) != "kept" {
+		t.Fatal("expected result to be persisted", res)
+	}
+	if res, ok := c.Get(key(1, 2)); !ok || res.Err != "failed" {
+		t.Fatal("expected error to be persisted", res)
+	}
+	if s := c.Stats(); s.Entries != 2 {
+		t.Fatalf("expected expired and invalidated results to be gone, got %+v", s)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Heliodex/coputer/bundle"
+	"github.com/Heliodex/coputer/litecode/cache"
+	. "github.com/Heliodex/coputer/litecode/types"
+	"github.com/Heliodex/coputer/litecode/vm/std"
+)
+
+// programs calling library programs with programs.call
+
+// programs we don't have are run through wallflower, which asks its peers
+const wallflowerAddr = "http://localhost:2507"
+
+// runCtx is shared by a program and every program it calls
+type runCtx struct {
+	c Compiler
+	// callees have to finish before their caller's time runs out
+	deadline time.Time
+	// hashes of the programs currently running, to detect cycles
+	chain []string
+	// where a web program's body goes as it's written, nil if it isn't streamed
+	stream *webStream
+	// results of runs, shared with calls, nil if they aren't cached
+	results *cache.Cache
+	// how the state of the program that was asked to run changed, nil if it isn't stateful
+	state *StateTransition
+	// set if the result depends on more than the program and its input: it called programs by name, which can point to new versions, or a call failed for reasons other than the callee
+	nondet *atomic.Bool
+}
+
+var errTimeout = ClassifyError(LimitError, errors.New("program timed out"))
+
+// cachedCall reuses results of running a program with the same input, the same as runs through the execution server. Only results that don't depend on calls by name, or on calls that failed nondeterministically, are kept.
+func (rc runCtx) cachedCall(hexhash string, args LibraryArgs, call func() (LibraryRets, bool, error)) (rets LibraryRets, err error) {
+	if rc.results == nil {
+		rets, _, err = call()
+		return
+	}
+
+	hash, err := hex.DecodeString(hexhash)
+	if err != nil {
+		return rets, ClassifyError(InfraError, err)
+	}
+	key := cache.Key{Program: [32]byte(hash), Input: InputHash(args)}
+
+	if res, ok := rc.results.Get(key); ok {
+		if res.Err != "" {
+			// only program errors are cached
+			return rets, ClassifyError(ProgramError, errors.New(res.Err))
+		}
+		return DecodeRets[LibraryRets](res.Output)
+	}
+
+	rets, det, err := call()
+	if err != nil || !det {
+		return
+	}
+
+	rc.results.Put(key, cache.Result{Output: rets.Encode()}, resultTTL(hexhash, rets))
+	return
+}
+
+// callChain is the programs running, to send with calls through wallflower
+func (rc runCtx) callChain() (c CallChain) {
+	c.Deadline = rc.deadline
+	for _, h := range rc.chain {
+		if hash, err := hex.DecodeString(h); err == nil && len(hash) == 32 {
+			c.Hashes = append(c.Hashes, [32]byte(hash))
+		}
+	}
+	return
+}
+
+// join continues a call chain from another node, so cycles through other nodes are found, and the first caller's time limit still applies
+func (rc *runCtx) join(c CallChain) error {
+	if c.Empty() {
+		return nil
+	}
+
+	chain := make([]string, 0, len(c.Hashes)+len(rc.chain))
+	for _, hash := range c.Hashes {
+		h := hex.EncodeToString(hash[:])
+		if slices.Contains(rc.chain, h) {
+			return ClassifyError(ProgramError, errors.New("cyclic program call"))
+		}
+		chain = append(chain, h)
+	}
+
+	rc.chain = append(chain, rc.chain...)
+	if c.Deadline.Before(rc.deadline) {
+		rc.deadline = c.Deadline
+	}
+	return nil
+}
+
+// localHash finds the hash of a program stored on this execution server, if it's there
+func localHash(pk, name string) (hexhash string, ok bool) {
+	hash, err := os.ReadFile(filepath.Join(NamesDir, pk, name))
+	if err != nil || len(hash) != 32 {
+		return
+	}
+
+	hexhash = hex.EncodeToString(hash)
+	return hexhash, bundle.BundleStored(hexhash)
+}
+
+func (rc runCtx) callLocal(p program, hexhash string, args LibraryArgs) (LibraryRets, error) {
+	if slices.Contains(rc.chain, hexhash) {
+		return LibraryRets{}, ClassifyError(ProgramError, errors.New("cyclic program call"))
+	}
+
+	callee := rc
+	callee.chain = append(slices.Clone(rc.chain), hexhash)
+	callee.stream = nil
+	callee.state = nil
+	callee.nondet = new(atomic.Bool)
+
+	call := func() (LibraryRets, bool, error) {
+		output, err := start(p, hexhash, args, callee)
+		if callee.nondet.Load() {
+			rc.nondet.Store(true)
+		}
+		if err != nil {
+			return LibraryRets{}, false, err
+		}
+		return output.(LibraryRets), !callee.nondet.Load(), nil
+	}
+
+	// calls to stateful programs change their state, so they can't be skipped
+	if stateful(hexhash) {
+		rets, _, err := call()
+		return rets, err
+	}
+	return rc.cachedCall(hexhash, args, call)
+}
+
+// callRemote runs a program we don't have through wallflower. Its results aren't cached here, as we don't know which version of the program its name points to; whoever runs it caches them by its hash.
+func (rc runCtx) callRemote(pk, name string, args LibraryArgs) (rets LibraryRets, err error) {
+	if !time.Now().Before(rc.deadline) {
+		return rets, errTimeout
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), rc.deadline)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wallflowerAddr+"/library/"+pk+"/"+url.PathEscape(name), bytes.NewReader(args.Encode()))
+	if err != nil {
+		return rets, ClassifyError(InfraError, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rc.callChain().SetHeaders(req.Header)
+
+	res, err := http.DefaultClient.Do(req)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return rets, errTimeout
+	} else if err != nil {
+		return rets, ClassifyError(InfraError, fmt.Errorf("call through wallflower: %w", err))
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return rets, errTimeout
+	} else if err != nil {
+		return rets, ClassifyError(InfraError, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		// wallflower passes on the class of the error from whoever ran it
+		c := ParseErrorClass(res.Header.Get(ErrorClassHeader))
+		return rets, ClassifyError(c, errors.New(strings.TrimSpace(string(b))))
+	}
+
+	return DecodeRets[LibraryRets](b)
+}
+
+func (rc runCtx) call(pk, name, function string, vals []Val) ([]Val, error) {
+	pk = strings.TrimPrefix(pk, "copub:")
+	if len(pk) != 49 || strings.ToLower(pk) != pk {
+		return nil, ClassifyError(ProgramError, errors.New("invalid public key"))
+	}
+
+	args, err := NewLibraryArgs(function, vals...)
+	if err != nil {
+		return nil, ClassifyError(ProgramError, fmt.Errorf("invalid arguments: %w", err))
+	}
+
+	var rets LibraryRets
+	if hexhash, ok := localHash(pk, name); ok {
+		rets, err = rc.callLocal(program{pk, name}, hexhash, args)
+	} else {
+		rets, err = rc.callRemote(pk, name, args)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return rets.Vals()
+}
+
+// callFn is programs.call for a running program. Failures are raised with their class, so callers can catch them with pcall.
+func (rc runCtx) callFn() Function {
+	return std.MakeFn("call", func(args std.Args) (r []Val, err error) {
+		pk, name, function := args.GetString(), args.GetString(), args.GetString()
+
+		// the caller's result depends on which version the name points to, so it can't be cached by the caller's hash and input
+		rc.nondet.Store(true)
+
+		return rc.call(pk, name, function, args.List[3:])
+	})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/sha3"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/Heliodex/coputer/bundle"
+	. "github.com/Heliodex/coputer/litecode/types"
+	"github.com/Heliodex/coputer/litecode/vm/compile"
+)
+
+// running programs locally, without bundling and storing them over HTTP first
+
+// headerFlags collects repeated -H "name: value" flags, and a header can be given more than once
+type headerFlags Headers
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(map[string][]string(h))
+}
+
+func (h headerFlags) Set(s string) error {
+	k, v, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("invalid header %q, expected name: value", s)
+	}
+
+	Headers(h).Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	return nil
+}
+
+func webArgsUrl(target string) (WebArgsUrl, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return WebArgsUrl{}, fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	return WebArgsUrl{
+		Rawpath:  u.String(),
+		Path:     u.Path,
+		Rawquery: u.RawQuery,
+		Query:    u.Query(),
+	}, nil
+}
+
+// parseRequestLine parses a request line like "GET /path?a=b HTTP/1.1"
+func parseRequestLine(line string) (method, target, proto string, err error) {
+	parts := strings.Fields(line)
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", "", "", fmt.Errorf("invalid request line %q", line)
+	}
+	if len(parts) == 2 {
+		return parts[0], parts[1], "HTTP/1.1", nil
+	}
+	if !strings.HasPrefix(parts[2], "HTTP/") {
+		return "", "", "", fmt.Errorf("invalid protocol in request line %q", line)
+	}
+
+	return parts[0], parts[1], parts[2], nil
+}
+
+func printWebRets(rets WebRets) {
+	fmt.Println(rets.StatusCode, http.StatusText(rets.StatusCode))
+
+	names := make([]string, 0, len(rets.Headers))
+	for k := range rets.Headers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+
+	for _, k := range names {
+		for _, v := range rets.Headers[k] {
+			fmt.Printf("%s: %s\n", k, v)
+		}
+	}
+	fmt.Println()
+	os.Stdout.Write(rets.Body)
+	fmt.Println()
+}
+
+func runUsage(fs *flag.FlagSet) {
+	fmt.Fprintln(fs.Output(), "Usage: litecode run [flags] <file or directory>")
+	fmt.Fprintln(fs.Output(), "Single files have no coputer.json, so use -caps to give them capabilities like json, crypto, or programs.call.")
+	fs.PrintDefaults()
+}
+
+// useTempDataDir moves into a temporary directory, so a one-off run's programs, state, and results aren't stored in the data dir of a node running from here
+func useTempDataDir() (cleanup func(), err error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("get working directory: %w", err)
+	}
+
+	tmp, err := os.MkdirTemp("", "litecode-run")
+	if err != nil {
+		return nil, fmt.Errorf("create data directory: %w", err)
+	}
+	if err = os.Chdir(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("enter data directory: %w", err)
+	}
+
+	return func() {
+		os.Chdir(wd)
+		os.RemoveAll(tmp)
+	}, nil
+}
+
+// loadProgram bundles and stores a program the same way the execution server does, returning its hash
+func loadProgram(path string) (hexhash string, err error) {
+	b, err := bundle.Bundle(path)
+	if err != nil {
+		return "", fmt.Errorf("bundle program: %w", err)
+	}
+
+	if _, err = bundle.UnbundleToDir(b); err != nil {
+		return "", fmt.Errorf("store program: %w", err)
+	}
+
+	hash := sha3.Sum256(b)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// grantCaps adds capabilities to a stored program's metadata, so a one-off run can use them
+func grantCaps(hexhash string, caps []string) error {
+	meta, err := bundle.ReadMeta(hexhash)
+	if err != nil {
+		return fmt.Errorf("read program metadata: %w", err)
+	}
+	for _, c := range caps {
+		if c = strings.TrimSpace(c); c != "" {
+			meta.Capabilities = append(meta.Capabilities, c)
+		}
+	}
+
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("encode program metadata: %w", err)
+	}
+	if err = os.WriteFile(filepath.Join(bundle.ProgramsDir, hexhash, bundle.MetaFilename), b, 0o644); err != nil {
+		return fmt.Errorf("write program metadata: %w", err)
+	}
+	return nil
+}
+
+func webArgsFromFlags(method, target, request, body, bodyFile, argsFile string, headers headerFlags) (args WebArgs, err error) {
+	if argsFile != "" {
+		b, err := os.ReadFile(argsFile)
+		if err != nil {
+			return WebArgs{}, fmt.Errorf("read args file: %w", err)
+		}
+		return DecodeArgs[WebArgs](b)
+	}
+
+	args.Protocol = "HTTP/1.1"
+	if request != "" {
+		// a request line overrides -method and -url
+		if method, target, args.Protocol, err = parseRequestLine(request); err != nil {
+			return
+		}
+	}
+
+	if args.Url, err = webArgsUrl(target); err != nil {
+		return
+	}
+	args.Method = strings.ToUpper(method)
+	args.Headers = Headers(headers)
+	args.Scheme = "http"
+	if args.Host = args.Headers.Get("host"); args.Host == "" {
+		args.Host = "localhost"
+	}
+
+	switch {
+	case bodyFile != "" && body != "":
+		return WebArgs{}, errors.New("only one of -body and -body-file can be used")
+	case bodyFile != "":
+		if args.Body, err = os.ReadFile(bodyFile); err != nil {
+			return WebArgs{}, fmt.Errorf("read body file: %w", err)
+		}
+	default:
+		args.Body = []byte(body)
+	}
+	return
+}
+
+func runCmd(argv []string) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.Usage = func() { runUsage(fs) }
+
+	headers := headerFlags{}
+	method := fs.String("method", http.MethodGet, "HTTP method of the request")
+	target := fs.String("url", "/", "URL (path and query) of the request")
+	request := fs.String("request", "", `HTTP request line to simulate, like "POST /submit?a=b HTTP/1.1" (overrides -method and -url)`)
+	body := fs.String("body", "", "body of the request")
+	bodyFile := fs.String("body-file", "", "file to read the body of the request from")
+	argsFile := fs.String("args", "", "JSON file containing web args (overrides all other request flags)")
+	jsonOut := fs.Bool("json", false, "print the result as JSON")
+	o := fs.Uint("O", 1, "optimisation level to compile with")
+	caps := fs.String("caps", "", `capabilities to grant the program, like "json,programs.call", as if declared in its coputer.json (for single files, which can't have one)`)
+	fs.Var(headers, "H", `request header, like "content-type: text/plain" (can be repeated)`)
+
+	if err := fs.Parse(argv); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		runUsage(fs)
+		return 2
+	}
+
+	args, err := webArgsFromFlags(*method, *target, *request, *body, *bodyFile, *argsFile, headers)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid arguments:", err)
+		return 2
+	}
+
+	allowedCaps = loadAllowedCaps()
+
+	dir, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	cleanup, err := useTempDataDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer cleanup()
+
+	hexhash, err := loadProgram(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *caps != "" {
+		if err = grantCaps(hexhash, strings.Split(*caps, ",")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	name := filepath.Base(dir)
+	if args.Program == (WebArgsProgram{}) {
+		args.Program = WebArgsProgram{Pk: "local", Name: name}
+	}
+
+	c := compile.MakeCompiler(uint8(*o))
+	output, err := Start(c, "local", name, hexhash, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Program failed:", err)
+		return 1
+	}
+
+	if *jsonOut {
+		os.Stdout.Write(output.Encode())
+		fmt.Println()
+		return 0
+	}
+
+	rets, ok := output.(WebRets)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Program returned %T, not web results\n", output)
+		return 1
+	}
+
+	printWebRets(rets)
+	return 0
+}
@@ -7,3 +7,13 @@ require golang.org/x/text v0.26.0
 require github.com/Heliodex/coputer/bundle v0.0.0-20250622152943-83f44d21f6b9
 
 replace github.com/Heliodex/coputer/bundle => ../bundle
+
+require github.com/Heliodex/coputer/ast v0.0.0
+
+replace github.com/Heliodex/coputer/ast => ../ast
+
+require github.com/Heliodex/coputer/sig v0.0.0
+
+require filippo.io/edwards25519 v1.2.0 // indirect
+
+replace github.com/Heliodex/coputer/sig => ../sig
@@ -69,6 +69,10 @@ func (e *CoError) Error() string {
 	return fmt.Sprintf("%s:%d: function %s\n%s", e.Path, e.Line, e.Dbgname, e.Sub.Error())
 }
 
+func (e *CoError) Unwrap() error {
+	return e.Sub
+}
+
 // Yield represents a coroutine yield, containing the return values or error if one occurred.
 type Yield struct {
 	Rets []Val
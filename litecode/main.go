@@ -3,15 +3,20 @@ package main
 import (
 	"crypto/sha3"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/Heliodex/coputer/bundle"
+	"github.com/Heliodex/coputer/litecode/cache"
 	. "github.com/Heliodex/coputer/litecode/types"
+	"github.com/Heliodex/coputer/litecode/vm"
 	"github.com/Heliodex/coputer/litecode/vm/compile"
 )
 
@@ -62,7 +67,36 @@ func findExists(w http.ResponseWriter, hexhash string) (b bool) {
 	return true
 }
 
-func runWeb(w http.ResponseWriter, r *http.Request, hexhash string, c Compiler /* lel c */, errCache map[[32]byte]map[[32]byte]error, runCache map[[32]byte]map[[32]byte]ProgramRets) {
+// nameHash finds the hash of the program a request's pk and name point to
+func nameHash(w http.ResponseWriter, r *http.Request) (hexhash string, ok bool) {
+	pk, name := r.PathValue("pk"), r.PathValue("name")
+	if !checkPK(w, pk) {
+		return
+	}
+
+	// fmt.Println("READING", filepath.Join(NamesDir, pk, name))
+	hash, err := os.ReadFile(filepath.Join(NamesDir, pk, name))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	hexhash = hex.EncodeToString(hash)
+	if _, ok := checkHash(w, hexhash); !ok {
+		return "", false
+	}
+	return hexhash, true
+}
+
+// runError sends an error from running a program, with its class so callers know whose fault it was
+func runError(w http.ResponseWriter, err error) {
+	c := ErrorClassOf(err)
+	w.Header().Set(ErrorClassHeader, c.String())
+	http.Error(w, err.Error(), c.Status())
+}
+
+// runProgram runs a program with the args in a request. Web programs are streamed if ws isn't nil.
+func runProgram[T ProgramArgs](w http.ResponseWriter, r *http.Request, hexhash string, c Compiler /* lel c */, results *cache.Cache, ws *webStream) {
 	hash, ok := checkHash(w, hexhash)
 	if !ok {
 		return
@@ -73,59 +107,149 @@ func runWeb(w http.ResponseWriter, r *http.Request, hexhash string, c Compiler /
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	inputhash := sha3.Sum256(input) // let's hope it's canonical
 
 	// decode input as json
-	args, err := DecodeArgs[WebArgs](input)
+	args, err := DecodeArgs[T](input)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	inputhash := InputHash(args) // re-encoded, so it's canonical
 
 	if !findExists(w, hexhash) {
 		return
 	}
 
-	if err, ok := errCache[hash][inputhash]; ok {
+	respond := func(output []byte) {
+		w.Write(output)
+	}
+	fail := func(err error) {
+		runError(w, err)
+	}
+	if ws != nil {
+		respond = func(output []byte) {
+			rets, err := DecodeRets[WebRets](output)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			ws.finish(rets)
+		}
+		fail = ws.fail
+	}
+
+	call, err := CallChainFromHeaders(r.Header)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if res, ok := runCache[hash][inputhash]; ok {
-		b := res.Encode()
+	rc := newRunCtx(c, hexhash)
+	rc.stream = ws
+	rc.results = results
+	if err = rc.join(call); err != nil {
+		fail(err)
+		return
+	}
+	p := program{r.PathValue("pk"), r.PathValue("name")}
+
+	// stateful programs give different results as their state changes
+	if stateful(hexhash) {
+		if p.pk == "" {
+			http.Error(w, "Stateful programs must be run by name", http.StatusBadRequest)
+			return
+		}
 
-		w.Write(b)
+		rc.state = new(StateTransition)
+		output, err := start(p, hexhash, args, rc)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		// so wallflower can send the transition to peers, which check it by running the program themselves
+		prefix := ""
+		if ws != nil && ws.started {
+			prefix = http.TrailerPrefix
+		}
+		w.Header().Set(prefix+StateBaseHeader, hex.EncodeToString(rc.state.Base[:]))
+		w.Header().Set(prefix+StateRootHeader, hex.EncodeToString(rc.state.Root[:]))
+
+		respond(output.Encode())
+		return
+	}
+
+	key := cache.Key{Program: hash, Input: inputhash}
+	if res, ok := results.Get(key); ok {
+		if res.Err != "" {
+			// only program errors are cached
+			fail(ClassifyError(ProgramError, errors.New(res.Err)))
+			return
+		}
+		respond(res.Output)
 		return
 	}
 
 	// rets program
-	output, err := Start(c, hexhash, args)
+	output, err := start(p, hexhash, args, rc)
 	if err != nil {
-		if errCache[hash] == nil {
-			errCache[hash] = make(map[[32]byte]error, 1)
+		// timeouts and failures of this node might not happen next time
+		if ErrorClassOf(err).Deterministic() && !rc.nondet.Load() {
+			results.Put(key, cache.Result{Err: err.Error()}, resultTTL(hexhash, nil))
 		}
-		errCache[hash][inputhash] = err
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		fail(err)
 		return
 	}
 
-	if runCache[hash] == nil {
-		runCache[hash] = make(map[[32]byte]ProgramRets, 1)
+	b := output.Encode()
+	if !rc.nondet.Load() {
+		results.Put(key, cache.Result{Output: b}, resultTTL(hexhash, output))
 	}
-	runCache[hash][inputhash] = output
+	respond(b)
+}
 
-	b := output.Encode()
+// loadAllowedCaps reads the capabilities file, which lists the capabilities this node allows programs to use.
+func loadAllowedCaps() []string {
+	const capsFile = "capabilities"
+
+	b, err := os.ReadFile(capsFile)
+	if os.IsNotExist(err) {
+		return nil // all capabilities allowed
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read capabilities file %s: %v\n", capsFile, err)
+		os.Exit(1)
+	}
 
-	w.Write(b)
+	allowed := []string{} // not nil, an empty file allows nothing
+	for line := range strings.SplitSeq(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			allowed = append(allowed, line)
+		}
+	}
+	return allowed
 }
 
-func main() {
+func serve() {
 	c := compile.MakeCompiler(1)
+	if allowedCaps = loadAllowedCaps(); allowedCaps == nil {
+		fmt.Println("No capabilities file found, all capabilities are allowed")
+	} else {
+		fmt.Println("Allowed capabilities:", strings.Join(allowedCaps, ", "))
+	}
 
-	// just 1 error cache, as different inputs may result in errors/not
+	// errors are cached per input too, as different inputs may result in errors/not
 	// (we don't want one error to bring down the whole program for every user)
-	errCache := make(map[[32]byte]map[[32]byte]error)
-	runCache := make(map[[32]byte]map[[32]byte]ProgramRets)
+	cacheCfg, err := loadCacheConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read cache config:", err)
+		os.Exit(1)
+	}
+	results, err := cache.New(cacheCfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to create result cache:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Loaded", results.Stats().Entries, "cached results")
 
 	// store program (bundled version)
 	http.HandleFunc("PUT /store/{pk}/{name}", func(w http.ResponseWriter, r *http.Request) {
@@ -141,38 +265,151 @@ func main() {
 			return
 		}
 
-		if err := os.MkdirAll(filepath.Join(NamesDir, pk), 0o755); err != nil {
+		hash := sha3.Sum256(data)
+		hexhash := hex.EncodeToString(hash[:])
+		p := program{pk, name}
+
+		v, err := versionFromHeaders(r.Header, pk, hexhash)
+		if errors.Is(err, errUnsigned) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if err = v.Verify(p.pk, p.name); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		exists := bundle.BundleStored(hexhash)
+		if !exists {
+			if _, err = bundle.UnbundleToDir(data); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest) // status whatever, reeks of ego anyway
+				return
+			}
+		}
+		if err = keepBundle(hexhash, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-		// fmt.Println("CREATING", filepath.Join(NamesDir, pk, name))
-		f, err := os.Create(filepath.Join(NamesDir, pk, name))
+		old, current, err := addVersion(p, v)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest) // status whatever, reeks of ego anyway
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer f.Close()
+		// results of the version the name pointed to before won't be needed again
+		if current && old != hash && old != [32]byte{} {
+			results.Invalidate(old)
+		}
 
-		hash := sha3.Sum256(data)
+		if exists {
+			http.Error(w, "Program already exists", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
 
-		if _, err = f.Write(hash[:]); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+	// history of a program name, oldest first
+	http.HandleFunc("GET /versions/{pk}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		pk := r.PathValue("pk")
+		if !checkPK(w, pk) {
 			return
 		}
 
-		// Write to file after creating names paths
-		if hexhash := hex.EncodeToString(hash[:]); bundle.BundleStored(hexhash) {
-			http.Error(w, "Program already exists", http.StatusConflict)
+		vs, err := readVersions(program{pk, r.PathValue("name")})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if len(vs) == 0 {
+			http.Error(w, "No versions found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vs)
+	})
+
+	// a version's bundle, with its signature, so it can be given to peers
+	http.HandleFunc("GET /versions/{pk}/{name}/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		pk, hexhash := r.PathValue("pk"), r.PathValue("hash")
+		if !checkPK(w, pk) {
+			return
+		}
+		if _, ok := checkHash(w, hexhash); !ok {
+			return
+		}
+
+		v, ok, err := findVersion(program{pk, r.PathValue("name")}, hexhash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			http.Error(w, "Version not found", http.StatusNotFound)
+			return
+		}
+
+		b, err := readBundle(hexhash)
+		if err != nil {
+			http.Error(w, "Bundle not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set(VersionTimeHeader, strconv.FormatInt(v.Time, 10))
+		if v.Sig != nil {
+			w.Header().Set(SignatureHeader, hex.EncodeToString(v.Sig))
+		}
+		w.Write(b)
+	})
+
+	// point a name back to a version from its history, with a new signed version
+	http.HandleFunc("POST /rollback/{pk}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		pk := r.PathValue("pk")
+		if !checkPK(w, pk) {
 			return
 		}
+		p := program{pk, r.PathValue("name")}
 
-		if _, err = bundle.UnbundleToDir(data); err != nil {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		w.WriteHeader(http.StatusCreated)
+		v, err := DecodeVersion(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = v.Verify(p.pk, p.name); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		if _, ok, err := findVersion(p, v.Hash); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok || !bundle.BundleStored(v.Hash) {
+			http.Error(w, "Version not found", http.StatusNotFound)
+			return
+		}
+
+		old, current, err := addVersion(p, v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if current && old != v.HashBytes() && old != [32]byte{} {
+			results.Invalidate(old)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	http.HandleFunc("GET /cache/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results.Stats())
 	})
 
 	http.HandleFunc("GET /{pk}", func(w http.ResponseWriter, r *http.Request) {
@@ -214,13 +451,13 @@ func main() {
 		findExists(w, hexhash)
 	})
 
-	http.HandleFunc("POST /web/{pk}/{name}", func(w http.ResponseWriter, r *http.Request) {
+	// list the capabilities a program declares, and whether they're granted
+	http.HandleFunc("GET /capabilities/{pk}/{name}", func(w http.ResponseWriter, r *http.Request) {
 		pk, name := r.PathValue("pk"), r.PathValue("name")
 		if !checkPK(w, pk) {
 			return
 		}
 
-		// fmt.Println("READING", filepath.Join(NamesDir, pk, name))
 		hash, err := os.ReadFile(filepath.Join(NamesDir, pk, name))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
@@ -228,13 +465,153 @@ func main() {
 		}
 
 		hexhash := hex.EncodeToString(hash)
-		if _, ok := checkHash(w, hexhash); !ok {
+		if !findExists(w, hexhash) {
 			return
 		}
 
-		runWeb(w, r, hexhash, c, errCache, runCache)
+		meta, err := bundle.ReadMeta(hexhash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		granted := vm.Effective(meta.Capabilities, allowedCaps)
+
+		w.WriteHeader(http.StatusOK)
+		for _, cp := range meta.Capabilities {
+			status := "denied"
+			if vm.Granted(cp, granted) {
+				status = "granted"
+			}
+			fmt.Fprintln(w, cp, status)
+		}
+	})
+
+	// a stateful program's current state, so peers can replicate it
+	http.HandleFunc("GET /state/{pk}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		pk := r.PathValue("pk")
+		if !checkPK(w, pk) {
+			return
+		}
+		p := program{pk, r.PathValue("name")}
+
+		root, ok, err := stateRoot(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			http.Error(w, "State not found", http.StatusNotFound)
+			return
+		}
+
+		s, err := readState(root)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set(StateRootHeader, hex.EncodeToString(root[:]))
+		w.Write(s.Encode())
+	})
+
+	// replace a stateful program's state with a peer's, when we've missed transitions. The state has to have the root in the header, which wallflower got from the transition.
+	http.HandleFunc("PUT /state/{pk}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		pk := r.PathValue("pk")
+		if !checkPK(w, pk) {
+			return
+		}
+		p := program{pk, r.PathValue("name")}
+
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s, err := DecodeState(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if root := s.Root(); r.Header.Get(StateRootHeader) != hex.EncodeToString(root[:]) {
+			http.Error(w, "State doesn't match root", http.StatusBadRequest)
+			return
+		}
+
+		unlock := lockState(p)
+		defer unlock()
+
+		if _, err = saveState(p, s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	http.HandleFunc("POST /web/{pk}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if hexhash, ok := nameHash(w, r); ok {
+			runProgram[WebArgs](w, r, hexhash, c, results, nil)
+		}
+	})
+
+	// web programs, with the response head sent before the body, and the body sent as it's written
+	http.HandleFunc("POST /webstream/{pk}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if hexhash, ok := nameHash(w, r); ok {
+			runProgram[WebArgs](w, r, hexhash, c, results, &webStream{w: w})
+		}
+	})
+
+	http.HandleFunc("POST /scheduled/{pk}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if hexhash, ok := nameHash(w, r); ok {
+			runProgram[ScheduledArgs](w, r, hexhash, c, results, nil)
+		}
+	})
+
+	http.HandleFunc("POST /library/{pk}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if hexhash, ok := nameHash(w, r); ok {
+			runProgram[LibraryArgs](w, r, hexhash, c, results, nil)
+		}
+	})
+
+	// running a program by its hash, whatever version its name points to
+	http.HandleFunc("POST /web/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		runProgram[WebArgs](w, r, r.PathValue("hash"), c, results, nil)
+	})
+
+	http.HandleFunc("POST /webstream/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		runProgram[WebArgs](w, r, r.PathValue("hash"), c, results, &webStream{w: w})
+	})
+
+	http.HandleFunc("POST /scheduled/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		runProgram[ScheduledArgs](w, r, r.PathValue("hash"), c, results, nil)
+	})
+
+	http.HandleFunc("POST /library/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		runProgram[LibraryArgs](w, r, r.PathValue("hash"), c, results, nil)
 	})
 
 	fmt.Println("Listening on port 2505")
 	panic(http.ListenAndServe(":2505", nil))
 }
+
+func main() {
+	if len(os.Args) <= 1 {
+		fmt.Println("Starting execution server...")
+		serve()
+		return
+	}
+
+	switch os.Args[1] {
+	case "serve":
+		fmt.Println("Starting execution server...")
+		serve()
+	case "run":
+		os.Exit(runCmd(os.Args[2:]))
+	case "repl":
+		os.Exit(replCmd(os.Args[2:]))
+	default:
+		fmt.Printf("Unknown command: %s\n", os.Args[1])
+		fmt.Println("Available commands: serve, run, repl")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Heliodex/coputer/ast/parse"
+	. "github.com/Heliodex/coputer/litecode/types"
+	"github.com/Heliodex/coputer/litecode/vm"
+	"github.com/Heliodex/coputer/litecode/vm/compile"
+	"github.com/Heliodex/coputer/litecode/vm/std"
+)
+
+// an interactive REPL, where globals persist between entries
+
+const replHelp = `Enter Luau expressions or statements. Globals persist between entries, locals don't.
+Ctrl-C stops an entry that's running.
+Commands:
+  :load <file>  run a file in the current environment
+  :reset        clear the environment
+  :type <expr>  print the type of an expression
+  :help         show this message
+  :quit         exit`
+
+type repl struct {
+	c       Compiler
+	o       uint8
+	env     Env
+	dir     string        // where entries are written to be compiled
+	timeout time.Duration // how long each entry can run for
+	n       int
+}
+
+var errInterrupted = errors.New("interrupted")
+
+func replPrint(args std.Args) (r []Val, err error) {
+	s := make([]string, len(args.List))
+	for i, arg := range args.List {
+		s[i] = std.ToString(arg)
+	}
+	fmt.Println(strings.Join(s, "\t"))
+	return
+}
+
+func (r *repl) reset() {
+	caps := make([]string, 0, len(vm.Capabilities))
+	for name := range vm.Capabilities {
+		caps = append(caps, name)
+	}
+
+	r.env = vm.Compose(nil, vm.Capabilities, vm.Effective(caps, allowedCaps))
+	r.env.AddFn(std.MakeFn("print", replPrint))
+}
+
+func unfinished(src string) bool {
+	ok, res := parse.Parse(src, parse.Options{})
+	if ok {
+		return false
+	}
+
+	for _, e := range res.Errors {
+		switch {
+		case strings.HasPrefix(e.Message, "Expected <eof>"):
+			// extra tokens, more input won't fix it
+		case strings.HasSuffix(e.Message, "got <eof>"),
+			strings.HasSuffix(e.Message, "got unfinished comment"):
+			return true
+		case strings.HasPrefix(e.Message, "Malformed string"):
+			// only long strings can go over multiple lines
+			start := min(lineOffset(src, e.Location.Begin.Line)+int(e.Location.Begin.Column), len(src))
+			if strings.HasPrefix(src[start:], "[") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// incomplete reports whether an entry failed to parse only because it ended too early, so more lines should be read
+func incomplete(src string) bool {
+	if ok, _ := parse.Parse(src, parse.Options{}); ok {
+		return false
+	}
+	if ok, _ := parse.Parse("return "+src, parse.Options{}); ok {
+		return false
+	}
+	return unfinished(src) || unfinished("return "+src)
+}
+
+func lineOffset(src string, line uint32) (o int) {
+	for range line {
+		i := strings.IndexByte(src[o:], '\n')
+		if i == -1 {
+			return len(src)
+		}
+		o += i + 1
+	}
+	return
+}
+
+// chunk turns an entry into a program, returning expressions so their values get printed
+func chunk(src string) string {
+	if ok, _ := parse.Parse("return "+src, parse.Options{}); ok {
+		return "return " + src
+	}
+	return src
+}
+
+func (r *repl) run(path string, c Compiler) ([]Val, error) {
+	p, err := compile.Compile(c, path)
+	if err != nil {
+		return nil, err
+	}
+
+	co, cancel := vm.LoadMutable(p, r.env, TestArgs{})
+
+	// ctrl-c stops the entry instead of the REPL
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	var interrupted atomic.Bool
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-interrupt:
+			interrupted.Store(true)
+			cancel()
+		case <-done:
+		}
+	}()
+
+	timer := time.AfterFunc(r.timeout, cancel)
+	vals, err := co.Resume()
+	timedOut := !timer.Stop()
+
+	switch {
+	case interrupted.Load():
+		return nil, errInterrupted
+	case timedOut:
+		return nil, errTimeout
+	}
+	return vals, err
+}
+
+func (r *repl) eval(src string) ([]Val, error) {
+	r.n++
+	path := filepath.Join(r.dir, strconv.Itoa(r.n))
+	if err := os.WriteFile(path+compile.Ext, []byte(src), 0o644); err != nil {
+		return nil, err
+	}
+
+	return r.run(path, r.c)
+}
+
+func (r *repl) load(file string) ([]Val, error) {
+	path, err := filepath.Abs(strings.TrimSuffix(file, compile.Ext))
+	if err != nil {
+		return nil, err
+	}
+
+	// new compiler, as the file may have changed since it was last loaded
+	return r.run(path, compile.MakeCompiler(r.o))
+}
+
+func printVals(vals []Val) {
+	if len(vals) == 0 {
+		return
+	}
+
+	s := make([]string, len(vals))
+	for i, v := range vals {
+		s[i] = std.ToString(v)
+	}
+	fmt.Println(strings.Join(s, "\t"))
+}
+
+// command runs a REPL command, returning false to exit
+func (r *repl) command(line string) bool {
+	cmd, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch cmd {
+	case ":quit", ":q", ":exit":
+		return false
+	case ":help":
+		fmt.Println(replHelp)
+	case ":reset":
+		r.reset()
+		fmt.Println("Environment reset")
+	case ":load":
+		if arg == "" {
+			fmt.Println("Usage: :load <file>")
+			break
+		}
+
+		vals, err := r.load(arg)
+		if err != nil {
+			fmt.Println("Error:", err)
+			break
+		}
+		printVals(vals)
+	case ":type":
+		if arg == "" {
+			fmt.Println("Usage: :type <expr>")
+			break
+		}
+
+		// whatever type() says, the same as a program would see
+		vals, err := r.eval("return type(" + arg + ")")
+		if err != nil {
+			fmt.Println("Error:", err)
+			break
+		}
+		printVals(vals)
+	default:
+		fmt.Printf("Unknown command %s, see :help\n", cmd)
+	}
+	return true
+}
+
+func replCmd(argv []string) int {
+	fs := flag.NewFlagSet("repl", flag.ContinueOnError)
+	o := fs.Uint("O", 1, "optimisation level to compile with")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long each entry can run for")
+	if err := fs.Parse(argv); err != nil {
+		return 2
+	}
+
+	dir, err := os.MkdirTemp("", "litecode-repl")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	allowedCaps = loadAllowedCaps()
+
+	r := &repl{
+		c:       compile.MakeCompiler(uint8(*o)),
+		o:       uint8(*o),
+		dir:     dir,
+		timeout: *timeout,
+	}
+	r.reset()
+
+	fmt.Println("litecode REPL, :help for help")
+
+	in := bufio.NewScanner(os.Stdin)
+	var entry strings.Builder
+
+	for {
+		if entry.Len() == 0 {
+			fmt.Print("> ")
+		} else {
+			fmt.Print(">> ")
+		}
+
+		if !in.Scan() {
+			fmt.Println()
+			return 0
+		}
+		line := in.Text()
+
+		if entry.Len() == 0 {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if strings.HasPrefix(line, ":") {
+				if !r.command(strings.TrimSpace(line)) {
+					return 0
+				}
+				continue
+			}
+		} else {
+			entry.WriteByte('\n')
+		}
+		entry.WriteString(line)
+
+		src := entry.String()
+		if incomplete(src) {
+			continue
+		}
+		entry.Reset()
+
+		vals, err := r.eval(chunk(src))
+		if err != nil {
+			fmt.Println("Error:", err)
+			continue
+		}
+		printVals(vals)
+	}
+}
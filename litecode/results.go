@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Heliodex/coputer/bundle"
+	"github.com/Heliodex/coputer/litecode/cache"
+	. "github.com/Heliodex/coputer/litecode/types"
+)
+
+// caching the results of program runs
+
+const CacheDir = bundle.DataDir + "/cache"
+
+// loadCacheConfig reads the cache file, which has a setting on each line, like "entries 10000".
+// Settings are entries and bytes (the most results and bytes kept), ttl (how long results are kept by default, like "1h"), and persist (false to keep results only in memory).
+func loadCacheConfig() (cfg cache.Config, err error) {
+	const cacheFile = "cache"
+
+	cfg = cache.Config{
+		MaxEntries: 10000,
+		MaxBytes:   64 << 20,
+		Dir:        CacheDir,
+	}
+
+	b, err := os.ReadFile(cacheFile)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	} else if err != nil {
+		return
+	}
+
+	for line := range strings.SplitSeq(string(b), "\n") {
+		k, v, _ := strings.Cut(strings.TrimSpace(line), " ")
+		v = strings.TrimSpace(v)
+
+		switch k {
+		case "":
+		case "entries":
+			cfg.MaxEntries, err = strconv.Atoi(v)
+		case "bytes":
+			cfg.MaxBytes, err = strconv.ParseInt(v, 10, 64)
+		case "ttl":
+			cfg.TTL, err = time.ParseDuration(v)
+		case "persist":
+			var persist bool
+			if persist, err = strconv.ParseBool(v); !persist {
+				cfg.Dir = ""
+			}
+		default:
+			return cfg, fmt.Errorf("unknown setting %q in %s", k, cacheFile)
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("invalid %s setting in %s: %w", k, cacheFile, err)
+		}
+	}
+	return
+}
+
+// cacheControlTTL reads a web program's cache-control header. ok is false if it doesn't have one that sets how long to cache for.
+func cacheControlTTL(h Headers) (ttl time.Duration, ok bool) {
+	maxAge, sMaxAge := -1, -1
+	for _, line := range h.Values("cache-control") {
+		for d := range strings.SplitSeq(line, ",") {
+			k, v, _ := strings.Cut(strings.ToLower(strings.TrimSpace(d)), "=")
+
+			switch k {
+			// we're a shared cache
+			case "no-store", "no-cache", "private":
+				return -1, true
+			case "max-age":
+				if n, err := strconv.Atoi(strings.Trim(v, `"`)); err == nil {
+					maxAge = n
+				}
+			case "s-maxage":
+				if n, err := strconv.Atoi(strings.Trim(v, `"`)); err == nil {
+					sMaxAge = n
+				}
+			}
+		}
+	}
+
+	if sMaxAge >= 0 { // overrides max-age for shared caches
+		maxAge = sMaxAge
+	}
+	switch {
+	case maxAge < 0:
+		return 0, false
+	case maxAge == 0:
+		return -1, true // stale straight away
+	}
+	return time.Duration(maxAge) * time.Second, true
+}
+
+// resultTTL decides how long a result is cached for: a web program's cache-control header, then the program's TTL, then the cache's default
+func resultTTL(hexhash string, output ProgramRets) time.Duration {
+	if rets, ok := output.(WebRets); ok {
+		if ttl, ok := cacheControlTTL(rets.Headers); ok {
+			return ttl
+		}
+	}
+
+	meta, err := bundle.ReadMeta(hexhash)
+	if err != nil {
+		return 0
+	}
+	return meta.CacheTTL()
+}
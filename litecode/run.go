@@ -3,89 +3,232 @@ package main
 import (
 	"errors"
 	"fmt"
+	"maps"
 	"net/http"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/Heliodex/coputer/bundle"
 	. "github.com/Heliodex/coputer/litecode/types"
 	"github.com/Heliodex/coputer/litecode/vm"
 	"github.com/Heliodex/coputer/litecode/vm/compile"
+	"github.com/Heliodex/coputer/litecode/vm/std"
 )
 
-func startWeb(v any) (rets WebRets, err error) {
-	t, ok := v.(*Table)
-	if !ok {
+// webRes is what a web program returns, before defaults are applied
+type webRes struct {
+	StatusCode *int           `luau:"statuscode"`
+	Headers    map[string]Val `luau:"headers"` // string, or list of strings
+	Body       Val            `luau:"body"`    // buffer, or function to stream the body
+}
+
+// webHeaders normalises the headers a web program returns
+func webHeaders(h map[string]Val) (Headers, error) {
+	if h == nil {
+		return nil, nil
+	}
+
+	hs := make(map[string][]string, len(h))
+	for k, v := range h {
+		switch tv := v.(type) {
+		case string:
+			hs[k] = []string{tv}
+		case *Table:
+			var vs []string
+			if err := Unmarshal(tv, &vs); err != nil {
+				return nil, fmt.Errorf("invalid header '%s': %w", k, err)
+			}
+			hs[k] = vs
+		default:
+			return nil, fmt.Errorf("header '%s' must be a string or a list of strings", k)
+		}
+	}
+	return NewHeaders(hs), nil
+}
+
+// streamBody calls a body function with a write function, sending each chunk as it's written. The body is the chunks joined together, so it's the same whether streamed or not.
+func streamBody(co Coroutine, f Function, stream *webStream) (body []byte, err error) {
+	var writeErr error
+	write := std.MakeFn("write", func(args std.Args) (r []Val, err error) {
+		var chunk []byte
+		switch c := args.GetAny().(type) {
+		case string:
+			chunk = []byte(c)
+		case *Buffer:
+			chunk = *c
+		default:
+			return nil, errors.New("chunk must be a string or buffer")
+		}
+
+		body = append(body, chunk...)
+		if stream != nil {
+			writeErr = stream.write(chunk)
+		}
+		return nil, writeErr
+	})
+
+	if _, err = vm.Call(co, f, write); writeErr != nil {
+		// not the program's fault, probably the client going away
+		return nil, ClassifyError(InfraError, writeErr)
+	}
+	return
+}
+
+func startWeb(co Coroutine, v Val, stream *webStream) (rets WebRets, err error) {
+	if _, ok := v.(*Table); !ok {
 		return WebRets{}, errors.New("web program did not return a table")
 	}
 
-	// ahh, error checking beauty
+	var res webRes
+	if err = Unmarshal(v, &res); err != nil {
+		return WebRets{}, fmt.Errorf("invalid web program return: %w", err)
+	}
 
-	var tstatuscode float64
-	if statuscode := t.GetHash("statuscode"); statuscode == nil {
-		tstatuscode = 200
-	} else if tstatuscode, ok = statuscode.(float64); !ok {
-		return WebRets{}, errors.New("return statuscode, if provided, must be a number")
+	rets.StatusCode = 200
+	if res.StatusCode != nil {
+		rets.StatusCode = *res.StatusCode
 	}
-	rets.StatusCode = int(tstatuscode)
 	if rets.StatusCode < 100 || rets.StatusCode > 599 {
 		return WebRets{}, errors.New("return statuscode, if provided, must be between 100 and 599")
 	}
-
-	if headers := t.GetHash("headers"); headers != nil {
-		theaders, ok := headers.(*Table)
-		if !ok {
-			return WebRets{}, errors.New("return headers, if provided, must be a table")
-		}
-		rets.Headers = make(map[string]string, len(theaders.Hash))
-
-		// we don't have to care about the list content, but we will here
-		for k, v := range theaders.Iter() {
-			if tk, ok := k.(string); !ok {
-				return WebRets{}, errors.New("header keys must be strings")
-			} else if tv, ok := v.(string); !ok {
-				return WebRets{}, errors.New("header values must be strings")
-			} else {
-				rets.Headers[tk] = tv
-			}
-		}
+	if rets.Headers, err = webHeaders(res.Headers); err != nil {
+		return WebRets{}, err
 	}
 
-	if body := t.GetHash("body"); body != nil {
-		tbody, ok := body.(*Buffer)
-		if !ok {
-			return WebRets{}, errors.New("return body, if provided, must be a buffer")
+	switch body := res.Body.(type) {
+	case *Buffer:
+		rets.Body = *body
+	case Function:
+		// the head is sent first, then the body as it's written
+		if stream != nil {
+			stream.start(rets.Head())
 		}
-		rets.Body = *tbody
-	} else { // default to status message if no body
+		if rets.Body, err = streamBody(co, body, stream); err != nil {
+			return WebRets{}, err
+		}
+	case nil: // default to status message if no body
 		if rets.Headers == nil {
-			rets.Headers = make(map[string]string, 1)
+			rets.Headers = make(Headers, 1)
 		}
-		rets.Headers["content-type"] = "text/plain; charset=utf-8"
+		rets.Headers.Set("content-type", "text/plain; charset=utf-8")
 
 		sm := http.StatusText(rets.StatusCode)
 		if sm == "" {
 			sm = fmt.Sprintf("Error %d", rets.StatusCode)
 		}
 		rets.Body = []byte(sm)
+	default:
+		return WebRets{}, errors.New("return body, if provided, must be a buffer or a function")
+	}
+	return
+}
+
+func startScheduled(v Val) (rets ScheduledRets, err error) {
+	switch ret := v.(type) {
+	case nil:
+	case string:
+		rets.Body = []byte(ret)
+	case *Buffer:
+		rets.Body = *ret
+	default:
+		return ScheduledRets{}, errors.New("scheduled program did not return a string, buffer, or nil")
+	}
+	return
+}
+
+// startLibrary calls the requested function from the table a library program returns
+func startLibrary(co Coroutine, v Val, args LibraryArgs) (rets LibraryRets, err error) {
+	lib, ok := v.(*Table)
+	if !ok {
+		return LibraryRets{}, errors.New("library program did not return a table")
+	}
+
+	f, ok := lib.GetHash(args.Function).(Function)
+	if !ok {
+		return LibraryRets{}, fmt.Errorf("library has no function '%s'", args.Function)
+	}
+
+	vals, err := args.Vals()
+	if err != nil {
+		return LibraryRets{}, fmt.Errorf("invalid library args: %w", err)
+	}
+
+	r, err := vm.Call(co, f, vals...)
+	if err != nil {
+		return
+	}
+
+	if rets.Rets, err = SerialiseVals(r...); err != nil {
+		return LibraryRets{}, fmt.Errorf("invalid library function return: %w", err)
 	}
 	return
 }
 
-func Start(c Compiler, hash string, args ProgramArgs) (output ProgramRets, err error) {
-	p, err := compile.Compile(c, filepath.Join(bundle.ProgramsDir, hash, bundle.Entrypoint))
+// capabilities the node operator allows programs to use, nil if unrestricted
+var allowedCaps []string
+
+// programCaps returns the capabilities a stored program is granted.
+func programCaps(hash string) (granted []string, err error) {
+	meta, err := bundle.ReadMeta(hash)
 	if err != nil {
 		return
 	}
 
-	co, cancel := vm.Load(p, nil, args)
+	return vm.Effective(meta.Capabilities, allowedCaps), nil
+}
 
-	go func() {
-		time.Sleep(5 * time.Second)
-		cancel()
+// newRunCtx gives a program 5 seconds for it and any programs it calls to finish
+func newRunCtx(c Compiler, hash string) runCtx {
+	return runCtx{
+		c:        c,
+		deadline: time.Now().Add(5 * time.Second),
+		chain:    []string{hash},
+		nondet:   new(atomic.Bool),
+	}
+}
+
+// Start runs a stored program. pk and name identify the program's state, if it's stateful.
+func Start(c Compiler, pk, name, hash string, args ProgramArgs) (output ProgramRets, err error) {
+	return start(program{pk, name}, hash, args, newRunCtx(c, hash))
+}
+
+func start(p program, hash string, args ProgramArgs, rc runCtx) (output ProgramRets, err error) {
+	granted, err := programCaps(hash)
+	if err != nil {
+		return nil, ClassifyError(InfraError, err)
+	}
+
+	caps := maps.Clone(vm.Capabilities)
+	caps["programs.call"] = rc.callFn()
+
+	if vm.Granted("store", granted) {
+		return startStateful(p, hash, args, rc, caps, granted)
+	}
+	return run(hash, args, rc, caps, granted)
+}
+
+func run(hash string, args ProgramArgs, rc runCtx, caps map[string]Val, granted []string) (output ProgramRets, err error) {
+	// anything that goes wrong here is the program's fault, unless it's been classified otherwise
+	defer func() {
+		err = ClassifyError(ProgramError, err)
 	}()
 
+	p, err := compile.Compile(rc.c, filepath.Join(bundle.ProgramsDir, hash, bundle.Entrypoint))
+	if err != nil {
+		return
+	}
+
+	env := vm.Compose(nil, caps, granted)
+	co, cancel := vm.Load(p, env, args)
+
+	timer := time.AfterFunc(time.Until(rc.deadline), cancel)
+	defer timer.Stop()
+
 	r, err := co.Resume()
+	if time.Now().After(rc.deadline) {
+		return nil, errTimeout
+	}
 	if err != nil {
 		return
 	}
@@ -98,7 +241,19 @@ func Start(c Compiler, hash string, args ProgramArgs) (output ProgramRets, err e
 	case TestProgramType:
 		return nil, errors.New("test program type not supported in this context")
 	case WebProgramType:
-		return startWeb(ret)
+		output, err = startWeb(co, ret, rc.stream)
+		if time.Now().After(rc.deadline) {
+			return nil, errTimeout
+		}
+		return
+	case ScheduledProgramType:
+		return startScheduled(ret)
+	case LibraryProgramType:
+		output, err = startLibrary(co, ret, args.(LibraryArgs))
+		if time.Now().After(rc.deadline) {
+			return nil, errTimeout
+		}
+		return
 	}
 	return nil, errors.New("unknown program type")
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha3"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Heliodex/coputer/bundle"
+	"github.com/Heliodex/coputer/litecode/cache"
+	. "github.com/Heliodex/coputer/litecode/types"
+	"github.com/Heliodex/coputer/litecode/vm"
+	"github.com/Heliodex/coputer/litecode/vm/std"
+)
+
+// state of stateful programs (those granted the store capability), belonging to a name so it's kept when the program is updated
+// states are stored by root, and each name points to its current root
+
+const (
+	StatesDir     = bundle.DataDir + "/states"
+	StateNamesDir = bundle.DataDir + "/statenames"
+)
+
+// program identifies a stored program, which its state belongs to
+type program struct {
+	pk, name string
+}
+
+var stateLocks sync.Map // program -> *sync.Mutex
+
+// lockState stops other runs of a program from changing its state until unlocked, so runs are applied one at a time
+func lockState(p program) (unlock func()) {
+	l, _ := stateLocks.LoadOrStore(p, &sync.Mutex{})
+	mu := l.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+func stateful(hexhash string) bool {
+	granted, err := programCaps(hexhash)
+	return err == nil && vm.Granted("store", granted)
+}
+
+func stateRoot(p program) (root [32]byte, ok bool, err error) {
+	b, err := os.ReadFile(filepath.Join(StateNamesDir, p.pk, p.name))
+	if errors.Is(err, os.ErrNotExist) {
+		return root, false, nil
+	} else if err != nil {
+		return
+	}
+	if len(b) != 32 {
+		return root, false, errors.New("bad state root")
+	}
+	return [32]byte(b), true, nil
+}
+
+func readState(root [32]byte) (State, error) {
+	b, err := os.ReadFile(filepath.Join(StatesDir, hex.EncodeToString(root[:])))
+	if err != nil {
+		return nil, err
+	}
+	return DecodeState(b)
+}
+
+// loadState returns a program's current state, which is empty if it hasn't been written to yet
+func loadState(p program) (State, error) {
+	root, ok, err := stateRoot(p)
+	if err != nil || !ok {
+		return State{}, err
+	}
+	return readState(root)
+}
+
+// writeFile writes a file atomically, so it's never seen half-written
+func writeFile(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// pointState makes a stored state the current state of a program
+func pointState(p program, root [32]byte) error {
+	return writeFile(filepath.Join(StateNamesDir, p.pk, p.name), root[:])
+}
+
+// saveState stores a state and makes it the current state of a program
+func saveState(p program, s State) (root [32]byte, err error) {
+	b := s.Encode()
+	root = sha3.Sum256(b)
+
+	path := filepath.Join(StatesDir, hex.EncodeToString(root[:]))
+	if _, err = os.Stat(path); err != nil {
+		if err = writeFile(path, b); err != nil {
+			return
+		}
+	}
+	return root, pointState(p, root)
+}
+
+// a run of a stateful program gives the same result and new state for the same input and state, so they're cached together, keyed by the input and the state it ran on
+func stateKey(hexhash string, args ProgramArgs, base [32]byte) (k cache.Key, err error) {
+	hash, err := hex.DecodeString(hexhash)
+	if err != nil {
+		return
+	}
+
+	inputhash := InputHash(args)
+	return cache.Key{Program: [32]byte(hash), Input: sha3.Sum256(append(inputhash[:], base[:]...))}, nil
+}
+
+// decodeRets decodes the output of a run with args of a type
+func decodeRets(t ProgramType, b []byte) (ProgramRets, error) {
+	switch t {
+	case WebProgramType:
+		return DecodeRets[WebRets](b)
+	case LibraryProgramType:
+		return DecodeRets[LibraryRets](b)
+	case ScheduledProgramType:
+		return DecodeRets[ScheduledRets](b)
+	}
+	return nil, errors.New("unknown program type")
+}
+
+// cachedState returns the result and new state root of a run on a state, if it's been done before. Cached outputs start with the new root.
+func cachedState(results *cache.Cache, key cache.Key, t ProgramType) (output ProgramRets, root [32]byte, ok bool) {
+	if results == nil {
+		return
+	}
+
+	res, ok := results.Get(key)
+	if !ok || res.Err != "" || len(res.Output) < 32 {
+		return nil, root, false
+	}
+
+	output, err := decodeRets(t, res.Output[32:])
+	return output, [32]byte(res.Output), err == nil
+}
+
+// startStateful runs a stateful program on its current state, applying its writes if the run succeeds
+func startStateful(p program, hash string, args ProgramArgs, rc runCtx, caps map[string]Val, granted []string) (output ProgramRets, err error) {
+	unlock := lockState(p)
+	defer unlock()
+
+	base, err := loadState(p)
+	if err != nil {
+		return nil, ClassifyError(InfraError, fmt.Errorf("load state: %w", err))
+	}
+	tx := NewStateTxn(base)
+
+	key, err := stateKey(hash, args, tx.Root)
+	if err != nil {
+		return nil, ClassifyError(InfraError, err)
+	}
+
+	if output, root, ok := cachedState(rc.results, key, args.Type()); ok {
+		if root != tx.Root {
+			if err = pointState(p, root); err != nil {
+				return nil, ClassifyError(InfraError, err)
+			}
+		}
+		if rc.state != nil {
+			*rc.state = StateTransition{Base: tx.Root, Root: root}
+		}
+		return output, nil
+	}
+
+	caps["store"] = std.NewStore(tx)
+	if output, err = run(hash, args, rc, caps, granted); err != nil {
+		return // writes are discarded
+	}
+
+	root := tx.Root
+	if tx.Changed() {
+		if root, err = saveState(p, tx.Apply()); err != nil {
+			return nil, ClassifyError(InfraError, fmt.Errorf("save state: %w", err))
+		}
+	}
+	if rc.state != nil {
+		*rc.state = StateTransition{Base: tx.Root, Root: root}
+	}
+
+	if rc.results != nil && !rc.nondet.Load() {
+		rc.results.Put(key, cache.Result{Output: append(root[:], output.Encode()...)}, 0)
+	}
+	return
+}
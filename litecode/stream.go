@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/Heliodex/coputer/litecode/types"
+)
+
+// webStream sends a web program's response as it's written
+type webStream struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+// start sends the head, after which the status can't change
+func (s *webStream) start(h WebHead) {
+	s.started = true
+	s.w.Header().Set("Content-Type", WebStreamContentType)
+	s.w.WriteHeader(http.StatusOK)
+	s.w.Write(h.Encode())
+	http.NewResponseController(s.w).Flush()
+}
+
+func (s *webStream) write(b []byte) (err error) {
+	if _, err = s.w.Write(b); err != nil {
+		return
+	}
+	return http.NewResponseController(s.w).Flush()
+}
+
+// finish sends a response that wasn't streamed (or came from the cache) all at once
+func (s *webStream) finish(rets WebRets) {
+	if !s.started {
+		s.start(rets.Head())
+		s.w.Write(rets.Body)
+	}
+}
+
+// fail sends an error, as a trailer if the head has already been sent
+func (s *webStream) fail(err error) {
+	if !s.started {
+		runError(s.w, err)
+		return
+	}
+	s.w.Header().Set(http.TrailerPrefix+WebStreamErrorTrailer, err.Error())
+}
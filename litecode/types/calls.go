@@ -0,0 +1,72 @@
+package types
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CallChain is the programs running when one program calls another, first caller first, and when the first caller's time runs out. It's sent along with calls run through wallflower, so programs calling each other across nodes share one time limit, and cycles are found wherever the programs are run.
+type CallChain struct {
+	Hashes   [][32]byte
+	Deadline time.Time
+}
+
+// Headers a call chain is sent to the execution server and wallflower with.
+const (
+	// CallChainHeader is the hashes of the programs in a call chain, in hex, separated by commas.
+	CallChainHeader = "Coputer-Call-Chain"
+	// CallDeadlineHeader is when a call chain's time runs out, in unix milliseconds.
+	CallDeadlineHeader = "Coputer-Call-Deadline"
+)
+
+// Empty reports whether there's no chain, as the program wasn't called by another.
+func (c CallChain) Empty() bool {
+	return len(c.Hashes) == 0
+}
+
+// Contains reports whether a program is already running in the chain.
+func (c CallChain) Contains(hash [32]byte) bool {
+	return slices.Contains(c.Hashes, hash)
+}
+
+// SetHeaders adds a call chain to a request's headers, unless it's empty.
+func (c CallChain) SetHeaders(h http.Header) {
+	if c.Empty() {
+		return
+	}
+
+	hs := make([]string, len(c.Hashes))
+	for i, hash := range c.Hashes {
+		hs[i] = hex.EncodeToString(hash[:])
+	}
+	h.Set(CallChainHeader, strings.Join(hs, ","))
+	h.Set(CallDeadlineHeader, strconv.FormatInt(c.Deadline.UnixMilli(), 10))
+}
+
+// CallChainFromHeaders reads a call chain from a request's headers. Requests that aren't calls have an empty chain.
+func CallChainFromHeaders(h http.Header) (c CallChain, err error) {
+	s := h.Get(CallChainHeader)
+	if s == "" {
+		return
+	}
+
+	for hs := range strings.SplitSeq(s, ",") {
+		b, err := hex.DecodeString(strings.TrimSpace(hs))
+		if err != nil || len(b) != 32 {
+			return CallChain{}, fmt.Errorf("invalid hash %q in call chain", hs)
+		}
+		c.Hashes = append(c.Hashes, [32]byte(b))
+	}
+
+	ms, err := strconv.ParseInt(h.Get(CallDeadlineHeader), 10, 64)
+	if err != nil {
+		return CallChain{}, fmt.Errorf("invalid call deadline: %w", err)
+	}
+	c.Deadline = time.UnixMilli(ms)
+	return
+}
@@ -0,0 +1,34 @@
+package types
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCallChainHeaders(t *testing.T) {
+	c := CallChain{
+		Hashes:   [][32]byte{{1}, {2}},
+		Deadline: time.UnixMilli(1700000000000),
+	}
+
+	h := http.Header{}
+	c.SetHeaders(h)
+
+	c2, err := CallChainFromHeaders(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c2.Hashes) != 2 || !c2.Contains([32]byte{2}) || !c2.Deadline.Equal(c.Deadline) {
+		t.Fatal("call chain didn't round trip", c2)
+	}
+
+	if c3, err := CallChainFromHeaders(http.Header{}); err != nil || !c3.Empty() {
+		t.Fatal("expected empty call chain, got", c3, err)
+	}
+
+	h.Set(CallChainHeader, "nothex")
+	if _, err = CallChainFromHeaders(h); err == nil {
+		t.Fatal("expected error for invalid hash")
+	}
+}
@@ -0,0 +1,93 @@
+package types
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrorClass says what caused a program run to fail, which decides whether the failure can be cached, and how it's reported.
+type ErrorClass uint8
+
+const (
+	// InfraError is a failure of the node running the program, like a missing compiler or a failed disk read. Retrying, or running the program elsewhere, may succeed.
+	InfraError ErrorClass = iota
+	// ProgramError is a failure of the program itself, like a runtime error or an invalid return value. The same program always fails the same way with the same input.
+	ProgramError
+	// LimitError is a program running into a resource limit, like running out of time. Whether it does can depend on how busy the node is.
+	LimitError
+)
+
+// ErrorClassHeader is the header errors from running programs are sent with, containing the error class.
+const ErrorClassHeader = "Coputer-Error-Class"
+
+var errorClassNames = [...]string{
+	InfraError:   "infrastructure",
+	ProgramError: "program",
+	LimitError:   "limit",
+}
+
+func (c ErrorClass) String() string {
+	if int(c) < len(errorClassNames) {
+		return errorClassNames[c]
+	}
+	return errorClassNames[InfraError]
+}
+
+// ParseErrorClass parses the name of an error class. Unknown names are infrastructure errors.
+func ParseErrorClass(s string) ErrorClass {
+	for c, name := range errorClassNames {
+		if name == s {
+			return ErrorClass(c)
+		}
+	}
+	return InfraError
+}
+
+// Deterministic reports whether errors of the class happen every time for the same program and input, so they can be cached.
+func (c ErrorClass) Deterministic() bool {
+	return c == ProgramError
+}
+
+// Status returns the HTTP status errors of the class are reported with.
+func (c ErrorClass) Status() int {
+	switch c {
+	case ProgramError:
+		return http.StatusUnprocessableEntity
+	case LimitError:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// RunError is an error from running a program, with its class.
+type RunError struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *RunError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyError gives an error a class, unless it already has one.
+func ClassifyError(c ErrorClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := errors.AsType[*RunError](err); ok {
+		return err
+	}
+	return &RunError{c, err}
+}
+
+// ErrorClassOf returns the class of an error. Errors without a class are infrastructure errors, as it's not known whether they'll happen again.
+func ErrorClassOf(err error) ErrorClass {
+	if re, ok := errors.AsType[*RunError](err); ok {
+		return re.Class
+	}
+	return InfraError
+}
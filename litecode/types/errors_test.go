@@ -0,0 +1,29 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorClass(t *testing.T) {
+	err := ClassifyError(LimitError, errors.New("program timed out"))
+	wrapped := fmt.Errorf("call: %w", ClassifyError(ProgramError, err))
+
+	// the first class given sticks
+	if c := ErrorClassOf(wrapped); c != LimitError {
+		t.Fatal("expected limit error, got", c)
+	}
+	if ErrorClassOf(errors.New("disk on fire")) != InfraError {
+		t.Fatal("expected unclassified error to be an infrastructure error")
+	}
+
+	for _, c := range [...]ErrorClass{InfraError, ProgramError, LimitError} {
+		if ParseErrorClass(c.String()) != c {
+			t.Fatal("error class didn't round trip", c)
+		}
+	}
+	if !ProgramError.Deterministic() || LimitError.Deterministic() || InfraError.Deterministic() {
+		t.Fatal("only program errors should be deterministic")
+	}
+}
@@ -0,0 +1,85 @@
+package types
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Headers are HTTP headers. Names are lowercase, and each name's values are kept in the order they were given.
+type Headers map[string][]string
+
+// NewHeaders normalises headers, merging names that only differ in case.
+func NewHeaders(h map[string][]string) Headers {
+	nh := make(Headers, len(h))
+	// sorted, so merged values are always in the same order
+	for _, k := range slices.Sorted(maps.Keys(h)) {
+		nh.Add(k, h[k]...)
+	}
+	return nh
+}
+
+// Get returns the first value of a header, or an empty string if it isn't set.
+func (h Headers) Get(name string) string {
+	if vs := h[strings.ToLower(name)]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// Values returns all values of a header.
+func (h Headers) Values(name string) []string {
+	return h[strings.ToLower(name)]
+}
+
+// Add adds values to a header, after any it already has.
+func (h Headers) Add(name string, vs ...string) {
+	name = strings.ToLower(name)
+	h[name] = append(h[name], vs...)
+}
+
+// Set replaces the values of a header.
+func (h Headers) Set(name string, vs ...string) {
+	h[strings.ToLower(name)] = slices.Clone(vs)
+}
+
+// Equal reports whether two sets of headers have the same names and values.
+func (h Headers) Equal(h2 Headers) bool {
+	return maps.EqualFunc(h, h2, slices.Equal)
+}
+
+// First returns the first value of each header.
+func (h Headers) First() map[string]string {
+	first := make(map[string]string, len(h))
+	for k, vs := range h {
+		if len(vs) > 0 {
+			first[k] = vs[0]
+		}
+	}
+	return first
+}
+
+// UnmarshalJSON decodes headers with a list of values for each name, or a single value as headers were encoded before.
+func (h *Headers) UnmarshalJSON(b []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	hs := make(map[string][]string, len(raw))
+	for k, v := range raw {
+		var vs []string
+		if err := json.Unmarshal(v, &vs); err != nil {
+			var s string
+			if json.Unmarshal(v, &s) != nil {
+				return err
+			}
+			vs = []string{s}
+		}
+		hs[k] = vs
+	}
+
+	*h = NewHeaders(hs)
+	return nil
+}
@@ -0,0 +1,33 @@
+package types
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestHeaders(t *testing.T) {
+	h := NewHeaders(map[string][]string{
+		"Set-Cookie":   {"a=1"},
+		"set-cookie":   {"b=2", "c=3"},
+		"Content-Type": {"text/html"},
+	})
+
+	if !slices.Equal(h.Values("SET-COOKIE"), []string{"a=1", "b=2", "c=3"}) {
+		t.Fatal("values not merged in order", h)
+	}
+	if h.Get("content-type") != "text/html" || h.Get("x-missing") != "" {
+		t.Fatal("wrong first values", h)
+	}
+
+	var decoded Headers
+	if err := decoded.UnmarshalJSON([]byte(`{"Set-Cookie":["a=1","b=2","c=3"],"content-type":"text/html"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(h) {
+		t.Fatal("decoded headers not equal", decoded)
+	}
+
+	if err := decoded.UnmarshalJSON([]byte(`{"x":1}`)); err == nil {
+		t.Fatal("expected invalid header value to fail")
+	}
+}
@@ -0,0 +1,55 @@
+package types
+
+import "encoding/json"
+
+// LibraryArgs stores the arguments passed to a library program: the function to call, and the values to call it with.
+type LibraryArgs struct {
+	Function string `json:"function"`
+	// Args are serialised with SerialiseVals.
+	Args []byte `json:"args"`
+}
+
+// NewLibraryArgs creates arguments to call a library function with the given values.
+func NewLibraryArgs(function string, vs ...Val) (LibraryArgs, error) {
+	args, err := SerialiseVals(vs...)
+	if err != nil {
+		return LibraryArgs{}, err
+	}
+	return LibraryArgs{function, args}, nil
+}
+
+// Vals deserialises the values the library function is called with.
+func (args LibraryArgs) Vals() ([]Val, error) {
+	return DeserialiseVals(args.Args)
+}
+
+// Type returns LibraryProgramType.
+func (LibraryArgs) Type() ProgramType {
+	return LibraryProgramType
+}
+
+func (args LibraryArgs) Encode() []byte {
+	b, _ := json.Marshal(args)
+	return b
+}
+
+// LibraryRets stores the values returned from a library function.
+type LibraryRets struct {
+	// Rets are serialised with SerialiseVals.
+	Rets []byte `json:"rets"`
+}
+
+// Vals deserialises the values returned from the library function.
+func (rets LibraryRets) Vals() ([]Val, error) {
+	return DeserialiseVals(rets.Rets)
+}
+
+// Type returns LibraryProgramType.
+func (LibraryRets) Type() ProgramType {
+	return LibraryProgramType
+}
+
+func (rets LibraryRets) Encode() []byte {
+	b, _ := json.Marshal(rets)
+	return b
+}
@@ -0,0 +1,437 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Marshalling between Go values and Luau values, a bit like encoding/json but without the encoding.
+//
+// Struct fields are named by their `luau:"name"` tag, or their lowercased field name if there isn't one.
+// `luau:"-"` skips a field, and `luau:"name,omitempty"` leaves out zero values when marshalling.
+
+// MarshalError is returned when a value can't be converted, with the path to the value that failed.
+type MarshalError struct {
+	Path string
+	Err  error
+}
+
+func (e *MarshalError) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+func (e *MarshalError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	rtTable    = reflect.TypeFor[*Table]()
+	rtFunction = reflect.TypeFor[Function]()
+	rtCo       = reflect.TypeFor[*Coroutine]()
+	rtBuffer   = reflect.TypeFor[*Buffer]()
+	rtVector   = reflect.TypeFor[Vector]()
+)
+
+// typeName is TypeOf from the std package, which we can't import from here.
+func typeName(v Val) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case *Table:
+		return "table"
+	case Function:
+		return "function"
+	case *Coroutine:
+		return "thread"
+	case *Buffer:
+		return "buffer"
+	case Vector:
+		return "vector"
+	}
+	return "userdata"
+}
+
+func joinField(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func joinKey(path string, k any) string {
+	if s, ok := k.(string); ok {
+		return fmt.Sprintf("%s[%q]", path, s)
+	}
+	return fmt.Sprintf("%s[%v]", path, k)
+}
+
+func isBytes(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8
+}
+
+type field struct {
+	name      string
+	index     int
+	omitempty bool
+}
+
+func structFields(t reflect.Type) (fs []field) {
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(sf.Tag.Get("luau"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(sf.Name)
+		}
+
+		fs = append(fs, field{name, i, opts == "omitempty"})
+	}
+	return
+}
+
+type marshaller struct {
+	readonly bool
+}
+
+func (m marshaller) table(t *Table) *Table {
+	t.Readonly = m.readonly
+	return t
+}
+
+func (m marshaller) key(path string, rv reflect.Value) (k Val, err error) {
+	switch rv.Kind() {
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), nil
+	}
+	return nil, &MarshalError{path, fmt.Errorf("unsupported map key type %s", rv.Type())}
+}
+
+func (m marshaller) marshal(path string, rv reflect.Value) (v Val, err error) {
+	if !rv.IsValid() {
+		return
+	}
+
+	switch t := rv.Type(); t {
+	case rtTable, rtFunction, rtCo, rtBuffer, rtVector:
+		if t.Kind() == reflect.Pointer && rv.IsNil() {
+			return
+		}
+		return rv.Interface(), nil
+	}
+
+	if isBytes(rv.Type()) {
+		b := make(Buffer, rv.Len())
+		copy(b, rv.Bytes())
+		return &b, nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), nil
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return
+		}
+		return m.marshal(path, rv.Elem())
+	case reflect.Slice, reflect.Array:
+		// nil slices are still empty tables, programs shouldn't have to check
+		list := make([]Val, rv.Len())
+		for i := range list {
+			if list[i], err = m.marshal(joinKey(path, i+1), rv.Index(i)); err != nil {
+				return
+			}
+			if list[i] == nil {
+				return nil, &MarshalError{joinKey(path, i+1), errors.New("lists cannot contain nil")}
+			}
+		}
+		return m.table(&Table{List: list}), nil
+	case reflect.Map:
+		hash := make(map[Val]Val, rv.Len())
+		for it := rv.MapRange(); it.Next(); {
+			k, err := m.key(path, it.Key())
+			if err != nil {
+				return nil, err
+			}
+
+			kv, err := m.marshal(joinKey(path, k), it.Value())
+			if err != nil {
+				return nil, err
+			}
+			if kv != nil {
+				hash[k] = kv
+			}
+		}
+		return m.table(&Table{Hash: hash}), nil
+	case reflect.Struct:
+		fs := structFields(rv.Type())
+		hash := make(map[Val]Val, len(fs))
+		for _, f := range fs {
+			fv := rv.Field(f.index)
+			if f.omitempty && fv.IsZero() {
+				continue
+			}
+
+			kv, err := m.marshal(joinField(path, f.name), fv)
+			if err != nil {
+				return nil, err
+			}
+			if kv != nil {
+				hash[f.name] = kv
+			}
+		}
+		return m.table(&Table{Hash: hash}), nil
+	}
+
+	return nil, &MarshalError{path, fmt.Errorf("unsupported type %s", rv.Type())}
+}
+
+// Marshal converts a Go value to a Luau value. Structs, maps, slices, and arrays become tables, byte slices become buffers, and all numeric types become numbers.
+func Marshal(v any) (Val, error) {
+	return marshaller{}.marshal("", reflect.ValueOf(v))
+}
+
+// MarshalReadonly is like Marshal, but every table created is readonly.
+func MarshalReadonly(v any) (Val, error) {
+	return marshaller{readonly: true}.marshal("", reflect.ValueOf(v))
+}
+
+func unmarshalError(path string, v Val, t reflect.Type) error {
+	return &MarshalError{path, fmt.Errorf("cannot unmarshal %s into %s", typeName(v), t)}
+}
+
+func unmarshalNumber(path string, v Val, rv reflect.Value) error {
+	n, ok := v.(float64)
+	if !ok {
+		return unmarshalError(path, v, rv.Type())
+	}
+
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		if rv.OverflowFloat(n) {
+			return &MarshalError{path, fmt.Errorf("number %g overflows %s", n, rv.Type())}
+		}
+		rv.SetFloat(n)
+		return nil
+	}
+
+	if n != math.Trunc(n) {
+		return &MarshalError{path, fmt.Errorf("number %s is not an integer", strconv.FormatFloat(n, 'g', -1, 64))}
+	}
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if rv.OverflowInt(int64(n)) || n < math.MinInt64 || n >= math.MaxInt64 {
+			return &MarshalError{path, fmt.Errorf("number %g overflows %s", n, rv.Type())}
+		}
+		rv.SetInt(int64(n))
+	default:
+		if n < 0 || rv.OverflowUint(uint64(n)) || n >= math.MaxUint64 {
+			return &MarshalError{path, fmt.Errorf("number %g overflows %s", n, rv.Type())}
+		}
+		rv.SetUint(uint64(n))
+	}
+	return nil
+}
+
+func unmarshalKey(path string, k Val, t reflect.Type) (rv reflect.Value, err error) {
+	rv = reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		s, ok := k.(string)
+		if !ok {
+			return rv, &MarshalError{path, fmt.Errorf("cannot unmarshal %s key into %s", typeName(k), t)}
+		}
+		rv.SetString(s)
+		return
+	case reflect.Bool:
+		b, ok := k.(bool)
+		if !ok {
+			return rv, &MarshalError{path, fmt.Errorf("cannot unmarshal %s key into %s", typeName(k), t)}
+		}
+		rv.SetBool(b)
+		return
+	case reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv, unmarshalNumber(path, k, rv)
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			rv.Set(reflect.ValueOf(k))
+			return
+		}
+	}
+	return rv, &MarshalError{path, fmt.Errorf("unsupported map key type %s", t)}
+}
+
+func unmarshal(path string, v Val, rv reflect.Value) (err error) {
+	t := rv.Type()
+
+	switch t {
+	case rtTable, rtFunction, rtCo, rtBuffer, rtVector:
+		if v == nil {
+			rv.SetZero()
+			return
+		}
+		av := reflect.ValueOf(v)
+		if av.Type() != t {
+			return unmarshalError(path, v, t)
+		}
+		rv.Set(av)
+		return
+	}
+
+	// nil leaves non-pointer values as their zero value
+	if v == nil {
+		rv.SetZero()
+		return
+	}
+
+	if isBytes(t) {
+		b, ok := v.(*Buffer)
+		if !ok {
+			return unmarshalError(path, v, t)
+		}
+		bs := reflect.MakeSlice(t, len(*b), len(*b))
+		reflect.Copy(bs, reflect.ValueOf([]byte(*b)))
+		rv.Set(bs)
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		b, ok := v.(bool)
+		if !ok {
+			return unmarshalError(path, v, t)
+		}
+		rv.SetBool(b)
+		return
+	case reflect.String:
+		s, ok := v.(string)
+		if !ok {
+			return unmarshalError(path, v, t)
+		}
+		rv.SetString(s)
+		return
+	case reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return unmarshalNumber(path, v, rv)
+	case reflect.Pointer:
+		pv := reflect.New(t.Elem())
+		if err = unmarshal(path, v, pv.Elem()); err != nil {
+			return
+		}
+		rv.Set(pv)
+		return
+	case reflect.Interface:
+		if t.NumMethod() != 0 {
+			break
+		}
+		rv.Set(reflect.ValueOf(v))
+		return
+	}
+
+	tv, ok := v.(*Table)
+	if !ok {
+		return unmarshalError(path, v, t)
+	}
+
+	switch t.Kind() {
+	case reflect.Slice:
+		l := tv.Len()
+		for tv.GetInt(l+1) != nil {
+			l++ // the list can carry on in the hash part
+		}
+
+		sv := reflect.MakeSlice(t, l, l)
+		for i := range l {
+			if err = unmarshal(joinKey(path, i+1), tv.GetInt(i+1), sv.Index(i)); err != nil {
+				return
+			}
+		}
+		rv.Set(sv)
+		return
+	case reflect.Array:
+		if l := tv.Len(); l > t.Len() {
+			return &MarshalError{path, fmt.Errorf("list of length %d too long for %s", l, t)}
+		}
+		for i := range t.Len() {
+			if err = unmarshal(joinKey(path, i+1), tv.GetInt(i+1), rv.Index(i)); err != nil {
+				return
+			}
+		}
+		return
+	case reflect.Map:
+		mv := reflect.MakeMap(t)
+		for k, kv := range tv.Iter() {
+			kp := joinKey(path, k)
+
+			rk, err := unmarshalKey(kp, k, t.Key())
+			if err != nil {
+				return err
+			}
+
+			rkv := reflect.New(t.Elem()).Elem()
+			if err = unmarshal(kp, kv, rkv); err != nil {
+				return err
+			}
+			mv.SetMapIndex(rk, rkv)
+		}
+		rv.Set(mv)
+		return
+	case reflect.Struct:
+		for _, f := range structFields(t) {
+			if err = unmarshal(joinField(path, f.name), tv.Get(f.name), rv.Field(f.index)); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	return &MarshalError{path, fmt.Errorf("unsupported type %s", t)}
+}
+
+// Unmarshal converts a Luau value into the Go value pointed to by out, following the same rules as Marshal. Table keys without a matching struct field are ignored.
+func Unmarshal(v Val, out any) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("unmarshal target must be a non-nil pointer")
+	}
+
+	return unmarshal("", v, rv.Elem())
+}
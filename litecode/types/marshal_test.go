@@ -0,0 +1,128 @@
+package types
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+type inner struct {
+	N    int     `luau:"n"`
+	Skip string  `luau:"-"`
+	Opt  *string `luau:"opt,omitempty"`
+}
+
+type outer struct {
+	Name  string            `luau:"name"`
+	List  []float64         `luau:"list"`
+	Map   map[string]string `luau:"map"`
+	Data  []byte            `luau:"data"`
+	Inner inner             `luau:"inner"`
+	Any   Val               `luau:"any"`
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	in := outer{
+		Name:  "test",
+		List:  []float64{1, 2, 3},
+		Map:   map[string]string{"a": "b"},
+		Data:  []byte("hello"),
+		Inner: inner{N: 5, Skip: "skipped"},
+		Any:   true,
+	}
+
+	v, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tv := v.(*Table)
+	if tv.GetHash("name") != "test" {
+		t.Fatal("name not marshalled")
+	}
+	if b, ok := tv.GetHash("data").(*Buffer); !ok || string(*b) != "hello" {
+		t.Fatal("data not marshalled as a buffer")
+	}
+
+	it := tv.GetHash("inner").(*Table)
+	if it.GetHash("skip") != nil || it.GetHash("Skip") != nil {
+		t.Fatal("skipped field was marshalled")
+	}
+	if _, ok := it.Hash["opt"]; ok {
+		t.Fatal("omitempty field was marshalled")
+	}
+
+	var out outer
+	if err = Unmarshal(v, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Name != in.Name || !slices.Equal(out.List, in.List) || !maps.Equal(out.Map, in.Map) || string(out.Data) != string(in.Data) || out.Inner.N != in.Inner.N || out.Any != in.Any {
+		t.Fatalf("round trip mismatch: %+v", out)
+	}
+}
+
+func TestMarshalReadonly(t *testing.T) {
+	v, err := MarshalReadonly(map[string][]string{"a": {"b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tv := v.(*Table)
+	if !tv.Readonly || !tv.GetHash("a").(*Table).Readonly {
+		t.Fatal("tables not readonly")
+	}
+
+	if v, _ = Marshal(map[string]string{}); v.(*Table).Readonly {
+		t.Fatal("table readonly when not requested")
+	}
+}
+
+func TestUnmarshalHashList(t *testing.T) {
+	// t[3] = "c" after the list part ends goes into the hash part
+	v := &Table{List: []Val{"a", "b"}, Hash: map[Val]Val{float64(3): "c"}}
+
+	var out []string
+	if err := Unmarshal(v, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 3 || out[2] != "c" {
+		t.Fatalf("unexpected list %q", out)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	list := &Table{List: []Val{"a", float64(2)}}
+	v := &Table{Hash: map[Val]Val{
+		"map":  &Table{Hash: map[Val]Val{"k": list}},
+		"name": float64(1),
+	}}
+
+	var out struct {
+		Map map[string][]string `luau:"map"`
+	}
+	err := Unmarshal(v, &out)
+	if err == nil || err.Error() != `map["k"][2]: cannot unmarshal number into string` {
+		t.Fatal("unexpected error:", err)
+	}
+
+	var n struct {
+		N int `luau:"n"`
+	}
+	err = Unmarshal(&Table{Hash: map[Val]Val{"n": 1.5}}, &n)
+	if err == nil || err.Error() != "n: number 1.5 is not an integer" {
+		t.Fatal("unexpected error:", err)
+	}
+
+	var f struct {
+		F float32 `luau:"f"`
+	}
+	err = Unmarshal(&Table{Hash: map[Val]Val{"f": 1e300}}, &f)
+	if err == nil || err.Error() != "f: number 1e+300 overflows float32" {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if err = Unmarshal(&Table{}, n); err == nil {
+		t.Fatal("expected error for non-pointer target")
+	}
+}
@@ -1,6 +1,9 @@
 package types
 
-import "encoding/json"
+import (
+	"crypto/sha3"
+	"encoding/json"
+)
 
 // ProgramType represents the type of a program.
 type ProgramType uint8
@@ -11,6 +14,12 @@ const (
 	TestProgramType ProgramType = iota
 	// WebProgramType represents the type of a web program.
 	WebProgramType
+	// LibraryProgramType represents the type of a library program.
+	// Library programs return a table of functions, which other programs can call.
+	LibraryProgramType
+	// ScheduledProgramType represents the type of a scheduled program.
+	// Scheduled programs are run periodically, according to the schedule in their metadata.
+	ScheduledProgramType
 )
 
 // TODO: either merge or distinguish these
@@ -42,6 +51,11 @@ func DecodeArgs[T ProgramArgs](encoded []byte) (args T, err error) {
 	return args, json.Unmarshal(encoded, &args)
 }
 
+// InputHash identifies a program's input, so results can be reused. It's the hash of the encoded args, which are canonical: decoding and re-encoding them gives the same hash.
+func InputHash(args ProgramArgs) [32]byte {
+	return sha3.Sum256(args.Encode())
+}
+
 // ProgramRets represents the response returned from a program.
 type ProgramRets interface {
 	// Equal(ProgramRets) error
@@ -0,0 +1,60 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Quorum is how many peers a program is run on, and how many of them have to return the same result for it to be accepted. Programs are deterministic, so peers that disagree with the rest either have a bug or are lying.
+type Quorum struct {
+	M int // matching results needed
+	K int // peers run on
+}
+
+// MaxQuorumPeers is the most peers a program can be run on at once.
+const MaxQuorumPeers = 16
+
+// Headers a quorum is requested with, and its result reported with.
+const (
+	// QuorumHeader asks for a quorum, as "m/k", meaning m of k peers have to agree.
+	QuorumHeader = "Coputer-Quorum"
+	// QuorumResultHeader is how many peers agreed on the result, of how many were asked, as "agreed/asked".
+	QuorumResultHeader = "Coputer-Quorum-Result"
+)
+
+// Enabled reports whether the quorum asks for more than one peer.
+func (q Quorum) Enabled() bool {
+	return q.K > 1
+}
+
+func (q Quorum) String() string {
+	return fmt.Sprintf("%d/%d", q.M, q.K)
+}
+
+// ParseQuorum parses a quorum written as "m/k".
+func ParseQuorum(s string) (q Quorum, err error) {
+	ms, ks, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return q, fmt.Errorf("quorum %q isn't written as m/k", s)
+	}
+
+	if q.M, err = strconv.Atoi(ms); err != nil {
+		return q, fmt.Errorf("invalid quorum matches: %w", err)
+	}
+	if q.K, err = strconv.Atoi(ks); err != nil {
+		return q, fmt.Errorf("invalid quorum peers: %w", err)
+	}
+	return q, q.Validate()
+}
+
+// Validate checks a quorum can be met.
+func (q Quorum) Validate() error {
+	switch {
+	case q.K < 1 || q.K > MaxQuorumPeers:
+		return fmt.Errorf("quorum must run on between 1 and %d peers, not %d", MaxQuorumPeers, q.K)
+	case q.M < 1 || q.M > q.K:
+		return fmt.Errorf("quorum must need between 1 and %d matching results, not %d", q.K, q.M)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package types
+
+import "testing"
+
+func TestQuorum(t *testing.T) {
+	q, err := ParseQuorum(" 2/3 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q != (Quorum{2, 3}) || !q.Enabled() {
+		t.Fatal("expected 2/3 quorum, got", q)
+	}
+	if q2, _ := ParseQuorum(q.String()); q2 != q {
+		t.Fatal("quorum didn't round trip", q2)
+	}
+
+	for _, s := range [...]string{"", "2", "a/3", "0/3", "4/3", "1/0", "1/17"} {
+		if _, err := ParseQuorum(s); err == nil {
+			t.Fatal("expected error parsing quorum", s)
+		}
+	}
+}
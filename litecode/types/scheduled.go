@@ -0,0 +1,34 @@
+package types
+
+import "encoding/json"
+
+// ScheduledArgs stores the arguments passed to a scheduled program.
+type ScheduledArgs struct {
+	// Tick is the time the run was scheduled for, in seconds since the Unix epoch. Every node uses the same tick for the same run, however late it starts.
+	Tick int64 `json:"tick" luau:"tick"`
+}
+
+// Type returns ScheduledProgramType.
+func (ScheduledArgs) Type() ProgramType {
+	return ScheduledProgramType
+}
+
+func (args ScheduledArgs) Encode() []byte {
+	b, _ := json.Marshal(args)
+	return b
+}
+
+// ScheduledRets stores the result of a scheduled program run.
+type ScheduledRets struct {
+	Body []byte `json:"body"`
+}
+
+// Type returns ScheduledProgramType.
+func (ScheduledRets) Type() ProgramType {
+	return ScheduledProgramType
+}
+
+func (rets ScheduledRets) Encode() []byte {
+	b, _ := json.Marshal(rets)
+	return b
+}
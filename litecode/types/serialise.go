@@ -0,0 +1,227 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Values passed between programs are serialised deterministically, so the same values always give the same bytes (and the same input hash).
+// Each value is a tag byte followed by its data, with lengths as uvarints. Table entries are sorted by their serialised keys.
+
+const (
+	sNil byte = iota
+	sFalse
+	sTrue
+	sNumber
+	sString
+	sBuffer
+	sVector
+	sTable
+)
+
+const maxSerialiseDepth = 100
+
+// canonical NaN, as there are many
+const nanBits = 0x7ff8000000000000
+
+func serialiseVal(b []byte, v Val, depth int) ([]byte, error) {
+	if depth > maxSerialiseDepth {
+		return nil, errors.New("cannot serialise deeply nested or cyclic table")
+	}
+
+	switch tv := v.(type) {
+	case nil:
+		return append(b, sNil), nil
+	case bool:
+		if tv {
+			return append(b, sTrue), nil
+		}
+		return append(b, sFalse), nil
+	case float64:
+		bits := math.Float64bits(tv)
+		if math.IsNaN(tv) {
+			bits = nanBits
+		}
+		return binary.BigEndian.AppendUint64(append(b, sNumber), bits), nil
+	case string:
+		b = binary.AppendUvarint(append(b, sString), uint64(len(tv)))
+		return append(b, tv...), nil
+	case *Buffer:
+		b = binary.AppendUvarint(append(b, sBuffer), uint64(len(*tv)))
+		return append(b, *tv...), nil
+	case Vector:
+		b = append(b, sVector)
+		for _, f := range tv {
+			b = binary.BigEndian.AppendUint32(b, math.Float32bits(f))
+		}
+		return b, nil
+	case *Table:
+		type entry struct{ k, v []byte }
+		var entries []entry
+
+		for k, tv := range tv.Iter() {
+			ek, err := serialiseVal(nil, k, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			ev, err := serialiseVal(nil, tv, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry{ek, ev})
+		}
+		slices.SortFunc(entries, func(a, b entry) int {
+			return bytes.Compare(a.k, b.k)
+		})
+
+		b = binary.AppendUvarint(append(b, sTable), uint64(len(entries)))
+		for _, e := range entries {
+			b = append(append(b, e.k...), e.v...)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("cannot serialise %s", typeName(v))
+}
+
+// SerialiseVals deterministically serialises a list of values. Only nil, booleans, numbers, strings, buffers, vectors, and tables of these can be serialised.
+func SerialiseVals(vs ...Val) (b []byte, err error) {
+	b = binary.AppendUvarint(nil, uint64(len(vs)))
+	for i, v := range vs {
+		if b, err = serialiseVal(b, v, 0); err != nil {
+			return nil, fmt.Errorf("value #%d: %w", i+1, err)
+		}
+	}
+	return
+}
+
+type deserialiser struct {
+	b   []byte
+	pos int
+}
+
+var errTruncated = errors.New("serialised values truncated")
+
+func (d *deserialiser) uvarint() (uint64, error) {
+	n, l := binary.Uvarint(d.b[d.pos:])
+	if l <= 0 {
+		return 0, errTruncated
+	}
+	d.pos += l
+	return n, nil
+}
+
+func (d *deserialiser) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.b)-d.pos) {
+		return nil, errTruncated
+	}
+	s := d.b[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return s, nil
+}
+
+func (d *deserialiser) val(depth int) (Val, error) {
+	if depth > maxSerialiseDepth {
+		return nil, errors.New("serialised table nested too deeply")
+	}
+
+	tag, err := d.bytes(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch tag[0] {
+	case sNil:
+		return nil, nil
+	case sFalse:
+		return false, nil
+	case sTrue:
+		return true, nil
+	case sNumber:
+		n, err := d.bytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(n)), nil
+	case sString, sBuffer:
+		l, err := d.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.bytes(l)
+		if err != nil {
+			return nil, err
+		}
+
+		if tag[0] == sString {
+			return string(s), nil
+		}
+		buf := Buffer(slices.Clone(s))
+		return &buf, nil
+	case sVector:
+		var v Vector
+		for i := range v {
+			f, err := d.bytes(4)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = math.Float32frombits(binary.BigEndian.Uint32(f))
+		}
+		return v, nil
+	case sTable:
+		l, err := d.uvarint()
+		if err != nil {
+			return nil, err
+		}
+
+		t := &Table{}
+		for range l {
+			k, err := d.val(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.val(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+
+			if k == nil {
+				return nil, errors.New("serialised table has nil key")
+			}
+			if fk, ok := k.(float64); ok && math.IsNaN(fk) {
+				return nil, errors.New("serialised table has NaN key")
+			}
+			t.Set(k, v)
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("invalid serialised value tag %d", tag[0])
+}
+
+// DeserialiseVals deserialises a list of values serialised with SerialiseVals.
+func DeserialiseVals(b []byte) (vs []Val, err error) {
+	d := &deserialiser{b: b}
+
+	n, err := d.uvarint()
+	if err != nil {
+		return
+	}
+	if n > uint64(len(b)) { // every value is at least 1 byte
+		return nil, errTruncated
+	}
+
+	vs = make([]Val, n)
+	for i := range vs {
+		if vs[i], err = d.val(0); err != nil {
+			return nil, fmt.Errorf("value #%d: %w", i+1, err)
+		}
+	}
+
+	if d.pos != len(b) {
+		return nil, errors.New("trailing data after serialised values")
+	}
+	return
+}
@@ -0,0 +1,97 @@
+package types
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestSerialiseRoundTrip(t *testing.T) {
+	buf := Buffer("data")
+	tbl := &Table{}
+	tbl.Set(1.0, "a")
+	tbl.Set(2.0, "b")
+	tbl.Set("key", true)
+	tbl.Set(2.5, Vector{1, 2, 3, 0})
+
+	vs := []Val{nil, false, 1.5, "str", &buf, tbl}
+
+	b, err := SerialiseVals(vs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := DeserialiseVals(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(vs) {
+		t.Fatalf("expected %d values, got %d", len(vs), len(out))
+	}
+	if out[0] != nil || out[1] != false || out[2] != 1.5 || out[3] != "str" {
+		t.Fatalf("unexpected values %v", out[:4])
+	}
+	if ob := out[4].(*Buffer); !bytes.Equal(*ob, buf) || ob == &buf {
+		t.Fatal("buffer not copied")
+	}
+
+	ot := out[5].(*Table)
+	if ot.Len() != 2 || ot.Get("key") != true || ot.Get(2.5) != (Vector{1, 2, 3, 0}) {
+		t.Fatalf("unexpected table %v %v", ot.List, ot.Hash)
+	}
+
+	// serialising again gives the same bytes
+	b2, err := SerialiseVals(out...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, b2) {
+		t.Fatal("serialisation not deterministic")
+	}
+}
+
+func TestSerialiseDeterministic(t *testing.T) {
+	// same contents, built differently
+	t1 := &Table{Hash: map[Val]Val{"b": 2.0, "a": 1.0, 3.0: "c"}}
+	t2 := &Table{}
+	t2.Set(3.0, "c")
+	t2.Set("a", 1.0)
+	t2.Set("b", 2.0)
+
+	b1, err := SerialiseVals(t1, math.NaN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := SerialiseVals(t2, -math.NaN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b1, b2) {
+		t.Fatalf("expected equal serialisations, got %x and %x", b1, b2)
+	}
+}
+
+func TestSerialiseErrors(t *testing.T) {
+	if _, err := SerialiseVals(Function{}); err == nil {
+		t.Fatal("expected error serialising function")
+	}
+
+	cyclic := &Table{}
+	cyclic.Set("self", cyclic)
+	if _, err := SerialiseVals(cyclic); err == nil {
+		t.Fatal("expected error serialising cyclic table")
+	}
+
+	b, err := SerialiseVals("hello", 1.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range b {
+		if _, err := DeserialiseVals(b[:i]); err == nil {
+			t.Fatalf("expected error deserialising %d truncated bytes", i)
+		}
+	}
+	if _, err := DeserialiseVals(append(b, 0)); err == nil {
+		t.Fatal("expected error with trailing data")
+	}
+}
@@ -0,0 +1,209 @@
+package types
+
+import (
+	"crypto/sha3"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	// MaxStateKeyLen is the maximum length of a key in a program's state.
+	MaxStateKeyLen = 1 << 10
+	// MaxStateValueLen is the maximum length of a value in a program's state.
+	MaxStateValueLen = 1 << 20
+)
+
+// State is the key-value state of a stateful program.
+type State map[string][]byte
+
+// Encode serialises the state deterministically, with keys in sorted order.
+func (s State) Encode() (b []byte) {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	for _, k := range slices.Sorted(maps.Keys(s)) {
+		b = binary.AppendUvarint(b, uint64(len(k)))
+		b = append(b, k...)
+		b = binary.AppendUvarint(b, uint64(len(s[k])))
+		b = append(b, s[k]...)
+	}
+	return
+}
+
+// Root returns the hash of the encoded state, which identifies its version.
+func (s State) Root() [32]byte {
+	return sha3.Sum256(s.Encode())
+}
+
+var errBadState = errors.New("bad state encoding")
+
+// DecodeState deserialises a state encoded with Encode.
+func DecodeState(b []byte) (s State, err error) {
+	next := func() ([]byte, error) {
+		l, n := binary.Uvarint(b)
+		if n <= 0 || l > uint64(len(b)-n) {
+			return nil, errBadState
+		}
+		v := b[n:][:l]
+		b = b[n+int(l):]
+		return v, nil
+	}
+
+	count, n := binary.Uvarint(b)
+	if n <= 0 || count > uint64(len(b)) {
+		return nil, errBadState
+	}
+	b = b[n:]
+
+	s = make(State, count)
+	var last string
+	for i := range count {
+		k, err := next()
+		if err != nil {
+			return nil, err
+		}
+		v, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		// sorted and unique, so there's only one encoding of each state
+		ks := string(k)
+		if i > 0 && ks <= last {
+			return nil, fmt.Errorf("%w: keys not sorted", errBadState)
+		}
+		last = ks
+		s[ks] = slices.Clone(v)
+	}
+
+	if len(b) != 0 {
+		return nil, fmt.Errorf("%w: trailing data", errBadState)
+	}
+	return
+}
+
+// StateTxn is a set of writes to a program's state, made during a run. Reads see the writes made before them.
+type StateTxn struct {
+	Base State
+	// Root is the root of the base state, which the run was given
+	Root   [32]byte
+	writes map[string][]byte // nil to delete
+}
+
+// NewStateTxn starts a transaction on a state.
+func NewStateTxn(base State) *StateTxn {
+	return &StateTxn{
+		Base:   base,
+		Root:   base.Root(),
+		writes: map[string][]byte{},
+	}
+}
+
+// Get returns the value at a key.
+func (tx *StateTxn) Get(k string) (v []byte, ok bool) {
+	if v, ok = tx.writes[k]; ok {
+		return v, v != nil
+	}
+	v, ok = tx.Base[k]
+	return
+}
+
+// Set sets the value at a key.
+func (tx *StateTxn) Set(k string, v []byte) error {
+	if len(k) > MaxStateKeyLen {
+		return fmt.Errorf("key longer than %d bytes", MaxStateKeyLen)
+	}
+	if len(v) > MaxStateValueLen {
+		return fmt.Errorf("value longer than %d bytes", MaxStateValueLen)
+	}
+
+	tx.writes[k] = slices.Clone(v)
+	if tx.writes[k] == nil {
+		tx.writes[k] = []byte{} // empty, not deleted
+	}
+	return nil
+}
+
+// Delete deletes the value at a key.
+func (tx *StateTxn) Delete(k string) {
+	tx.writes[k] = nil
+}
+
+// Scan returns the keys starting with a prefix, in sorted order.
+func (tx *StateTxn) Scan(prefix string) (ks []string) {
+	for k := range tx.Base {
+		if _, ok := tx.Get(k); ok && strings.HasPrefix(k, prefix) {
+			ks = append(ks, k)
+		}
+	}
+	for k, v := range tx.writes {
+		if _, inBase := tx.Base[k]; !inBase && v != nil && strings.HasPrefix(k, prefix) {
+			ks = append(ks, k)
+		}
+	}
+
+	slices.Sort(ks)
+	return
+}
+
+// Changed reports whether the transaction has made any writes.
+func (tx *StateTxn) Changed() bool {
+	return len(tx.writes) > 0
+}
+
+// Apply returns the state after the transaction's writes, leaving the base state unchanged.
+func (tx *StateTxn) Apply() State {
+	s := maps.Clone(tx.Base)
+	if s == nil {
+		s = State{}
+	}
+
+	for k, v := range tx.writes {
+		if v == nil {
+			delete(s, k)
+		} else {
+			s[k] = v
+		}
+	}
+	return s
+}
+
+// StateTransition is how a run of a stateful program changed its state, from one root to another. Peers apply it by running the program with the same input on the base state, and checking they get the same root.
+type StateTransition struct {
+	Base, Root [32]byte
+}
+
+// Headers a run of a stateful program reports its state transition in. Streamed runs send them as trailers.
+const (
+	StateBaseHeader = "Coputer-State-Base"
+	StateRootHeader = "Coputer-State-Root"
+)
+
+// Changed reports whether the run changed the state.
+func (t StateTransition) Changed() bool {
+	return t.Base != t.Root
+}
+
+// StateTransitionFrom reads a state transition from a response's headers or trailers, if it has one.
+func StateTransitionFrom(h, trailer http.Header) (t StateTransition, ok bool) {
+	get := func(k string) ([32]byte, bool) {
+		v := h.Get(k)
+		if v == "" {
+			v = trailer.Get(k)
+		}
+
+		b, err := hex.DecodeString(v)
+		if err != nil || len(b) != 32 {
+			return [32]byte{}, false
+		}
+		return [32]byte(b), true
+	}
+
+	base, ok1 := get(StateBaseHeader)
+	root, ok2 := get(StateRootHeader)
+	return StateTransition{base, root}, ok1 && ok2
+}
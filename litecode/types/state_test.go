@@ -0,0 +1,88 @@
+package types
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestStateTxn(t *testing.T) {
+	base := State{"a": []byte("1"), "b": []byte("2"), "c/1": []byte("3")}
+	tx := NewStateTxn(base)
+
+	tx.Set("c/2", []byte("4"))
+	tx.Delete("a")
+	tx.Set("b", nil)
+
+	if _, ok := tx.Get("a"); ok {
+		t.Fatal("deleted key still readable")
+	}
+	if v, ok := tx.Get("b"); !ok || len(v) != 0 {
+		t.Fatal("empty value should be readable")
+	}
+	if ks := tx.Scan("c/"); !slices.Equal(ks, []string{"c/1", "c/2"}) {
+		t.Fatal("unexpected scan", ks)
+	}
+	if ks := tx.Scan(""); !slices.Equal(ks, []string{"b", "c/1", "c/2"}) {
+		t.Fatal("unexpected scan", ks)
+	}
+
+	s := tx.Apply()
+	if len(s) != 3 || string(s["c/2"]) != "4" {
+		t.Fatal("unexpected state", s)
+	}
+	if len(base) != 3 || string(base["a"]) != "1" {
+		t.Fatal("base state modified")
+	}
+	if s.Root() == tx.Root {
+		t.Fatal("root should change with state")
+	}
+
+	if err := tx.Set(string(make([]byte, MaxStateKeyLen+1)), nil); err == nil {
+		t.Fatal("expected error with long key")
+	}
+}
+
+func TestStateEncode(t *testing.T) {
+	s := State{"z": []byte("last"), "": []byte{}, "m": []byte{0, 1, 2}}
+
+	b := s.Encode()
+	s2, err := DecodeState(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s2.Encode(), b) || s2.Root() != s.Root() {
+		t.Fatal("state not equal after round trip")
+	}
+
+	// keys out of order aren't canonical
+	bad := []byte{2, 1, 'b', 0, 1, 'a', 0}
+	if _, err := DecodeState(bad); err == nil {
+		t.Fatal("expected error with unsorted keys")
+	}
+	for i := range b {
+		if _, err := DecodeState(b[:i]); err == nil {
+			t.Fatalf("expected error with %d truncated bytes", i)
+		}
+	}
+}
+
+func TestStateTransitionHeaders(t *testing.T) {
+	st := StateTransition{State{}.Root(), State{"a": []byte("1")}.Root()}
+	if !st.Changed() {
+		t.Fatal("transition should change the state")
+	}
+
+	h, trailer := http.Header{}, http.Header{}
+	h.Set(StateBaseHeader, hex.EncodeToString(st.Base[:]))
+	trailer.Set(StateRootHeader, hex.EncodeToString(st.Root[:]))
+
+	if st2, ok := StateTransitionFrom(h, trailer); !ok || st2 != st {
+		t.Fatal("transition not read from headers and trailers", st2)
+	}
+	if _, ok := StateTransitionFrom(http.Header{}, nil); ok {
+		t.Fatal("expected no transition")
+	}
+}
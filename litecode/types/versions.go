@@ -0,0 +1,86 @@
+package types
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Heliodex/coputer/sig"
+)
+
+// Version is an entry in a program name's history, recording that the name pointed to a program from some time.
+type Version struct {
+	Hash   string `json:"hash"`   // hash of the program's bundle, in hex
+	Time   int64  `json:"time"`   // unix milliseconds, when the version was signed
+	Signer string `json:"signer"` // public key of who signed the version, without prefix
+	Sig    []byte `json:"sig,omitempty"`
+}
+
+// Headers a version is sent with when a program is stored.
+const (
+	VersionTimeHeader = "Coputer-Version-Time"
+	SignatureHeader   = "Coputer-Signature"
+)
+
+// VersionMessage returns what's signed for a version. The public key and name are included, so a signature for one name can't be used for another.
+func VersionMessage(pk, name string, hash [32]byte, time int64) []byte {
+	b := append([]byte("coputer version\x00"), pk...)
+	b = append(b, 0)
+	b = append(b, name...)
+	b = append(b, 0)
+	b = append(b, hash[:]...)
+	return binary.BigEndian.AppendUint64(b, uint64(time))
+}
+
+// HashBytes returns the decoded hash of the version's program.
+func (v Version) HashBytes() (hash [32]byte) {
+	hex.Decode(hash[:], []byte(v.Hash))
+	return
+}
+
+// Message returns what's signed for the version of a program name.
+func (v Version) Message(pk, name string) []byte {
+	return VersionMessage(pk, name, v.HashBytes(), v.Time)
+}
+
+func (v Version) Encode() []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// DecodeVersion decodes a version, checking its hash and signer are well-formed.
+func DecodeVersion(b []byte) (v Version, err error) {
+	if err = json.Unmarshal(b, &v); err != nil {
+		return
+	}
+
+	if len(v.Hash) != 64 || strings.ToLower(v.Hash) != v.Hash {
+		return Version{}, errors.New("invalid version hash")
+	}
+	if _, err = hex.DecodeString(v.Hash); err != nil {
+		return Version{}, errors.New("invalid version hash")
+	}
+	if len(v.Signer) != 49 || strings.ToLower(v.Signer) != v.Signer {
+		return Version{}, errors.New("invalid version signer")
+	}
+	return
+}
+
+// Verify checks the version of a program name was signed by the name's owner, whose public key is given without prefix.
+func (v Version) Verify(pk, name string) error {
+	if v.Signer != pk {
+		return errors.New("version must be signed by the program's owner")
+	}
+
+	spk, err := sig.DecodePKNoPrefix(pk)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+	if len(v.Sig) != sig.HashSigLen || !spk.VerifyHash(sig.HashSig(v.Sig), v.Message(pk, name)) {
+		return errors.New("invalid version signature")
+	}
+	return nil
+}
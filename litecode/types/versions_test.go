@@ -0,0 +1,45 @@
+package types
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	hash := sha3.Sum256([]byte("bundle"))
+	pk := strings.Repeat("a", 49)
+
+	v := Version{Hash: hex.EncodeToString(hash[:]), Time: 1700000000000, Signer: pk, Sig: []byte{1, 2, 3}}
+	v2, err := DecodeVersion(v.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2.Hash != v.Hash || v2.Time != v.Time || v2.Signer != v.Signer || !bytes.Equal(v2.Sig, v.Sig) {
+		t.Fatal("version didn't round trip", v2)
+	}
+	if v2.HashBytes() != hash {
+		t.Fatal("version hash not equal")
+	}
+
+	// signatures are only valid for the name and time they were made for
+	msg := v.Message(pk, "web1")
+	if !bytes.Equal(msg, VersionMessage(pk, "web1", hash, v.Time)) {
+		t.Fatal("version message not equal")
+	}
+	if bytes.Equal(msg, v.Message(pk, "web2")) || bytes.Equal(msg, VersionMessage(pk, "web1", hash, v.Time+1)) {
+		t.Fatal("version messages should differ")
+	}
+
+	for _, bad := range []Version{
+		{Hash: "abc", Signer: pk},
+		{Hash: strings.ToUpper(v.Hash), Signer: pk},
+		{Hash: v.Hash, Signer: "copub:" + pk},
+	} {
+		if _, err := DecodeVersion(bad.Encode()); err == nil {
+			t.Fatal("expected invalid version to fail", bad)
+		}
+	}
+}
@@ -1,27 +1,90 @@
 package types
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"maps"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
 	"slices"
 )
 
 // WebArgsUrl represents a parsed URL and its properties.
 type WebArgsUrl struct {
-	Rawpath  string              `json:"rawpath"`
-	Path     string              `json:"path"`
-	Rawquery string              `json:"rawquery"`
-	Query    map[string][]string `json:"query"`
+	Rawpath  string              `json:"rawpath" luau:"rawpath"`
+	Path     string              `json:"path" luau:"path"`
+	Rawquery string              `json:"rawquery" luau:"rawquery"`
+	Query    map[string][]string `json:"query" luau:"query"`
+}
+
+// WebArgsProgram identifies the program a web request was routed to.
+type WebArgsProgram struct {
+	Pk   string `json:"pk" luau:"pk"`
+	Name string `json:"name" luau:"name"`
 }
 
 // WebArgs stores the arguments passed to a web program.
+//
+// Every field is part of the input hash, so results are only reused for requests that are the same in every field. Gateways should leave out (or anonymise) the client address where they can, as each different address is a different input.
+// Cookies and form fields aren't sent, as they're parsed from the headers and body when the program asks for them.
 type WebArgs struct {
-	Url     WebArgsUrl        `json:"url"`
-	Method  string            `json:"method"`
-	Headers map[string]string `json:"headers"`
-	Body    []byte            `json:"body"`
+	Url    WebArgsUrl `json:"url" luau:"url"`
+	Method string     `json:"method" luau:"method"`
+	// programs get headers and headerlist instead, see args.web
+	Headers Headers `json:"headers" luau:"-"`
+	Body    []byte  `json:"body" luau:"body"`
+
+	Host     string         `json:"host,omitempty" luau:"host"`
+	Scheme   string         `json:"scheme,omitempty" luau:"scheme"`     // http or https
+	Protocol string         `json:"protocol,omitempty" luau:"protocol"` // like HTTP/1.1
+	Program  WebArgsProgram `json:"program" luau:"program"`
+	// address of the client, possibly anonymised, or empty if the gateway doesn't send it
+	Client string `json:"client,omitempty" luau:"client"`
+}
+
+// Cookies parses the cookies sent with the request. If a cookie is sent more than once, the first value is used.
+func (args WebArgs) Cookies() map[string]string {
+	cookies := map[string]string{}
+	for _, line := range args.Headers.Values("cookie") {
+		cs, err := http.ParseCookie(line)
+		if err != nil {
+			continue // skip malformed cookie headers, like browsers do
+		}
+
+		for _, c := range cs {
+			if _, ok := cookies[c.Name]; !ok {
+				cookies[c.Name] = c.Value
+			}
+		}
+	}
+	return cookies
+}
+
+// maxFormMemory limits the size of multipart form fields held in memory
+const maxFormMemory = 10 << 20
+
+// Form parses the form fields in the request body, for url-encoded and multipart forms. Files in multipart forms aren't included.
+func (args WebArgs) Form() (map[string][]string, error) {
+	mt, params, err := mime.ParseMediaType(args.Headers.Get("content-type"))
+	if err != nil {
+		return map[string][]string{}, nil // not a form
+	}
+
+	switch mt {
+	case "application/x-www-form-urlencoded":
+		return url.ParseQuery(string(args.Body))
+	case "multipart/form-data":
+		form, err := multipart.NewReader(bytes.NewReader(args.Body), params["boundary"]).ReadForm(maxFormMemory)
+		if err != nil {
+			return nil, err
+		}
+		defer form.RemoveAll()
+		return form.Value, nil
+	}
+	return map[string][]string{}, nil
 }
 
 // Type returns WebProgramType.
@@ -36,17 +99,17 @@ func (args WebArgs) Encode() []byte {
 
 // WebRets stores the response returned from a web program.
 type WebRets struct {
-	StatusCode int `json:"statuscode"`
+	StatusCode int `json:"statuscode" luau:"statuscode"`
 	// StatusMessage string            `json:"statusmessage"` // removed 3 now
-	Headers map[string]string `json:"headers"`
-	Body    []byte            `json:"body"`
+	Headers Headers `json:"headers" luau:"headers"`
+	Body    []byte  `json:"body" luau:"body"`
 }
 
 func (r1 WebRets) Equal(r2 WebRets) (err error) {
 	if r1.StatusCode != r2.StatusCode {
 		err = fmt.Errorf("Expected StatusCode %d, got %d", r1.StatusCode, r2.StatusCode)
 	}
-	if !maps.Equal(r1.Headers, r2.Headers) {
+	if !r1.Headers.Equal(r2.Headers) {
 		err = errors.Join(err, fmt.Errorf("Expected Headers %v, got %v", r1.Headers, r2.Headers))
 	}
 	if !slices.Equal(r1.Body, r2.Body) {
@@ -0,0 +1,29 @@
+package types
+
+import "testing"
+
+func TestInputHash(t *testing.T) {
+	args := WebArgs{
+		Url:     WebArgsUrl{Rawpath: "/", Path: "/"},
+		Method:  "GET",
+		Headers: Headers{"accept": {"*/*"}},
+		Host:    "example.localhost",
+		Scheme:  "https",
+		Program: WebArgsProgram{"copub:abc", "web1"},
+	}
+
+	decoded, err := DecodeArgs[WebArgs](args.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if InputHash(decoded) != InputHash(args) {
+		t.Fatal("expected re-encoded args to have the same hash")
+	}
+
+	// every field counts, including the client
+	other := args
+	other.Client = "192.0.2.0"
+	if InputHash(other) == InputHash(args) {
+		t.Fatal("expected different client to change the hash")
+	}
+}
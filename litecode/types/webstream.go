@@ -0,0 +1,43 @@
+package types
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+)
+
+// WebStreamContentType is the content type of a streamed web response. The response's head is sent first, as JSON on one line, followed by its body as it's written.
+const WebStreamContentType = "application/vnd.coputer.webstream"
+
+// WebStreamErrorTrailer is the trailer set if a streamed web response fails after its head has been sent.
+const WebStreamErrorTrailer = "Coputer-Error"
+
+// WebHead is a web response without its body, which is sent before a streamed body.
+type WebHead struct {
+	StatusCode int     `json:"statuscode"`
+	Headers    Headers `json:"headers"`
+}
+
+// Head returns the head of a web response.
+func (rets WebRets) Head() WebHead {
+	return WebHead{rets.StatusCode, rets.Headers}
+}
+
+// Encode encodes a head as one line, to be followed by the body.
+func (h WebHead) Encode() []byte {
+	b, _ := json.Marshal(h)
+	return append(b, '\n')
+}
+
+// ReadWebHead reads the head of a streamed web response. The rest of r is the response body.
+func ReadWebHead(r *bufio.Reader) (h WebHead, err error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return WebHead{}, fmt.Errorf("read web response head: %w", err)
+	}
+
+	if err = json.Unmarshal(line, &h); err != nil {
+		return WebHead{}, fmt.Errorf("decode web response head: %w", err)
+	}
+	return
+}
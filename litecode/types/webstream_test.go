@@ -0,0 +1,38 @@
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestWebStream(t *testing.T) {
+	rets := WebRets{
+		StatusCode: 201,
+		Headers:    Headers{"content-type": {"text/csv"}},
+		Body:       []byte("a,b\n1,2\n"),
+	}
+
+	r := bufio.NewReader(bytes.NewReader(append(rets.Head().Encode(), rets.Body...)))
+	h, err := ReadWebHead(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.StatusCode != rets.StatusCode || !h.Headers.Equal(rets.Headers) {
+		t.Fatal("head not equal", h)
+	}
+
+	// newlines in the body don't matter after the head
+	body, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != string(rets.Body) {
+		t.Fatalf("expected body %q, got %q", rets.Body, body)
+	}
+
+	if _, err = ReadWebHead(bufio.NewReader(bytes.NewReader([]byte(`{"statuscode":200}`)))); err == nil {
+		t.Fatal("expected incomplete head to fail")
+	}
+}
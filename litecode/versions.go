@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Heliodex/coputer/bundle"
+	. "github.com/Heliodex/coputer/litecode/types"
+)
+
+// history of the programs each name has pointed to
+// each name has a file of versions, one per line, which is only ever appended to. The name points to the latest version, so peers agree on it whatever order they receive versions in.
+// every version is signed by the name's owner, and the signature is kept so the version can be given to peers
+
+const (
+	VersionsDir = bundle.DataDir + "/versions"
+	// bundles as they were stored, so versions can be fetched
+	BundlesDir = bundle.DataDir + "/bundles"
+)
+
+var versionsMu sync.Mutex
+
+// versionCmp orders versions by time, and by hash if they were signed at the same time
+func versionCmp(a, b Version) int {
+	return cmp.Or(cmp.Compare(a.Time, b.Time), strings.Compare(a.Hash, b.Hash))
+}
+
+// readVersions returns the history of a program name, oldest first
+func readVersions(p program) (vs []Version, err error) {
+	b, err := os.ReadFile(filepath.Join(VersionsDir, p.pk, p.name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+
+	for line := range bytes.SplitSeq(bytes.TrimSpace(b), []byte{'\n'}) {
+		v, err := DecodeVersion(line)
+		if err != nil {
+			return nil, fmt.Errorf("bad version: %w", err)
+		}
+		vs = append(vs, v)
+	}
+
+	slices.SortStableFunc(vs, versionCmp)
+	return
+}
+
+// addVersion records a version of a program name. If it's the latest version, the name is pointed to it, and the hash the name pointed to before is returned.
+func addVersion(p program, v Version) (old [32]byte, current bool, err error) {
+	versionsMu.Lock()
+	defer versionsMu.Unlock()
+
+	vs, err := readVersions(p)
+	if err != nil {
+		return
+	}
+	for _, e := range vs {
+		if versionCmp(e, v) == 0 && e.Signer == v.Signer {
+			return // already have it, probably from another peer
+		}
+	}
+
+	path := filepath.Join(VersionsDir, p.pk, p.name)
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(v.Encode(), '\n')); err != nil {
+		return
+	}
+
+	// older versions are kept in the history, but don't change what the name points to
+	if len(vs) > 0 && versionCmp(vs[len(vs)-1], v) > 0 {
+		return
+	}
+
+	if b, _ := os.ReadFile(filepath.Join(NamesDir, p.pk, p.name)); len(b) == 32 {
+		old = [32]byte(b)
+	}
+
+	hash := v.HashBytes()
+	return old, true, writeFile(filepath.Join(NamesDir, p.pk, p.name), hash[:])
+}
+
+// findVersion finds the latest version of a program name with a hash
+func findVersion(p program, hexhash string) (v Version, ok bool, err error) {
+	vs, err := readVersions(p)
+	if err != nil {
+		return
+	}
+
+	for _, e := range slices.Backward(vs) {
+		if e.Hash == hexhash {
+			return e, true, nil
+		}
+	}
+	return
+}
+
+var errUnsigned = errors.New("program must be stored with a version time and signature")
+
+// versionFromHeaders reads the version a program is stored with, which has to be signed by the program's owner.
+func versionFromHeaders(h http.Header, pk, hexhash string) (v Version, err error) {
+	t, s := h.Get(VersionTimeHeader), h.Get(SignatureHeader)
+	if t == "" || s == "" {
+		return Version{}, errUnsigned
+	}
+
+	v = Version{Hash: hexhash, Signer: pk}
+	if v.Time, err = strconv.ParseInt(t, 10, 64); err != nil {
+		return Version{}, errors.New("invalid version time")
+	}
+	if v.Sig, err = hex.DecodeString(s); err != nil {
+		return Version{}, errors.New("invalid signature")
+	}
+	return
+}
+
+// keepBundle stores a bundle as it was uploaded, unless it's already kept
+func keepBundle(hexhash string, b []byte) error {
+	path := filepath.Join(BundlesDir, hexhash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	return writeFile(path, b)
+}
+
+func readBundle(hexhash string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(BundlesDir, hexhash))
+}
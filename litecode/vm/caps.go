@@ -0,0 +1,99 @@
+package vm
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	. "github.com/Heliodex/coputer/litecode/types"
+	"github.com/Heliodex/coputer/litecode/vm/std"
+)
+
+// Capabilities are optional parts of the global environment, which programs must declare and node operators must allow.
+// A capability is either a whole library ("json"), or a single function in a library ("programs.call").
+var Capabilities = map[string]Val{
+	"crypto":        std.Libcrypto,
+	"json":          std.Libjson,
+	"programs.call": std.Libprograms.GetHash("call"),
+	"store":         std.Libstore,
+}
+
+// denied takes the place of a capability that hasn't been granted, so accessing it errors instead of being nil
+type denied string
+
+func (d denied) Error() string {
+	return fmt.Sprintf("capability '%s' not granted", string(d))
+}
+
+func deniedFn(name, f string) Function {
+	err := denied(name)
+	return fn(f, nil, func(*Coroutine, ...Val) ([]Val, error) {
+		return nil, err
+	})
+}
+
+// capLib returns a copy of the library table a function capability goes into, so shared libraries aren't modified.
+func capLib(env Env, lib string) *Table {
+	t := &Table{Hash: map[Val]Val{}, Readonly: true}
+	if et, ok := env[lib].(*Table); ok {
+		maps.Copy(t.Hash, et.Hash)
+	}
+
+	env[lib] = t
+	return t
+}
+
+// Granted reports whether a capability is covered by a list of capabilities. Granting a library grants all of its functions.
+func Granted(name string, caps []string) bool {
+	lib, _, _ := strings.Cut(name, ".")
+	return slices.Contains(caps, name) || slices.Contains(caps, lib)
+}
+
+// Effective returns the capabilities a program is granted, given the capabilities it declares and those allowed by the node operator. A nil allowed list allows everything.
+func Effective(declared, allowed []string) (granted []string) {
+	for _, c := range declared {
+		if allowed == nil || Granted(c, allowed) {
+			granted = append(granted, c)
+		}
+	}
+	return
+}
+
+// Compose adds capabilities to a global environment. Granted capabilities are added as usual, and the rest are added as placeholders that error when accessed.
+func Compose(env Env, caps map[string]Val, granted []string) Env {
+	composed := make(Env, len(env)+len(caps))
+	maps.Copy(composed, env)
+
+	// deterministic, and libraries go before their functions
+	names := make([]string, 0, len(caps))
+	for name := range caps {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		v := caps[name]
+		lib, f, isFn := strings.Cut(name, ".")
+		ok := Granted(name, granted)
+
+		if !isFn {
+			if ok {
+				composed[name] = v
+			} else {
+				composed[name] = denied(name)
+			}
+			continue
+		}
+
+		if _, libDenied := composed[lib].(denied); libDenied && !ok {
+			continue // whole library denied anyway
+		}
+		if !ok {
+			v = deniedFn(name, f)
+		}
+		capLib(composed, lib).Hash[f] = v
+	}
+
+	return composed
+}
@@ -0,0 +1,60 @@
+package vm
+
+import (
+	"slices"
+	"testing"
+
+	. "github.com/Heliodex/coputer/litecode/types"
+	"github.com/Heliodex/coputer/litecode/vm/std"
+)
+
+func TestEffective(t *testing.T) {
+	declared := []string{"json", "programs.call", "crypto"}
+
+	if e := Effective(declared, nil); !slices.Equal(e, declared) {
+		t.Fatal("nil allowed list should allow everything, got", e)
+	}
+
+	if e := Effective(declared, []string{"programs", "crypto"}); !slices.Equal(e, []string{"programs.call", "crypto"}) {
+		t.Fatal("unexpected effective capabilities", e)
+	}
+
+	if e := Effective(declared, []string{}); len(e) != 0 {
+		t.Fatal("empty allowed list should allow nothing, got", e)
+	}
+}
+
+func TestCompose(t *testing.T) {
+	caps := map[string]Val{
+		"json":          std.Libjson,
+		"crypto":        std.Libcrypto,
+		"programs.call": std.MakeFn("call", func(std.Args) ([]Val, error) { return []Val{true}, nil }),
+	}
+
+	env := Compose(Env{"print": true}, caps, []string{"json"})
+
+	if env["print"] != true {
+		t.Fatal("existing environment not kept")
+	}
+	if env["json"] != std.Libjson {
+		t.Fatal("granted library not added")
+	}
+
+	if d, ok := env["crypto"].(denied); !ok || d.Error() != "capability 'crypto' not granted" {
+		t.Fatal("denied library not replaced, got", env["crypto"])
+	}
+
+	call, ok := env["programs"].(*Table).GetHash("call").(Function)
+	if !ok {
+		t.Fatal("denied function not added")
+	}
+	if _, err := (*call.Run)(nil); err == nil || err.Error() != "capability 'programs.call' not granted" {
+		t.Fatal("denied function didn't error, got", err)
+	}
+
+	env = Compose(nil, caps, []string{"programs"})
+	call = env["programs"].(*Table).GetHash("call").(Function)
+	if r, err := (*call.Run)(nil); err != nil || r[0] != true {
+		t.Fatal("granted function not callable", r, err)
+	}
+}
@@ -49,15 +49,18 @@ func Compile(c Compiler, path string) (p Program, err error) {
 	// find if file at path exists
 	if _, err := os.Stat(pathext); err != nil {
 		if _, err := os.Stat(path); err != nil {
-			return p, errors.New("error finding file")
+			return p, ClassifyError(InfraError, errors.New("error finding file"))
 		}
 		// main.luau directory
 		pathext = path + "/main" + Ext
 	}
 
 	b, err := luauCompile(pathext, c.O)
-	if err != nil {
-		return p, fmt.Errorf("compile file: %w", err)
+	if _, ok := errors.AsType[*exec.ExitError](err); ok {
+		// the compiler ran, and rejected the program
+		return p, ClassifyError(ProgramError, fmt.Errorf("compile file: %w", err))
+	} else if err != nil {
+		return p, ClassifyError(InfraError, fmt.Errorf("compile file: %w", err))
 	}
 
 	// dbgpath has the extension and all
@@ -12,53 +12,56 @@ func args_web(args Args) (r []Val, err error) {
 		return nil, errors.New("web args only available in web mode")
 	}
 
-	query := make(map[Val]Val, len(pargs.Url.Query))
-	for k, vs := range pargs.Url.Query {
-		params := make([]Val, len(vs))
-		for i, v := range vs {
-			params[i] = v
-		}
+	webargs, err := MarshalReadonly(pargs)
+	if err != nil {
+		return
+	}
 
-		query[k] = &Table{
-			List:     params,
-			Readonly: true,
-		}
+	// headers for the first value of each header, headerlist for all of them
+	headers, err := MarshalReadonly(pargs.Headers.First())
+	if err != nil {
+		return
+	}
+	headerlist, err := MarshalReadonly(map[string][]string(pargs.Headers))
+	if err != nil {
+		return
 	}
 
-	headers := make(map[Val]Val, len(pargs.Headers))
-	for k, v := range pargs.Headers {
-		headers[k] = v
+	// parsed here rather than sent, so they always match the headers and body
+	cookies, err := MarshalReadonly(pargs.Cookies())
+	if err != nil {
+		return
+	}
+	fields, err := pargs.Form()
+	if err != nil {
+		fields = nil // malformed forms have no fields
+	}
+	form, err := MarshalReadonly(fields)
+	if err != nil {
+		return
 	}
 
-	bb := Buffer(pargs.Body)
+	t := webargs.(*Table)
+	t.Hash["headers"], t.Hash["headerlist"] = headers, headerlist
+	t.Hash["cookies"], t.Hash["form"] = cookies, form
+	return []Val{t}, nil
+}
+
+func args_scheduled(args Args) (r []Val, err error) {
+	pargs, ok := args.Co.ProgramArgs.(ScheduledArgs)
+	if !ok {
+		return nil, errors.New("scheduled args only available in scheduled mode")
+	}
 
-	webargs := &Table{
-		Hash: map[Val]Val{
-			"url": &Table{
-				Hash: map[Val]Val{
-					"rawpath":  pargs.Url.Rawpath,
-					"path":     pargs.Url.Path,
-					"rawquery": pargs.Url.Rawquery,
-					"query": &Table{
-						Hash:     query,
-						Readonly: true,
-					},
-				},
-				Readonly: true,
-			},
-			"method": pargs.Method,
-			"headers": &Table{
-				Hash:     headers,
-				Readonly: true,
-			},
-			"body": &bb,
-		},
-		Readonly: true,
+	schedargs, err := MarshalReadonly(pargs)
+	if err != nil {
+		return
 	}
 
-	return []Val{webargs}, nil
+	return []Val{schedargs}, nil
 }
 
 var Libargs = NewLib([]Function{
 	MakeFn("web", args_web),
+	MakeFn("scheduled", args_scheduled),
 })
@@ -0,0 +1,57 @@
+package std
+
+import (
+	"testing"
+
+	. "github.com/Heliodex/coputer/litecode/types"
+)
+
+func TestArgsWebHeaders(t *testing.T) {
+	co := &Coroutine{ProgramArgs: WebArgs{
+		Method:  "GET",
+		Headers: NewHeaders(map[string][]string{"Accept": {"text/html", "*/*"}}),
+	}}
+
+	r, err := (*Libargs.GetHash("web").(Function).Run)(co)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webargs := r[0].(*Table)
+
+	// headers has the first value, headerlist has all of them
+	if v := webargs.GetHash("headers").(*Table).GetHash("accept"); v != "text/html" {
+		t.Fatal("expected first header value, got", v)
+	}
+
+	list := webargs.GetHash("headerlist").(*Table).GetHash("accept").(*Table)
+	if list.Len() != 2 || list.List[1] != "*/*" {
+		t.Fatal("expected all header values, got", list.List)
+	}
+}
+
+func TestArgsWebCookiesForm(t *testing.T) {
+	co := &Coroutine{ProgramArgs: WebArgs{
+		Method: "POST",
+		Headers: NewHeaders(map[string][]string{
+			"Cookie":       {"session=abc; theme=dark", "session=ignored"},
+			"Content-Type": {"application/x-www-form-urlencoded"},
+		}),
+		Body: []byte("name=coputer&tag=a&tag=b"),
+	}}
+
+	r, err := (*Libargs.GetHash("web").(Function).Run)(co)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webargs := r[0].(*Table)
+
+	cookies := webargs.GetHash("cookies").(*Table)
+	if cookies.GetHash("session") != "abc" || cookies.GetHash("theme") != "dark" {
+		t.Fatal("cookies not parsed", cookies.Hash)
+	}
+
+	tags := webargs.GetHash("form").(*Table).GetHash("tag").(*Table)
+	if tags.Len() != 2 || tags.List[0] != "a" || tags.List[1] != "b" {
+		t.Fatal("form not parsed", tags.List)
+	}
+}
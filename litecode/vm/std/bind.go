@@ -0,0 +1,350 @@
+package std
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	. "github.com/Heliodex/coputer/litecode/types"
+)
+
+// reflection time, so people embedding litecode don't have to write args.GetNumber() a thousand times
+
+var (
+	typeVal      = reflect.TypeFor[Val]()
+	typeError    = reflect.TypeFor[error]()
+	typeTable    = reflect.TypeFor[*Table]()
+	typeFunction = reflect.TypeFor[Function]()
+	typeCo       = reflect.TypeFor[*Coroutine]()
+	typeBuffer   = reflect.TypeFor[*Buffer]()
+	typeBytes    = reflect.TypeFor[[]byte]()
+	typeVector   = reflect.TypeFor[Vector]()
+)
+
+// param converts a single Luau argument to a Go value of a bound function's parameter type.
+type param struct {
+	t        reflect.Type
+	tx       string // Luau type expected, for error messages
+	optional bool
+}
+
+func luauType(t reflect.Type) (tx string, ok bool) {
+	switch t {
+	case typeVal:
+		return "any", true
+	case typeTable:
+		return "table", true
+	case typeFunction:
+		return "function", true
+	case typeCo:
+		return "thread", true
+	case typeBuffer, typeBytes:
+		return "buffer", true
+	case typeVector:
+		return "vector", true
+	}
+
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "number", true
+	case reflect.String:
+		return "string", true
+	case reflect.Bool:
+		return "boolean", true
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		return "table", true // converted with Unmarshal
+	}
+	return
+}
+
+func makeParam(t reflect.Type) (p param, err error) {
+	// pointers to basic types are optional, *Table etc are already pointers
+	if t.Kind() == reflect.Pointer && t != typeTable && t != typeCo && t != typeBuffer {
+		tx, ok := luauType(t.Elem())
+		if !ok || tx == "any" {
+			return param{}, fmt.Errorf("unsupported parameter type %s", t)
+		}
+		return param{t, tx, true}, nil
+	}
+
+	tx, ok := luauType(t)
+	if !ok {
+		return param{}, fmt.Errorf("unsupported parameter type %s", t)
+	}
+	return param{t, tx, tx == "any"}, nil
+}
+
+// errWrongType is returned by convert when an argument is of the wrong Luau type.
+var errWrongType = errors.New("wrong type")
+
+// convert returns the Go value for a Luau argument.
+func (p param) convert(v Val) (rv reflect.Value, err error) {
+	t := p.t
+	if p.optional && t.Kind() == reflect.Pointer {
+		if v == nil {
+			return reflect.Zero(t), nil
+		}
+
+		ev, err := param{t: t.Elem()}.convert(v)
+		if err != nil {
+			return rv, err
+		}
+		pv := reflect.New(t.Elem())
+		pv.Elem().Set(ev)
+		return pv, nil
+	}
+
+	switch t {
+	case typeVal:
+		if v == nil {
+			return reflect.Zero(t), nil
+		}
+		return reflect.ValueOf(&v).Elem(), nil
+	case typeBytes:
+		b, ok := v.(*Buffer)
+		if !ok {
+			return rv, errWrongType
+		}
+		return reflect.ValueOf([]byte(*b)), nil
+	}
+
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, ok := v.(float64); !ok {
+			return rv, errWrongType
+		}
+		// non-integers and numbers out of range are rejected, not truncated or wrapped
+		pv := reflect.New(t)
+		if err := Unmarshal(v, pv.Interface()); err != nil {
+			return rv, err
+		}
+		return pv.Elem(), nil
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		if t == typeVector || t == typeFunction {
+			break
+		}
+		if _, ok := v.(*Table); !ok {
+			return rv, errWrongType
+		}
+		pv := reflect.New(t)
+		if err := Unmarshal(v, pv.Interface()); err != nil {
+			return rv, err
+		}
+		return pv.Elem(), nil
+	}
+
+	if v == nil {
+		return rv, errWrongType
+	}
+	av := reflect.ValueOf(v)
+	if av.Type() != t {
+		return rv, errWrongType
+	}
+	return av, nil
+}
+
+// ret converts a return value of a bound function back to a Luau value.
+func ret(rv reflect.Value) (v Val, err error) {
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), nil
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.Interface:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return ret(rv.Elem())
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		if t := rv.Type(); t != typeTable && t != typeCo && t != typeBuffer {
+			return ret(rv.Elem())
+		}
+	case reflect.Slice:
+		if rv.IsNil() {
+			return nil, nil
+		}
+	}
+
+	switch t := rv.Type(); {
+	case t == typeBytes:
+		b := Buffer(rv.Bytes())
+		return &b, nil
+	case t == typeVector, t == typeFunction:
+	case t.Kind() == reflect.Struct, t.Kind() == reflect.Map, t.Kind() == reflect.Slice, t.Kind() == reflect.Array:
+		// only the top-level type is checked when binding, so nested fields can still fail
+		return Marshal(rv.Interface())
+	}
+	return rv.Interface(), nil
+}
+
+// call calls a bound function, turning a panic into an error so it can't crash whatever is running the VM.
+func call(name string, fv reflect.Value, in []reflect.Value) (out []reflect.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s panicked: %v", name, r)
+		}
+	}()
+	return fv.Call(in), nil
+}
+
+func invalidArg(i int, fn, tx string, v Val, err error) error {
+	if err == errWrongType {
+		return invalidArgType(i, fn, tx, TypeOf(v))
+	}
+	return fmt.Errorf("invalid argument #%d to '%s' (%w)", i, fn, err)
+}
+
+func checkRets(t reflect.Type) (hasErr bool, err error) {
+	n := t.NumOut()
+	for i := range n {
+		o := t.Out(i)
+		if o == typeError {
+			if i != n-1 {
+				return false, errors.New("error must be the last return value")
+			}
+			return true, nil
+		}
+		if o.Kind() == reflect.Pointer && o != typeTable && o != typeCo && o != typeBuffer {
+			o = o.Elem()
+		}
+		if _, ok := luauType(o); !ok {
+			return false, fmt.Errorf("unsupported return type %s", t.Out(i))
+		}
+	}
+	return
+}
+
+func bindValue(name string, fv reflect.Value) (f Function, err error) {
+	t := fv.Type()
+	if t.Kind() != reflect.Func {
+		return Function{}, fmt.Errorf("cannot bind %s: not a function", t)
+	}
+
+	nin := t.NumIn()
+	variadic := t.IsVariadic()
+	params := make([]param, nin)
+	for i := range nin {
+		pt := t.In(i)
+		if variadic && i == nin-1 {
+			pt = pt.Elem()
+		}
+		if params[i], err = makeParam(pt); err != nil {
+			return Function{}, fmt.Errorf("cannot bind %s: parameter %d: %w", name, i+1, err)
+		}
+	}
+
+	hasErr, err := checkRets(t)
+	if err != nil {
+		return Function{}, fmt.Errorf("cannot bind %s: %w", name, err)
+	}
+
+	// number of params that must be provided (optional ones at the end can be left out)
+	fixed := nin
+	if variadic {
+		fixed--
+	}
+	required := fixed
+	for required > 0 && params[required-1].optional {
+		required--
+	}
+
+	return fn(name, func(_ *Coroutine, vargs ...Val) (r []Val, err error) {
+		in := make([]reflect.Value, 0, max(nin, len(vargs)))
+
+		for i, p := range params[:fixed] {
+			if i >= len(vargs) {
+				if i < required {
+					return nil, invalidNumArgsExpected(name, i+1, p.tx)
+				}
+				in = append(in, reflect.Zero(p.t))
+				continue
+			}
+
+			rv, err := p.convert(vargs[i])
+			if err != nil {
+				return nil, invalidArg(i+1, name, p.tx, vargs[i], err)
+			}
+			in = append(in, rv)
+		}
+
+		if variadic {
+			p := params[fixed]
+			for i := fixed; i < len(vargs); i++ {
+				rv, err := p.convert(vargs[i])
+				if err != nil {
+					return nil, invalidArg(i+1, name, p.tx, vargs[i], err)
+				}
+				in = append(in, rv)
+			}
+		}
+
+		out, err := call(name, fv, in)
+		if err != nil {
+			return
+		}
+		if hasErr {
+			if e := out[len(out)-1]; !e.IsNil() {
+				return nil, e.Interface().(error)
+			}
+			out = out[:len(out)-1]
+		}
+
+		r = make([]Val, len(out))
+		for i, o := range out {
+			if r[i], err = ret(o); err != nil {
+				return nil, fmt.Errorf("invalid return value #%d from '%s' (%w)", i+1, name, err)
+			}
+		}
+		return
+	}), nil
+}
+
+// Bind creates a native function from an ordinary Go function, checking and converting arguments automatically.
+//
+// Parameters may be numbers (any Go integer or float type), strings, booleans, *Table, Function, *Coroutine, *Buffer, []byte (as a buffer), Vector, or Val. Structs, maps, slices, and arrays are converted from tables with Unmarshal. Pointers to basic types are optional, and receive nil if the argument is missing or nil. The final parameter may be variadic.
+// Return values follow the same rules, and a final error return value is raised as a Luau error.
+func Bind(name string, f any) (Function, error) {
+	return bindValue(name, reflect.ValueOf(f))
+}
+
+// MustBind is like Bind, but panics if the function cannot be bound.
+func MustBind(name string, f any) Function {
+	bf, err := Bind(name, f)
+	if err != nil {
+		panic(err)
+	}
+	return bf
+}
+
+// BindLib creates a library from the exported methods of a value, using Bind for each method. Method names are converted to lowercase, as with the standard libraries.
+func BindLib(v any) (*Table, error) {
+	rv := reflect.ValueOf(v)
+	rt := rv.Type()
+
+	functions := make([]Function, 0, rt.NumMethod())
+	for i := range rt.NumMethod() {
+		name := strings.ToLower(rt.Method(i).Name)
+
+		f, err := bindValue(name, rv.Method(i))
+		if err != nil {
+			return nil, err
+		}
+		functions = append(functions, f)
+	}
+
+	return NewLib(functions), nil
+}
@@ -0,0 +1,206 @@
+package std
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	. "github.com/Heliodex/coputer/litecode/types"
+)
+
+func runFn(f Function, args ...Val) ([]Val, error) {
+	return (*f.Run)(nil, args...)
+}
+
+func TestBind(t *testing.T) {
+	rep := MustBind("rep", func(s string, n float64) (string, error) {
+		if n < 0 {
+			return "", errors.New("negative count")
+		}
+		return strings.Repeat(s, int(n)), nil
+	})
+
+	r, err := runFn(rep, "ab", float64(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 || r[0] != "ababab" {
+		t.Fatalf("unexpected return %v", r)
+	}
+
+	if _, err = runFn(rep, "ab", float64(-1)); err == nil || err.Error() != "negative count" {
+		t.Fatal("expected returned error, got", err)
+	}
+
+	if _, err = runFn(rep, "ab", "3"); err == nil || err.Error() != "invalid argument #2 to 'rep' (number expected, got string)" {
+		t.Fatal("expected invalid argument error, got", err)
+	}
+
+	if _, err = runFn(rep, "ab"); err == nil || err.Error() != "missing argument #2 to 'rep' (number expected)" {
+		t.Fatal("expected missing argument error, got", err)
+	}
+}
+
+func TestBindOptionalVariadic(t *testing.T) {
+	sum := MustBind("sum", func(start *int, ns ...float64) float64 {
+		var s float64
+		if start != nil {
+			s = float64(*start)
+		}
+		for _, n := range ns {
+			s += n
+		}
+		return s
+	})
+
+	for _, c := range []struct {
+		args []Val
+		res  float64
+	}{
+		{nil, 0},
+		{[]Val{nil}, 0},
+		{[]Val{float64(10)}, 10},
+		{[]Val{float64(10), float64(1), float64(2)}, 13},
+	} {
+		r, err := runFn(sum, c.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r[0] != c.res {
+			t.Fatalf("expected %v, got %v", c.res, r[0])
+		}
+	}
+
+	if _, err := runFn(sum, float64(1), float64(2), true); err == nil || err.Error() != "invalid argument #3 to 'sum' (number expected, got boolean)" {
+		t.Fatal("expected invalid variadic argument error, got", err)
+	}
+}
+
+func TestBindBuffer(t *testing.T) {
+	upper := MustBind("upper", func(b []byte) []byte {
+		return []byte(strings.ToUpper(string(b)))
+	})
+
+	b := Buffer("hello")
+	r, err := runFn(upper, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rb, ok := r[0].(*Buffer)
+	if !ok || string(*rb) != "HELLO" {
+		t.Fatalf("unexpected return %v", r[0])
+	}
+}
+
+type testLib struct{ prefix string }
+
+func (l testLib) Greet(name string) string {
+	return l.prefix + name
+}
+
+func (testLib) Pair() (float64, bool) {
+	return 1, true
+}
+
+func TestBindLib(t *testing.T) {
+	lib, err := BindLib(testLib{"hi "})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	greet, ok := lib.GetHash("greet").(Function)
+	if !ok {
+		t.Fatal("greet not found in library")
+	}
+
+	r, err := runFn(greet, "world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r[0] != "hi world" {
+		t.Fatalf("unexpected return %v", r[0])
+	}
+
+	pair := lib.GetHash("pair").(Function)
+	if r, _ = runFn(pair); len(r) != 2 || r[0] != float64(1) || r[1] != true {
+		t.Fatalf("unexpected return %v", r)
+	}
+
+	if _, err = Bind("bad", func(chan int) {}); err == nil {
+		t.Fatal("expected unsupported parameter error")
+	}
+}
+
+type point struct {
+	X float64 `luau:"x"`
+	Y float64 `luau:"y"`
+}
+
+func TestBindStruct(t *testing.T) {
+	swap := MustBind("swap", func(p point) point {
+		return point{p.Y, p.X}
+	})
+
+	r, err := runFn(swap, &Table{Hash: map[Val]Val{"x": float64(1), "y": float64(2)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p point
+	if err = Unmarshal(r[0], &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.X != 2 || p.Y != 1 {
+		t.Fatalf("unexpected return %+v", p)
+	}
+
+	_, err = runFn(swap, &Table{Hash: map[Val]Val{"x": "1"}})
+	if err == nil || err.Error() != "invalid argument #1 to 'swap' (x: cannot unmarshal string into float64)" {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestBindNumbers(t *testing.T) {
+	idx := MustBind("idx", func(i uint8) uint8 { return i })
+
+	if r, err := runFn(idx, float64(255)); err != nil || r[0] != float64(255) {
+		t.Fatal("unexpected return", r, err)
+	}
+
+	for _, c := range []struct {
+		n   float64
+		err string
+	}{
+		{1.5, "invalid argument #1 to 'idx' (number 1.5 is not an integer)"},
+		{-1, "invalid argument #1 to 'idx' (number -1 overflows uint8)"},
+		{256, "invalid argument #1 to 'idx' (number 256 overflows uint8)"},
+	} {
+		if _, err := runFn(idx, c.n); err == nil || err.Error() != c.err {
+			t.Fatal("expected", c.err, "got", err)
+		}
+	}
+}
+
+func TestBindPanic(t *testing.T) {
+	boom := MustBind("boom", func() float64 {
+		var m map[string]int
+		m["x"] = 1 // assignment to entry in nil map
+		return 0
+	})
+
+	if _, err := runFn(boom); err == nil || !strings.HasPrefix(err.Error(), "boom panicked: ") {
+		t.Fatal("expected panic to be returned as an error, got", err)
+	}
+}
+
+func TestBindNestedReturn(t *testing.T) {
+	type withChan struct {
+		C chan int
+	}
+	bad := MustBind("bad", func() withChan { return withChan{make(chan int)} })
+
+	if _, err := runFn(bad); err == nil || err.Error() != "invalid return value #1 from 'bad' (c: unsupported type chan int)" {
+		t.Fatal("unexpected error:", err)
+	}
+}
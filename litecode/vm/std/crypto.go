@@ -0,0 +1,46 @@
+package std
+
+import (
+	"crypto/sha256"
+	"crypto/sha3"
+	"encoding/hex"
+	"errors"
+
+	. "github.com/Heliodex/coputer/litecode/types"
+)
+
+// hashes take strings or buffers
+func hashData(v Val) ([]byte, error) {
+	switch d := v.(type) {
+	case string:
+		return []byte(d), nil
+	case *Buffer:
+		return *d, nil
+	}
+	return nil, errors.New("string or buffer expected, got " + TypeOf(v))
+}
+
+func crypto_sha256(data Val) (string, error) {
+	b, err := hashData(data)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+func crypto_sha3(data Val) (string, error) {
+	b, err := hashData(data)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha3.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+var Libcrypto = NewLib([]Function{
+	MustBind("sha256", crypto_sha256),
+	MustBind("sha3", crypto_sha3),
+})
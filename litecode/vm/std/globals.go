@@ -567,6 +567,20 @@ func global_require(args Args) (r []Val, err error) {
 	return []Val{p}, nil
 }
 
+// global_pcall calls a function, returning false and the error message if it fails instead of raising it. Limit errors still raise, so programs can't run past their limits.
+func global_pcall(args Args) (r []Val, err error) {
+	f := args.GetFunction()
+
+	rets, err := (*f.Run)(args.Co, args.List[1:]...)
+	if err != nil {
+		if ErrorClassOf(err) == LimitError {
+			return nil, err
+		}
+		return []Val{false, err.Error()}, nil
+	}
+	return append([]Val{true}, rets...), nil
+}
+
 var Globals = []Function{
 	MakeFn("type", global_type),
 	// MakeFn("typeof", global_type), // same because no metatables
@@ -576,4 +590,5 @@ var Globals = []Function{
 	MakeFn("tonumber", global_tonumber),
 	MakeFn("tostring", global_tostring),
 	MakeFn("require", global_require),
+	MakeFn("pcall", global_pcall),
 }
@@ -1,8 +1,11 @@
 package std
 
 import (
+	"errors"
 	"math"
 	"testing"
+
+	. "github.com/Heliodex/coputer/litecode/types"
 )
 
 func TestMul128(t *testing.T) {
@@ -79,3 +82,30 @@ func BenchmarkNum2Str3(b *testing.B) {
 		num2str(n)
 	}
 }
+
+func TestPcall(t *testing.T) {
+	pcall := MakeFn("pcall", global_pcall)
+	add := MakeFn("add", func(args Args) ([]Val, error) {
+		return []Val{args.GetNumber() + args.GetNumber()}, nil
+	})
+	fail := MakeFn("fail", func(Args) ([]Val, error) {
+		return nil, ClassifyError(ProgramError, errors.New("oh no"))
+	})
+	timeout := MakeFn("timeout", func(Args) ([]Val, error) {
+		return nil, ClassifyError(LimitError, errors.New("program timed out"))
+	})
+
+	r, err := runFn(pcall, add, float64(1), float64(2))
+	if err != nil || len(r) != 2 || r[0] != true || r[1] != float64(3) {
+		t.Fatalf("unexpected return %v, %v", r, err)
+	}
+
+	r, err = runFn(pcall, fail)
+	if err != nil || len(r) != 2 || r[0] != false || r[1] != "oh no" {
+		t.Fatalf("unexpected return %v, %v", r, err)
+	}
+
+	if _, err = runFn(pcall, timeout); ErrorClassOf(err) != LimitError {
+		t.Fatalf("expected limit error to raise, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package std
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	. "github.com/Heliodex/coputer/litecode/types"
+)
+
+// lists become arrays, everything else becomes an object (encoding/json sorts keys, so it's deterministic)
+func jsonValue(v Val, depth int) (jv any, err error) {
+	if depth > 100 {
+		return nil, errors.New("cannot encode deeply nested or cyclic table")
+	}
+
+	switch tv := v.(type) {
+	case nil, bool, string:
+		return tv, nil
+	case float64:
+		if math.IsNaN(tv) || math.IsInf(tv, 0) {
+			return nil, fmt.Errorf("cannot encode number %s", num2str(tv))
+		}
+		return tv, nil
+	case *Table:
+		if len(tv.Hash) == 0 {
+			list := make([]any, len(tv.List))
+			for i, lv := range tv.List {
+				if list[i], err = jsonValue(lv, depth+1); err != nil {
+					return
+				}
+			}
+			return list, nil
+		}
+
+		obj := make(map[string]any, tv.Len()+len(tv.Hash))
+		for k, hv := range tv.Iter() {
+			sk, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("cannot encode table with %s keys", TypeOf(k))
+			}
+			if obj[sk], err = jsonValue(hv, depth+1); err != nil {
+				return
+			}
+		}
+		return obj, nil
+	}
+	return nil, fmt.Errorf("cannot encode %s", TypeOf(v))
+}
+
+func json_encode(args Args) (r []Val, err error) {
+	v := args.GetAny()
+
+	jv, err := jsonValue(v, 0)
+	if err != nil {
+		return
+	}
+
+	b, err := json.Marshal(jv)
+	if err != nil {
+		return
+	}
+	return []Val{string(b)}, nil
+}
+
+// arrays become lists, with nulls left as holes, so elements after them keep their index
+func luauValue(jv any) Val {
+	switch tv := jv.(type) {
+	case []any:
+		t := &Table{}
+		for i, e := range tv {
+			if v := luauValue(e); v != nil {
+				t.SetInt(i+1, v)
+			}
+		}
+		return t
+	case map[string]any:
+		t := &Table{Hash: make(map[Val]Val, len(tv))}
+		for k, e := range tv {
+			if v := luauValue(e); v != nil {
+				t.Hash[k] = v
+			}
+		}
+		return t
+	}
+	return jv // nil, bool, float64 or string
+}
+
+func json_decode(args Args) (r []Val, err error) {
+	s := args.GetString()
+
+	var jv any
+	if err = json.Unmarshal([]byte(s), &jv); err != nil {
+		return nil, fmt.Errorf("invalid json: %w", err)
+	}
+
+	return []Val{luauValue(jv)}, nil
+}
+
+var Libjson = NewLib([]Function{
+	MakeFn("encode", json_encode),
+	MakeFn("decode", json_decode),
+})
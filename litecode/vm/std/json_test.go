@@ -0,0 +1,52 @@
+package std
+
+import (
+	"testing"
+
+	. "github.com/Heliodex/coputer/litecode/types"
+)
+
+func TestJson(t *testing.T) {
+	encode := Libjson.GetHash("encode").(Function)
+	decode := Libjson.GetHash("decode").(Function)
+
+	v := &Table{
+		List: []Val{float64(1), "two"},
+	}
+	r, err := runFn(encode, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r[0] != `[1,"two"]` {
+		t.Fatal("unexpected list encoding", r[0])
+	}
+
+	v = &Table{Hash: map[Val]Val{"b": true, "a": &Table{}}}
+	if r, err = runFn(encode, v); err != nil {
+		t.Fatal(err)
+	}
+	if r[0] != `{"a":[],"b":true}` {
+		t.Fatal("unexpected object encoding", r[0])
+	}
+
+	if _, err = runFn(encode, &Table{Hash: map[Val]Val{true: "x"}}); err == nil {
+		t.Fatal("expected error encoding boolean keys")
+	}
+
+	if r, err = runFn(decode, `{"a":[1,2],"b":"c"}`); err != nil {
+		t.Fatal(err)
+	}
+	dt := r[0].(*Table)
+	if dt.GetHash("b") != "c" || dt.GetHash("a").(*Table).GetInt(2) != float64(2) {
+		t.Fatal("unexpected decoded value", dt)
+	}
+
+	// nulls in arrays are holes
+	if r, err = runFn(decode, `[1,null,3]`); err != nil {
+		t.Fatal(err)
+	}
+	dt = r[0].(*Table)
+	if dt.GetInt(1) != float64(1) || dt.GetInt(2) != nil || dt.GetInt(3) != float64(3) {
+		t.Fatal("unexpected decoded array with null", dt)
+	}
+}
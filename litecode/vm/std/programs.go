@@ -0,0 +1,16 @@
+package std
+
+import (
+	"errors"
+
+	. "github.com/Heliodex/coputer/litecode/types"
+)
+
+// calling other programs needs somewhere to run them, so the execution server replaces this with its own version
+func programs_call(args Args) (r []Val, err error) {
+	return nil, errors.New("program calls are not available here")
+}
+
+var Libprograms = NewLib([]Function{
+	MakeFn("call", programs_call),
+})
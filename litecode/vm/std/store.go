@@ -0,0 +1,64 @@
+package std
+
+import (
+	"encoding/hex"
+	"errors"
+	"slices"
+
+	. "github.com/Heliodex/coputer/litecode/types"
+)
+
+// the store library reads and writes a stateful program's state, as a transaction the execution server applies if the run succeeds
+
+var errNoStore = errors.New("program state is not available here")
+
+func storeFns(tx *StateTxn) []Function {
+	check := func(f func(Args) ([]Val, error)) func(Args) ([]Val, error) {
+		if tx == nil {
+			return func(Args) ([]Val, error) {
+				return nil, errNoStore
+			}
+		}
+		return f
+	}
+
+	return []Function{
+		MakeFn("get", check(func(args Args) (r []Val, err error) {
+			v, ok := tx.Get(args.GetString())
+			if !ok {
+				return []Val{nil}, nil
+			}
+
+			b := Buffer(slices.Clone(v)) // buffers are mutable
+			return []Val{&b}, nil
+		})),
+		MakeFn("set", check(func(args Args) (r []Val, err error) {
+			k, v := args.GetString(), args.GetBuffer()
+			return nil, tx.Set(k, *v)
+		})),
+		MakeFn("delete", check(func(args Args) (r []Val, err error) {
+			tx.Delete(args.GetString())
+			return
+		})),
+		MakeFn("scan", check(func(args Args) (r []Val, err error) {
+			ks := tx.Scan(args.GetString(""))
+
+			list := make([]Val, len(ks))
+			for i, k := range ks {
+				list[i] = k
+			}
+			return []Val{&Table{List: list}}, nil
+		})),
+		MakeFn("root", check(func(args Args) (r []Val, err error) {
+			return []Val{hex.EncodeToString(tx.Root[:])}, nil
+		})),
+	}
+}
+
+// NewStore creates a store library for a run of a stateful program.
+func NewStore(tx *StateTxn) *Table {
+	return NewLib(storeFns(tx))
+}
+
+// Libstore is the store library outside of the execution server, where there's no state
+var Libstore = NewStore(nil)
@@ -145,6 +145,8 @@ type toWrap struct {
 	upvals    []*upval
 	alive     *bool
 	env       Env
+	// globals can be set, only used by the REPL
+	mutable bool
 	// Store the last return, as it's the only one that's relevant
 	requireCache map[string]Val
 }
@@ -167,6 +169,9 @@ func getImport(A, count uint8, K0, K1, K2 string, towrap toWrap, stack *[]Val) (
 	if imp == nil {
 		imp = towrap.env[K0]
 	}
+	if d, ok := imp.(denied); ok {
+		return d
+	}
 
 	if count < 2 {
 		(*stack)[A] = imp
@@ -308,7 +313,7 @@ func handleRequire(towrap toWrap, p compile.Program, co *Coroutine) (rets []Val,
 	}
 
 	// since environments only store global libraries etc, using the same env here should be fine??
-	c2, _ := loadmodule(p, co.Env, towrap.requireCache, co.ProgramArgs)
+	c2, _ := loadmodule(p, co.Env, towrap.requireCache, co.ProgramArgs, false)
 	reqrets, err := c2.Resume()
 	if err != nil {
 		return
@@ -506,6 +511,8 @@ func execute(towrap toWrap, stack, vargsList []Val, co *Coroutine) (r []Val, err
 
 			if e, ok := exts[kv]; ok {
 				stack[i.A] = e
+			} else if d, ok := towrap.env[kv].(denied); ok {
+				return nil, d
 			} else {
 				stack[i.A] = towrap.env[kv]
 			}
@@ -520,7 +527,12 @@ func execute(towrap toWrap, stack, vargsList []Val, co *Coroutine) (r []Val, err
 			if _, ok := exts[kv]; ok {
 				return nil, fmt.Errorf("attempt to redefine global '%s'", kv)
 			}
-			return nil, fmt.Errorf("attempt to set global '%s'", kv)
+			if !towrap.mutable {
+				return nil, fmt.Errorf("attempt to set global '%s'", kv)
+			}
+
+			towrap.env[kv] = stack[i.A]
+			pc += 2 // -- adjust for aux
 		case 9: // GETUPVAL
 			if uv := upvals[i.B]; uv.store == nil {
 				stack[i.A] = uv.Val
@@ -1027,7 +1039,7 @@ func wrapclosure(towrap toWrap, existingCo *Coroutine) Function {
 	})
 }
 
-func loadmodule(p compile.Program, env Env, requireCache map[string]Val, args ProgramArgs) (co Coroutine, cancel func()) {
+func loadmodule(p compile.Program, env Env, requireCache map[string]Val, args ProgramArgs, mutable bool) (co Coroutine, cancel func()) {
 	alive := true
 
 	towrap := toWrap{
@@ -1035,6 +1047,7 @@ func loadmodule(p compile.Program, env Env, requireCache map[string]Val, args Pr
 		protoList:    p.ProtoList,
 		alive:        &alive,
 		env:          env,
+		mutable:      mutable,
 		requireCache: requireCache,
 	}
 
@@ -1052,5 +1065,27 @@ func loadmodule(p compile.Program, env Env, requireCache map[string]Val, args Pr
 }
 
 func Load(p compile.Program, env Env, args ProgramArgs) (co Coroutine, cancel func()) {
-	return loadmodule(p, env, map[string]Val{}, args)
+	return loadmodule(p, env, map[string]Val{}, args, false)
+}
+
+// LoadMutable is like Load, but globals set by the program are stored in env instead of erroring, so they persist between programs sharing it.
+func LoadMutable(p compile.Program, env Env, args ProgramArgs) (co Coroutine, cancel func()) {
+	return loadmodule(p, env, map[string]Val{}, args, true)
+}
+
+// Call runs a function in a new coroutine, with the same environment and program args as co (usually the finished main coroutine). Errors in the function are returned instead of killing co.
+func Call(co Coroutine, f Function, args ...Val) ([]Val, error) {
+	co.Function = f
+	co.YieldChan = make(chan internal.Yield, 1)
+	co.ResumeChan = make(chan []Val, 1)
+	co.Status = internal.CoNotStarted
+
+	r, err := co.Resume(args...)
+	if err != nil {
+		return nil, err
+	}
+	if co.Status != internal.CoDead {
+		return nil, errors.New("function yielded instead of returning")
+	}
+	return r, nil
 }
@@ -1,4 +1,4 @@
-package keys
+package sig
 
 // base(d) on eknkc/basex
 
@@ -0,0 +1,5 @@
+module github.com/Heliodex/coputer/sig
+
+go 1.26.1
+
+require filippo.io/edwards25519 v1.2.0
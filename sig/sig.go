@@ -0,0 +1,56 @@
+package sig
+
+import (
+	"crypto/rand"
+	"crypto/sha3"
+)
+
+// public and secret keys, and signatures made and verified with them
+// only depends on edwards25519, so the execution server can verify signatures without depending on wallflower
+
+// signatures are versioned, so the scheme can change without breaking old ones
+// --- Version [1]
+// --- Signature [64] (XEdDSA, for version 1)
+
+const (
+	// SigXEdDSA is the version of XEdDSA signatures. Version 0 was never sent, as the signatures before were encrypted to a well-known key, and anyone could forge them.
+	SigXEdDSA = 1
+
+	SigLen     = 1 + xeddsaSigLen
+	HashSigLen = SigLen
+)
+
+type Sig [SigLen]byte
+
+// HashSig is a signature of the hash of a message, for messages too large to sign directly.
+type HashSig = Sig
+
+func (sk SK) Sign(msg []byte) (sig Sig) {
+	var z [64]byte
+	rand.Read(z[:])
+
+	sig[0] = SigXEdDSA
+	copy(sig[1:], xeddsaSign(sk, msg, z))
+	return
+}
+
+func (pk PK) Verify(msg []byte, sig Sig) bool {
+	u := [32]byte{}
+	copy(u[3:], pk[:])
+
+	switch sig[0] {
+	case SigXEdDSA:
+		return xeddsaVerify(u, msg, sig[1:])
+	}
+	return false // unknown version
+}
+
+func (sk SK) SignHash(b []byte) HashSig {
+	hash := sha3.Sum256(b)
+	return sk.Sign(hash[:])
+}
+
+func (pk PK) VerifyHash(sig HashSig, b []byte) bool {
+	hash := sha3.Sum256(b)
+	return pk.Verify(hash[:], sig)
+}
@@ -0,0 +1,71 @@
+package sig
+
+import (
+	"crypto/ecdh"
+	"encoding/hex"
+	"testing"
+)
+
+func Assert(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// XEdDSA test vectors, checked against an independent implementation of the spec
+var xeddsaVectors = []struct {
+	k, msg, z, sig string
+}{
+	{ // skf1, zero nonce
+		"43911e12748e5a59b9a2249636762d1c18a5ec9add76eec61629ecc90260f714",
+		"what's up world!",
+		"",
+		"28513fd80c20a13e659bbf4495477bfc65a5d79d82ebf129f9128fec624e3317d1813ad1d12a081cf8e4e17bb9fd3273cf4934192b54936077700e6a9ad3f800",
+	},
+	{ // skf1, nonce 00..3f
+		"43911e12748e5a59b9a2249636762d1c18a5ec9add76eec61629ecc90260f714",
+		"what's up world!",
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f",
+		"3a408addb474621903d32c70f4c92b0a03b1497a8f48845dee0aeec99e8dc7d24575af0e5867da4f623d2149a1c8e0f868ba4881ce2df215bff6fc01e53b5b04",
+	},
+	{ // private key negated, as the Edwards public key's sign bit is 1
+		"010c17222d38434e59646f7a85909ba6b1bcc7d2dde8f3fe09141f2a35404b56",
+		"coputer",
+		"",
+		"19de1e0b9e145e4b8c5896735f5b28337ca034320dcf1c20f407cbd77d5abd68a470d92fb83d4985bfab284dfe74e162bef44684986fd51aab0a21785c3d7f03",
+	},
+	{ // private key not negated
+		"4b56616c77828d98a3aeb9c4cfdae5f0fb06111c27323d48535e69747f8a95a0",
+		"coputer",
+		"",
+		"9c1fc908d7a401f196865c441cad24450dad38eb686da9d654b462c15b9c8ac073ab74aa6dcf795fa756eeb51bf0fa1cceb8bf6941a3a14f674ad596fc03260b",
+	},
+}
+
+func TestXEdDSAVectors(t *testing.T) {
+	for _, v := range xeddsaVectors {
+		kb, err := hex.DecodeString(v.k)
+		Assert(t, err)
+
+		var z [64]byte
+		if v.z != "" {
+			zb, err := hex.DecodeString(v.z)
+			Assert(t, err)
+			z = [64]byte(zb)
+		}
+
+		k := [32]byte(kb)
+		sig := xeddsaSign(k, []byte(v.msg), z)
+		if hex.EncodeToString(sig) != v.sig {
+			t.Fatalf("signature mismatch for key %s: got %x", v.k, sig)
+		}
+
+		esk, err := ecdh.X25519().NewPrivateKey(k[:])
+		Assert(t, err)
+
+		u := [32]byte(esk.PublicKey().Bytes())
+		if !xeddsaVerify(u, []byte(v.msg), sig) {
+			t.Fatal("signature verification failed for key", v.k)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package sig
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+
+	"filippo.io/edwards25519"
+	"filippo.io/edwards25519/field"
+)
+
+// XEdDSA, signing with the curve25519 keys we already have
+// https://signal.org/docs/specifications/xeddsa/
+// Signatures are Ed25519 signatures under the Edwards form of the public key, with its sign bit cleared, so they're verified with crypto/ed25519.
+
+const xeddsaSigLen = 64
+
+// hash1 is prefixed to the hash of the nonce, to separate it from the hash in the signature
+var hash1 = [32]byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// edwardsKeypair converts a curve25519 private key to an Edwards keypair, negating the private key if needed so the public key's sign bit is 0
+func edwardsKeypair(k [32]byte) (A []byte, a *edwards25519.Scalar) {
+	a, _ = edwards25519.NewScalar().SetBytesWithClamping(k[:])
+	A = new(edwards25519.Point).ScalarBaseMult(a).Bytes()
+
+	if A[31]&0x80 != 0 {
+		a.Negate(a)
+		A[31] &= 0x7f
+	}
+	return
+}
+
+// edwardsPK converts a curve25519 public key to the Edwards public key signatures are made with
+func edwardsPK(u [32]byte) (A []byte, ok bool) {
+	fu, err := new(field.Element).SetBytes(u[:])
+	if err != nil || !bytes.Equal(fu.Bytes(), u[:]) { // not reduced
+		return nil, false
+	}
+
+	// y = (u - 1) / (u + 1)
+	one := new(field.Element).One()
+	num := new(field.Element).Subtract(fu, one)
+	den := new(field.Element).Add(fu, one)
+	y := new(field.Element).Multiply(num, den.Invert(den))
+
+	return y.Bytes(), true // sign bit 0
+}
+
+// xeddsaSign signs a message with a curve25519 private key, using 64 random bytes z
+func xeddsaSign(k [32]byte, msg []byte, z [64]byte) []byte {
+	A, a := edwardsKeypair(k)
+
+	h := sha512.New()
+	h.Write(hash1[:])
+	h.Write(a.Bytes())
+	h.Write(msg)
+	h.Write(z[:])
+	r, _ := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+
+	R := new(edwards25519.Point).ScalarBaseMult(r).Bytes()
+
+	h.Reset()
+	h.Write(R)
+	h.Write(A)
+	h.Write(msg)
+	hs, _ := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+
+	s := edwards25519.NewScalar().MultiplyAdd(hs, a, r)
+	return append(R, s.Bytes()...)
+}
+
+// xeddsaVerify verifies a signature of a message with a curve25519 public key
+func xeddsaVerify(u [32]byte, msg, sig []byte) bool {
+	if len(sig) != xeddsaSigLen {
+		return false
+	}
+
+	A, ok := edwardsPK(u)
+	if !ok {
+		return false
+	}
+	return ed25519.Verify(A, msg, sig)
+}
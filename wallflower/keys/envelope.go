@@ -0,0 +1,283 @@
+package keys
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// encrypted messages, version 1
+// Every message has its own ephemeral key, so keys (and nonces) are never reused. If we know the recipient's session key it's used too, for forward secrecy.
+
+// --- Version [1]
+// --- Ephemeral pk [32]
+// --- Recipient session pk [32] (zero if we don't know one)
+// --- Header length [2]
+
+// --- Sender pk [29]
+// --- Address count [1] (alternates only)
+// --- Addresses [16]...
+// --- Sender session [105]
+// encrypted [16] with the header key
+
+// then the chunks
+// --- Actual message [up to 65519 (chunkSize)]
+// encrypted [16] with the payload key [total up to 65535 (chunkEnc)]
+// each chunk's nonce is its index, marked on the last chunk, so chunks can't be reordered, dropped, or cut off
+
+const (
+	envelopeV1  = 1
+	envelopePre = 1 + 32 + 32 + 2
+)
+
+var zeroKey [32]byte
+
+func dh(sk, pk []byte) ([]byte, error) {
+	// errors for low order points
+	return curve25519.X25519(sk, pk)
+}
+
+// staticPK returns the curve25519 public key of a peer
+func staticPK(pk PK) (k [32]byte) {
+	copy(k[3:], pk[:])
+	return
+}
+
+// deriveKey derives a key from shared secrets, bound to everything sent before it
+func deriveKey(info string, salt []byte, secrets ...[]byte) ([]byte, error) {
+	var ikm []byte
+	for _, s := range secrets {
+		ikm = append(ikm, s...)
+	}
+	return hkdf.Key(sha256.New, ikm, salt, info, chacha20poly1305.KeySize)
+}
+
+func chunkNonce(i int, last bool) []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	if last {
+		n[0] = 1
+	}
+	binary.BigEndian.PutUint64(n[4:], uint64(i))
+	return n
+}
+
+// Encrypt encrypts a message to a peer. There's always at least one chunk, even if the message is empty.
+func (p ThisPeer) Encrypt(msg []byte, to Peer) (out []byte, err error) {
+	// Address count [1] (alternates only)
+	addrCount := len(p.AltAddrs)
+	if addrCount > 255 {
+		return nil, errors.New("too many addresses")
+	}
+
+	now := time.Now()
+	var sess Session
+	if p.Sessions != nil {
+		if sess, err = p.Sessions.announce(p.Kp.Sk, now); err != nil {
+			return nil, fmt.Errorf("session: %w", err)
+		}
+	}
+
+	esk := make([]byte, 32)
+	if _, err = rand.Read(esk); err != nil {
+		return
+	}
+	epk, err := curve25519.X25519(esk, curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+
+	rpk := staticPK(to.Pk)
+	es, err := dh(esk, rpk[:])
+	if err != nil {
+		return nil, fmt.Errorf("recipient key: %w", err)
+	}
+
+	var rsess [32]byte
+	var esess []byte
+	if to.Session.Valid(now) {
+		rsess = to.Session.Pk
+		if esess, err = dh(esk, rsess[:]); err != nil {
+			return nil, fmt.Errorf("recipient session key: %w", err)
+		}
+	}
+
+	ss, err := dh(p.Kp.Sk[:], rpk[:])
+	if err != nil {
+		return nil, fmt.Errorf("recipient key: %w", err)
+	}
+
+	header := make([]byte, 0, PKSize+1+AddressLen*(addrCount+1)+sessionLen)
+	header = append(header, p.Kp.Pk[:]...)
+	header = append(header, byte(addrCount))
+	header = append(header, p.MainAddr[:]...) // main address is always first
+	for _, addr := range p.AltAddrs {
+		header = append(header, addr[:]...)
+	}
+	header = append(header, sess.encode()...)
+
+	chunkCount := max(1, (len(msg)+chunkSize-1)/chunkSize)
+	headerEnc := len(header) + chacha20poly1305.Overhead
+
+	out = make([]byte, 0, envelopePre+headerEnc+len(msg)+chunkCount*chacha20poly1305.Overhead)
+	out = append(out, envelopeV1)
+	out = append(out, epk...)
+	out = append(out, rsess[:]...)
+	out = binary.BigEndian.AppendUint16(out, uint16(headerEnc))
+
+	hkey, err := deriveKey("coputer header", out, es, esess)
+	if err != nil {
+		return
+	}
+	haead, err := chacha20poly1305.New(hkey)
+	if err != nil {
+		return
+	}
+	out = haead.Seal(out, chunkNonce(0, false), header, out)
+
+	// the payload key also depends on our static key, so only we could have sent it
+	pkey, err := deriveKey("coputer payload", out, es, esess, ss)
+	if err != nil {
+		return
+	}
+	paead, err := chacha20poly1305.New(pkey)
+	if err != nil {
+		return
+	}
+
+	// chunking time
+	for i := range chunkCount {
+		c := msg[i*chunkSize : min((i+1)*chunkSize, len(msg))]
+		out = paead.Seal(out, chunkNonce(i, i == chunkCount-1), c, nil)
+	}
+
+	return out, nil
+}
+
+// Decrypt decrypts a message sent to us, returning who it's from.
+func (p ThisPeer) Decrypt(emsg []byte) (from Peer, msg []byte, err error) {
+	if len(emsg) > 0 && emsg[0] == envelopeV1 {
+		if from, msg, err = p.decryptV1(emsg); err == nil {
+			return
+		}
+	}
+
+	// old messages can start with any byte, and are accepted until every node sends the new version
+	from, msg, errv0 := decryptV0(p.Kp, emsg)
+	if errv0 == nil {
+		return from, msg, nil
+	}
+	if err == nil {
+		err = errv0
+	}
+	return Peer{}, nil, err
+}
+
+func (p ThisPeer) decryptV1(emsg []byte) (from Peer, msg []byte, err error) {
+	if len(emsg) < envelopePre {
+		return Peer{}, nil, fmt.Errorf("message too short (%d)", len(emsg))
+	}
+
+	pre := emsg[:envelopePre]
+	epk, rsess := pre[1:33], [32]byte(pre[33:65])
+	headerEnc := int(binary.BigEndian.Uint16(pre[65:]))
+	if len(emsg) < envelopePre+headerEnc {
+		return Peer{}, nil, fmt.Errorf("message too short (%d)", len(emsg))
+	}
+	encryptedHeader, ct := emsg[envelopePre:envelopePre+headerEnc], emsg[envelopePre+headerEnc:]
+
+	now := time.Now()
+	es, err := dh(p.Kp.Sk[:], epk)
+	if err != nil {
+		return Peer{}, nil, fmt.Errorf("ephemeral key: %w", err)
+	}
+
+	var esess []byte
+	if rsess != zeroKey {
+		if p.Sessions == nil {
+			return Peer{}, nil, errors.New("unknown or expired session")
+		}
+		ssk, ok := p.Sessions.find(rsess, now)
+		if !ok {
+			return Peer{}, nil, errors.New("unknown or expired session")
+		}
+		if esess, err = dh(ssk[:], epk); err != nil {
+			return Peer{}, nil, fmt.Errorf("ephemeral key: %w", err)
+		}
+	}
+
+	hkey, err := deriveKey("coputer header", pre, es, esess)
+	if err != nil {
+		return
+	}
+	haead, err := chacha20poly1305.New(hkey)
+	if err != nil {
+		return
+	}
+	header, err := haead.Open(nil, chunkNonce(0, false), encryptedHeader, pre)
+	if err != nil {
+		return Peer{}, nil, errors.New("header decryption failed")
+	}
+
+	// Sender pk [29] + Address count [1]
+	if len(header) < PKSize+1 {
+		return Peer{}, nil, errors.New("header too short")
+	}
+	from.Pk = PK(header[:PKSize])
+	addrsSize := AddressLen * (int(header[PKSize]) + 1)
+	if len(header) != PKSize+1+addrsSize+sessionLen {
+		return Peer{}, nil, errors.New("header has wrong length")
+	}
+
+	// Addresses [16]...
+	addrs := header[PKSize+1:][:addrsSize]
+	from.MainAddr = Address(addrs[:AddressLen])
+	for a := range len(addrs)/AddressLen - 1 {
+		from.AltAddrs = append(from.AltAddrs, Address(addrs[(a+1)*AddressLen:][:AddressLen]))
+	}
+
+	if sess := decodeSession(header[PKSize+1+addrsSize:]); sess.Pk != zeroKey {
+		if !from.Pk.Verify(SessionMessage(sess.Pk, sess.Expires), sess.Sig) {
+			return Peer{}, nil, errors.New("invalid session signature")
+		}
+		from.Session = sess
+	}
+
+	spk := staticPK(from.Pk)
+	ss, err := dh(p.Kp.Sk[:], spk[:])
+	if err != nil {
+		return Peer{}, nil, fmt.Errorf("sender key: %w", err)
+	}
+
+	pkey, err := deriveKey("coputer payload", emsg[:envelopePre+headerEnc], es, esess, ss)
+	if err != nil {
+		return
+	}
+	paead, err := chacha20poly1305.New(pkey)
+	if err != nil {
+		return
+	}
+
+	// chunking time
+	if len(ct) == 0 {
+		return Peer{}, nil, errors.New("no chunks found")
+	}
+	msg = make([]byte, 0, len(ct))
+	for i := 0; len(ct) > 0; i++ {
+		clen := min(chunkEnc, len(ct))
+		var chunk []byte
+		chunk, ct = ct[:clen], ct[clen:]
+
+		if msg, err = paead.Open(msg, chunkNonce(i, len(ct) == 0), chunk, nil); err != nil {
+			return Peer{}, nil, errors.New("chunk decryption failed")
+		}
+	}
+
+	return
+}
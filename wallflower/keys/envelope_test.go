@@ -0,0 +1,164 @@
+package keys
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+const skf2 = "cosec:0aqouiilz3-ynmmxunwx1-7u6e5xppqa-hmz7q8yd3f-5l92e17yos"
+
+func testPeer(t *testing.T, skf string, addr byte) ThisPeer {
+	kp := testKeypair(t, skf)
+	p := Peer{Pk: kp.Pk, MainAddr: Address{15: addr}, AltAddrs: []Address{{0: addr}}}
+	return ThisPeer{Peer: p, Kp: kp, Sessions: &Sessions{}}
+}
+
+// encryptV0 encrypts a message the way nodes did before version 1
+func encryptV0(p ThisPeer, msg []byte, to PK) (out []byte) {
+	pk := staticPK(to)
+	sk := [32]byte(p.Kp.Sk)
+
+	key := append(p.Kp.Pk[:], byte(len(p.AltAddrs)))
+	out, _ = box.SealAnonymous(nil, key, &pk, nil)
+
+	addrs := p.MainAddr[:]
+	for _, addr := range p.AltAddrs {
+		addrs = append(addrs, addr[:]...)
+	}
+	out = append(out, box.Seal(nil, addrs, zeroNonce, &pk, &sk)...)
+
+	for i := 0; i < len(msg); i += chunkSize {
+		out = append(out, box.Seal(nil, msg[i:min(i+chunkSize, len(msg))], zeroNonce, &pk, &sk)...)
+	}
+	return
+}
+
+func TestEnvelope(t *testing.T) {
+	a, b := testPeer(t, skf1, 1), testPeer(t, skf2, 2)
+
+	check := func(ct, msg []byte) Peer {
+		t.Helper()
+		from, dec, err := b.Decrypt(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dec, msg) {
+			t.Fatal("message not equal")
+		}
+		if !from.Equals(a.Peer) {
+			t.Fatal("sender not equal", from)
+		}
+		return from
+	}
+
+	msg := []byte("hello world")
+	ct1, err := a.Encrypt(msg, b.Peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := check(ct1, msg)
+	if !from.Session.Valid(time.Now()) {
+		t.Fatal("expected sender's session")
+	}
+
+	// same message, different ciphertext
+	ct2, err := a.Encrypt(msg, b.Peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(ct1, ct2) {
+		t.Fatal("ciphertexts should differ")
+	}
+
+	// b replies to a's session
+	reply, err := b.Encrypt(msg, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Decrypt(reply); err != nil {
+		t.Fatal(err)
+	}
+
+	// once a's session is forgotten, the reply can't be decrypted
+	a.Sessions = &Sessions{}
+	if _, _, err := a.Decrypt(reply); err == nil {
+		t.Fatal("expected forgotten session to fail")
+	}
+
+	for _, msg := range [][]byte{{}, bytes.Repeat([]byte("abc"), chunkSize)} {
+		ct, err := a.Encrypt(msg, b.Peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(ct, msg)
+	}
+
+	// old messages still decrypt
+	check(encryptV0(a, msg, b.Pk), msg)
+
+	// not to us
+	if _, _, err := a.Decrypt(ct1); err == nil {
+		t.Fatal("expected wrong recipient to fail")
+	}
+}
+
+func TestEnvelopeChunks(t *testing.T) {
+	a, b := testPeer(t, skf1, 1), testPeer(t, skf2, 2)
+
+	msg := bytes.Repeat([]byte{1, 2, 3}, chunkSize) // 3 chunks
+	ct, err := a.Encrypt(msg, b.Peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := len(ct) - 2*chunkEnc - (len(msg) - 2*chunkSize + 16)
+
+	swapped := bytes.Clone(ct[:chunks])
+	swapped = append(swapped, ct[chunks+chunkEnc:][:chunkEnc]...)
+	swapped = append(swapped, ct[chunks:][:chunkEnc]...)
+	swapped = append(swapped, ct[chunks+2*chunkEnc:]...)
+
+	for name, bad := range map[string][]byte{
+		"truncated": ct[:chunks+2*chunkEnc],
+		"cut":       ct[:len(ct)-1],
+		"reordered": swapped,
+		"no chunks": ct[:chunks],
+		"extended":  append(bytes.Clone(ct), ct[chunks:][:chunkEnc]...),
+	} {
+		if _, _, err := b.Decrypt(bad); err == nil {
+			t.Fatal("expected", name, "message to fail")
+		}
+	}
+
+	if _, dec, err := b.Decrypt(ct); err != nil || !bytes.Equal(dec, msg) {
+		t.Fatal("message should still decrypt", err)
+	}
+}
+
+func TestSessionsForget(t *testing.T) {
+	sk := testKeypair(t, skf1).Sk
+	s, now := &Sessions{}, time.Now()
+
+	first, err := s.announce(sk, now)
+	Assert(t, err)
+
+	second, err := s.announce(sk, now.Add(sessionRotate))
+	Assert(t, err)
+	if second.Pk == first.Pk || s.previous.Pk != first.Pk {
+		t.Fatal("expected session to rotate")
+	}
+
+	// the first session's key is zeroed once it expires, even when looking for another
+	if _, ok := s.find(second.Pk, now.Add(SessionLifetime)); !ok {
+		t.Fatal("expected current session")
+	}
+	if s.previous != (sessionKey{}) {
+		t.Fatal("expected expired session to be forgotten")
+	}
+
+	if _, ok := s.find([32]byte{}, now); ok {
+		t.Fatal("found empty session")
+	}
+}
@@ -3,7 +3,6 @@ package keys
 import (
 	"bytes"
 	"crypto/rand"
-	"crypto/sha3"
 	"errors"
 	"fmt"
 	"net"
@@ -31,11 +30,14 @@ type Peer struct {
 	MainAddr Address
 	AltAddrs []Address
 	LastSeen time.Time
+	Session  Session // latest session they've announced
+	Find     string  // their signed find string, if we have it, so they can be shared with other peers
 }
 
 type ThisPeer struct {
 	Peer
-	Kp Keypair
+	Kp       Keypair
+	Sessions *Sessions
 }
 
 func (p Peer) Equals(p2 Peer) bool {
@@ -88,9 +90,9 @@ func KeypairSK(sk [32]byte) (kp Keypair, err error) {
 	return keypair(*pk, sk)
 }
 
-// Who needs nonces anyway? Every request is idempotent becaue every computation is deterministic.
-// Exactly-once delivery 4 tha win
-var ZeroNonce = new([24]byte)
+// encrypted messages, version 0
+// Everything was encrypted with the same nonce, so these are only decrypted while nodes are updated to send version 1.
+var zeroNonce = new([24]byte)
 
 const (
 	keySize   = 29 + 1
@@ -99,8 +101,6 @@ const (
 	chunkSize = chunkEnc - box.Overhead
 )
 
-// We could do real anonymous messages someday but having keys for every message at the moment is valuable
-
 // --- Sender pk [29]
 // --- Address count [1]
 // anonymously encrypted [48] with recipient pk [total 78]
@@ -112,76 +112,6 @@ const (
 // --- Actual message [up to 65519 (chunkSize)]
 // encrypted [16] with recipient pk [total up to 65535 (chunkEnc)]
 
-func encryptKey(p ThisPeer, pk *[32]byte) ([]byte, error) {
-	c := make([]byte, keySize)
-
-	// Sender pk [29] + Address count [1]
-	copy(c, p.Kp.Pk[:])
-	c[len(c)-1] = byte(len(p.AltAddrs))
-
-	// anonymously encrypted [48] with recipient pk
-	return box.SealAnonymous(nil, c, pk, nil)
-}
-
-func encryptAddresses(p ThisPeer, pk *[32]byte, sk [32]byte) []byte {
-	c := p.MainAddr[:] // main address is always first
-
-	// Addresses [16]...
-	for _, addr := range p.AltAddrs {
-		c = append(c, addr[:]...)
-	}
-
-	// encrypted [16] with recipient pk
-	return box.Seal(nil, c, ZeroNonce, pk, &sk)
-}
-
-// chunks are chunked because not having to hold the whole thing in memory at the same time (?)
-// we cold do larger chunks but messages larger than 64k will probably be rare (apart from file transfers? large responses? I'll get to tis when I do gateway implementation soon)
-func (p ThisPeer) Encrypt(msg []byte, to PK) (out []byte, err error) {
-	pk := new([32]byte)
-	copy(pk[3:], to[:])
-	sk := [32]byte(p.Kp.Sk)
-
-	// Address count [1] (alternates only)
-	addrCount := len(p.AltAddrs)
-	if addrCount > 255 {
-		return nil, errors.New("too many addresses")
-	}
-
-	addrsSize := AddressLen * addrCount
-	addrsEnc := addrsSize + box.Overhead
-
-	l := len(msg)
-
-	chunkCount := l / chunkSize
-	if l%chunkSize != 0 {
-		chunkCount++
-	}
-	chunksEnc := l + chunkCount*box.Overhead
-
-	out = make([]byte, 0, keyEnc+addrsEnc+chunksEnc)
-
-	// encryption
-	enc, err := encryptKey(p, pk)
-	if err != nil {
-		return nil, err
-	}
-	out = append(out, enc...)
-	out = append(out, encryptAddresses(p, pk, sk)...)
-
-	// chunking time
-	for i := range chunkCount {
-		c := msg[i*chunkSize : min((i+1)*chunkSize, l)]
-
-		enc := box.Seal(nil, c, ZeroNonce, pk, &sk)
-
-		// add it to the message
-		out = append(out, enc...)
-	}
-
-	return out, nil
-}
-
 func decryptKey(encryptedKey []byte, pk *[32]byte, sk [32]byte) (peerpk PK, addrcount int, ok bool) {
 	// anonymously encrypted [48] with recipient pk
 	dec, ok := box.OpenAnonymous(nil, encryptedKey, pk, &sk)
@@ -194,7 +124,7 @@ func decryptKey(encryptedKey []byte, pk *[32]byte, sk [32]byte) (peerpk PK, addr
 
 func decryptAddrs(encryptedAddrs []byte, peerpk *[32]byte, sk [32]byte) (addrs []Address, ok bool) {
 	// encrypted [16] with recipient pk
-	dec, ok := box.Open(nil, encryptedAddrs, ZeroNonce, peerpk, &sk)
+	dec, ok := box.Open(nil, encryptedAddrs, zeroNonce, peerpk, &sk)
 	if !ok || len(dec)%AddressLen != 0 {
 		return
 	}
@@ -207,8 +137,7 @@ func decryptAddrs(encryptedAddrs []byte, peerpk *[32]byte, sk [32]byte) (addrs [
 	return addrs, true
 }
 
-// todo: version cyphertexts
-func Decrypt(kp Keypair, emsg []byte) (from Peer, msg []byte, err error) {
+func decryptV0(kp Keypair, emsg []byte) (from Peer, msg []byte, err error) {
 	pk := new([32]byte)
 	copy(pk[3:], kp.Pk[:])
 	sk := [32]byte(kp.Sk)
@@ -257,7 +186,7 @@ func Decrypt(kp Keypair, emsg []byte) (from Peer, msg []byte, err error) {
 	for len(ct) > 0 {
 		clen := min(chunkEnc, len(ct)) // we don't actually need to know the chunk size
 		chunk, ct = ct[:clen], ct[clen:]
-		dec, ok := box.Open(nil, chunk, ZeroNonce, peerpk, &sk)
+		dec, ok := box.Open(nil, chunk, zeroNonce, peerpk, &sk)
 
 		if !ok {
 			return Peer{}, nil, errors.New("chunk decryption failed")
@@ -268,51 +197,3 @@ func Decrypt(kp Keypair, emsg []byte) (from Peer, msg []byte, err error) {
 
 	return
 }
-
-// fake signatures with encryption
-// because at the moment, signing with ed25519 with key conversion from curve25519 is a pain, converting from existing curve25519 keys to ed25519 is even worse, and while using ristretto255 for everything would be nice, that would require me rolling my own everything which would actually be not nice, and also I'm pissy that I'd have to use 64-byte private keys with edwards curves
-// this would kill any competent cryptographer from a mile away lmao
-
-const (
-	SignOverhead = box.Overhead
-	HashSigLen   = 32 + box.Overhead
-)
-
-type HashSig [HashSigLen]byte
-
-func (sk SK) Sign(msg []byte) (sig []byte) {
-	skb := new([32]byte)
-	copy(skb[:], sk[:])
-
-	// encrypt to a pk everyone knows with our sk
-	return box.Seal(nil, msg, ZeroNonce, ZeroPK, skb)
-}
-
-func (pk PK) Verify(sig []byte) (msg []byte, ok bool) {
-	pkb := new([32]byte)
-	copy(pkb[3:], pk[:])
-
-	// decrypt with a sk everyone knows and their pk
-	return box.Open(nil, sig, ZeroNonce, pkb, ZeroSK)
-}
-
-func (sk SK) SignHash(b []byte) (sig HashSig) {
-	skb := new([32]byte)
-	copy(skb[:], sk[:])
-
-	hash := sha3.Sum256(b)
-	return HashSig(sk.Sign(hash[:]))
-}
-
-func (pk PK) VerifyHash(sig HashSig, b []byte) (ok bool) {
-	pkb := new([32]byte)
-	copy(pkb[3:], pk[:])
-
-	msg, ok := pk.Verify(sig[:])
-	if !ok {
-		return
-	}
-
-	hash := sha3.Sum256(b)
-	return bytes.Equal(msg, hash[:])
-}
@@ -1,9 +1,6 @@
 package keys
 
-import (
-	"fmt"
-	"testing"
-)
+import "testing"
 
 // not actually a good test
 // func TestKeys(t *testing.T) {
@@ -78,16 +75,36 @@ func TestSign(t *testing.T) {
 	message := []byte("what's up world!")
 
 	sig := kp1.Sk.Sign(message)
+	if sig[0] != SigXEdDSA {
+		t.Fatal("signature version mismatch")
+	}
+	if !kp1.Pk.Verify(message, sig) {
+		t.Fatal("signature verification failed")
+	}
+
+	// signatures are randomised, but both verify
+	if sig2 := kp1.Sk.Sign(message); sig2 == sig || !kp1.Pk.Verify(message, sig2) {
+		t.Fatal("second signature mismatch")
+	}
 
-	fmt.Println(len(sig), len(message))
-	if len(sig) != len(message)+16 { // hey wouldya look at that, 16 bytes of overhead, i'm a genuis
-		t.Fatal("signature length mismatch")
+	if kp1.Pk.Verify([]byte("what's up world?"), sig) {
+		t.Fatal("signature verified for a different message")
 	}
 
-	ver, ok := kp1.Pk.Verify(sig)
-	fmt.Println(string(ver))
+	var pk2 PK
+	copy(pk2[:], kp1.Pk[:])
+	pk2[0] ^= 1
+	if pk2.Verify(message, sig) {
+		t.Fatal("signature verified for a different public key")
+	}
 
-	if !ok {
-		t.Fatal("signature verification failed")
+	bad := sig
+	bad[0] = 0 // the old fake signatures
+	if kp1.Pk.Verify(message, bad) {
+		t.Fatal("signature verified with an unknown version")
+	}
+
+	if !kp1.Pk.VerifyHash(kp1.Sk.SignHash(message), message) {
+		t.Fatal("hash signature verification failed")
 	}
 }
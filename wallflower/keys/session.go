@@ -0,0 +1,124 @@
+package keys
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// session keys, for forward secrecy
+// Each node has a short-lived session keypair, which it announces (signed with its static key) in every message it sends. Peers encrypt to the session key as well as the static key, and the session's private key is forgotten once it expires, so recorded messages can't be decrypted even if the static key leaks later.
+
+const (
+	SessionLifetime = time.Hour
+	// sessions are replaced half way through their lifetime, so peers that learned the previous one can still use it
+	sessionRotate = SessionLifetime / 2
+	sessionLen    = 32 + 8 + SigLen
+)
+
+// Session is a session public key, as announced by a peer.
+type Session struct {
+	Pk      [32]byte
+	Expires int64 // unix seconds
+	Sig     Sig
+}
+
+// SessionMessage returns what's signed for a session key.
+func SessionMessage(pk [32]byte, expires int64) []byte {
+	b := append([]byte("coputer session\x00"), pk[:]...)
+	return binary.BigEndian.AppendUint64(b, uint64(expires))
+}
+
+// Valid reports whether the session can still be encrypted to.
+func (s Session) Valid(now time.Time) bool {
+	return s.Pk != [32]byte{} && now.Unix() < s.Expires
+}
+
+// --- Session pk [32]
+// --- Expiry [8]
+// --- Signature [65]
+// all zero if there's no session
+func (s Session) encode() []byte {
+	b := append(make([]byte, 0, sessionLen), s.Pk[:]...)
+	b = binary.BigEndian.AppendUint64(b, uint64(s.Expires))
+	return append(b, s.Sig[:]...)
+}
+
+func decodeSession(b []byte) (s Session) {
+	s.Pk = [32]byte(b[:32])
+	s.Expires = int64(binary.BigEndian.Uint64(b[32:40]))
+	s.Sig = Sig(b[40:sessionLen])
+	return
+}
+
+type sessionKey struct {
+	Session
+	sk [32]byte
+}
+
+func newSessionKey(sk SK, now time.Time) (s sessionKey, err error) {
+	if _, err = rand.Read(s.sk[:]); err != nil {
+		return
+	}
+
+	pk, err := curve25519.X25519(s.sk[:], curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+
+	s.Pk = [32]byte(pk)
+	s.Expires = now.Add(SessionLifetime).Unix()
+	s.Sig = sk.Sign(SessionMessage(s.Pk, s.Expires))
+	return
+}
+
+// Sessions holds our current session keypair, and the one before it. The zero value is ready to use.
+type Sessions struct {
+	mu                sync.Mutex
+	current, previous sessionKey
+}
+
+// forget zeroes the private keys of sessions that have expired, so they're gone as soon as we notice, not only once they're replaced
+func (s *Sessions) forget(now time.Time) {
+	for _, k := range [...]*sessionKey{&s.current, &s.previous} {
+		if k.Pk != [32]byte{} && !k.Valid(now) {
+			*k = sessionKey{}
+		}
+	}
+}
+
+// announce returns the session to send to peers, starting a new one if it's due
+func (s *Sessions) announce(sk SK, now time.Time) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.forget(now)
+	if s.current.Pk == [32]byte{} || now.Unix() >= s.current.Expires-int64(sessionRotate/time.Second) {
+		next, err := newSessionKey(sk, now)
+		if err != nil {
+			return Session{}, err
+		}
+		s.previous, s.current = s.current, next
+	}
+	return s.current.Session, nil
+}
+
+// find returns the private key of one of our sessions, if it hasn't expired
+func (s *Sessions) find(pk [32]byte, now time.Time) (sk [32]byte, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.forget(now)
+	if pk == [32]byte{} {
+		return
+	}
+	for _, k := range [...]*sessionKey{&s.current, &s.previous} {
+		if k.Pk == pk {
+			return k.sk, true
+		}
+	}
+	return
+}
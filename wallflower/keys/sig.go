@@ -0,0 +1,34 @@
+package keys
+
+import "github.com/Heliodex/coputer/sig"
+
+// keys and signatures are in sig, so the execution server can verify them without depending on wallflower
+
+type (
+	PK      = sig.PK
+	SK      = sig.SK
+	KeyType = sig.KeyType
+	Sig     = sig.Sig
+	HashSig = sig.HashSig
+)
+
+const (
+	PKSize   = sig.PKSize
+	SKSize   = sig.SKSize
+	PubStart = sig.PubStart
+	SecStart = sig.SecStart
+
+	Public = sig.Public
+	Secret = sig.Secret
+
+	SigXEdDSA  = sig.SigXEdDSA
+	SigLen     = sig.SigLen
+	HashSigLen = sig.HashSigLen
+)
+
+var (
+	DecodePK         = sig.DecodePK
+	DecodePKNoPrefix = sig.DecodePKNoPrefix
+	DecodeSK         = sig.DecodeSK
+	DecodeSKNoPrefix = sig.DecodeSKNoPrefix
+)
@@ -1,31 +1,57 @@
 package keys
 
 import (
-	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/pem"
+	"encoding/asn1"
+	"errors"
 	"fmt"
 	"math/big"
 	"net"
+	"sync"
 	"time"
 )
 
-func (sk SK) TLS() (cert tls.Certificate, err error) {
-	// fuck the secret key, as long as it's d e t e r m i n i s t i c
-	skr := bytes.NewReader(append(sk[:], sk[:]...)) // long enough lmaoooo
+// TLS certificates, bound to wallflower keys
+// Our keys can't sign certificates, so each certificate has its own ECDSA key, and an extension with our public key and a signature of the certificate's key. Peers check the extension instead of a chain, and the handshake proves the certificate's key is held by whoever sent it.
 
-	esk, err := ecdsa.GenerateKey(elliptic.P384(), skr)
+const (
+	tlsLifetime = 24 * time.Hour
+	// certificates are replaced with this much time left
+	tlsRenew = time.Hour
+)
+
+// not registered, but only we look for it
+var tlsExtension = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 60047, 1}
+
+// tlsMessage returns what's signed for a certificate's key
+func tlsMessage(spki []byte) []byte {
+	return append([]byte("coputer tls\x00"), spki...)
+}
+
+// TLS makes a certificate with a new key, bound to our public key.
+func (kp Keypair) TLS() (cert tls.Certificate, err error) {
+	esk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("generate ECDSA key: %v", err)
 	}
 
+	spki, err := x509.MarshalPKIXPublicKey(&esk.PublicKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("marshal ECDSA public key: %v", err)
+	}
+
+	// --- Public key [29]
+	// --- Signature [65]
+	sig := kp.Sk.Sign(tlsMessage(spki))
+	ext := append(kp.Pk[:], sig[:]...)
+
 	notBefore := time.Now()
-	notAfter := notBefore.Add(24 * time.Hour) // 1 day validity
+	notAfter := notBefore.Add(tlsLifetime)
 
 	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
@@ -36,12 +62,14 @@ func (sk SK) TLS() (cert tls.Certificate, err error) {
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			Organization: []string{"wallflower"},
+			CommonName:   kp.Pk.Encode(),
 		},
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
+		ExtraExtensions:       []pkix.Extension{{Id: tlsExtension, Value: ext}},
 
 		IPAddresses: []net.IP{net.IPv6loopback},
 	}
@@ -51,16 +79,107 @@ func (sk SK) TLS() (cert tls.Certificate, err error) {
 		return tls.Certificate{}, fmt.Errorf("create X.509 certificate: %v", err)
 	}
 
-	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  esk,
+	}, nil
+}
+
+// VerifyTLS checks a peer's certificate is bound to a wallflower key, and returns the key.
+func VerifyTLS(rawCerts [][]byte) (pk PK, err error) {
+	if len(rawCerts) != 1 {
+		return PK{}, errors.New("expected one certificate")
+	}
+
+	c, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return PK{}, fmt.Errorf("parse certificate: %w", err)
+	}
+
+	if now := time.Now(); now.Before(c.NotBefore) || now.After(c.NotAfter) {
+		return PK{}, errors.New("certificate has expired or is not yet valid")
+	}
+
+	for _, e := range c.Extensions {
+		if !e.Id.Equal(tlsExtension) {
+			continue
+		}
+		if len(e.Value) != PKSize+SigLen {
+			return PK{}, errors.New("invalid key extension length")
+		}
+
+		pk, sig := PK(e.Value[:PKSize]), Sig(e.Value[PKSize:])
+		if !pk.Verify(tlsMessage(c.RawSubjectPublicKeyInfo), sig) {
+			return PK{}, errors.New("invalid key extension signature")
+		}
+		return pk, nil
+	}
+	return PK{}, errors.New("certificate isn't bound to a key")
+}
+
+type tlsCerts struct {
+	mu   sync.Mutex
+	kp   Keypair
+	cert *tls.Certificate
+	exp  time.Time
+}
+
+// get returns our certificate, replacing it if it's close to expiring
+func (c *tlsCerts) get() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cert != nil && time.Until(c.exp) > tlsRenew {
+		return c.cert, nil
+	}
 
-	skBytes, err := x509.MarshalECPrivateKey(esk)
+	cert, err := c.kp.TLS()
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("marshal ECDSA private key: %v", err)
+		return nil, err
 	}
-	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: skBytes})
+	c.cert, c.exp = &cert, time.Now().Add(tlsLifetime)
+	return c.cert, nil
+}
+
+// TLSConfig returns a config where both sides of a connection present certificates bound to their keys. Any key is accepted; use TLSConfigFor to only accept a particular peer.
+func (kp Keypair) TLSConfig() (*tls.Config, error) {
+	certs := &tlsCerts{kp: kp}
+	if _, err := certs.get(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certs.get()
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certs.get()
+		},
+		ClientAuth: tls.RequireAnyClientCert,
+		MinVersion: tls.VersionTLS13,
+		// there's no chain to verify, only the binding to a key
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, err := VerifyTLS(rawCerts)
+			return err
+		},
+		// resumed connections aren't verified again
+		SessionTicketsDisabled: true,
+	}, nil
+}
 
-	if cert, err = tls.X509KeyPair(certPem, keyPem); err != nil {
-		return tls.Certificate{}, fmt.Errorf("create TLS certificate: %v", err)
+// TLSConfigFor returns a config for connecting to a peer, which fails unless the peer's certificate is bound to its key.
+func TLSConfigFor(conf *tls.Config, pk PK) *tls.Config {
+	c := conf.Clone()
+	c.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		got, err := VerifyTLS(rawCerts)
+		if err != nil {
+			return err
+		}
+		if got != pk {
+			return fmt.Errorf("expected peer %s, got %s", pk.Encode(), got.Encode())
+		}
+		return nil
 	}
-	return
+	return c
 }
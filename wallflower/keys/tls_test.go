@@ -0,0 +1,137 @@
+package keys
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func testKeypair(t *testing.T, skf string) Keypair {
+	sk, err := DecodeSK(skf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp, err := KeypairSK(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kp
+}
+
+// handshake connects a client to a server, returning both sides' errors and the key the server saw
+func handshake(t *testing.T, client, server *tls.Config) (cerr, serr error, pk PK) {
+	cc, sc := net.Pipe()
+	defer cc.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer sc.Close()
+
+		s := tls.Server(sc, server)
+		if serr = s.Handshake(); serr != nil {
+			return
+		}
+		pk, serr = VerifyTLS([][]byte{s.ConnectionState().PeerCertificates[0].Raw})
+		s.Write([]byte{0}) // the client's handshake finishes after ours
+	}()
+
+	c := tls.Client(cc, client)
+	if cerr = c.Handshake(); cerr == nil {
+		_, cerr = c.Read(make([]byte, 1))
+	}
+	cc.Close()
+	<-done
+	return
+}
+
+func TestTLS(t *testing.T) {
+	kp1, kp2 := testKeypair(t, skf1), testKeypair(t, skf2)
+
+	conf1, err := kp1.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf2, err := kp2.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both sides know who they're talking to
+	cerr, serr, pk := handshake(t, TLSConfigFor(conf2, kp1.Pk), conf1)
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+	if pk != kp2.Pk {
+		t.Fatal("server saw the wrong key", pk.Encode())
+	}
+
+	// dialling an address that turns out to have someone else's key
+	if cerr, _, _ = handshake(t, TLSConfigFor(conf2, kp2.Pk), conf1); cerr == nil {
+		t.Fatal("expected connection to the wrong peer to fail")
+	}
+
+	// certificates not bound to a key aren't accepted by either side
+	plain := &tls.Config{
+		Certificates:       []tls.Certificate{selfSigned(t, nil)},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+	}
+	if _, serr, _ = handshake(t, plain, conf1); serr == nil {
+		t.Fatal("expected client without a bound certificate to fail")
+	}
+	if cerr, _, _ = handshake(t, TLSConfigFor(conf2, kp1.Pk), plain); cerr == nil {
+		t.Fatal("expected server without a bound certificate to fail")
+	}
+
+	// a binding can't be moved to another certificate
+	cert, err := kp1.TLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = VerifyTLS(cert.Certificate); err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range c.Extensions {
+		if e.Id.Equal(tlsExtension) {
+			moved := selfSigned(t, &e)
+			if _, err = VerifyTLS(moved.Certificate); err == nil {
+				t.Fatal("expected moved binding to fail")
+			}
+		}
+	}
+}
+
+// selfSigned makes a certificate with its own key, and maybe an extension
+func selfSigned(t *testing.T, ext *pkix.Extension) tls.Certificate {
+	esk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if ext != nil {
+		template.ExtraExtensions = []pkix.Extension{*ext}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &esk.PublicKey, esk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: esk}
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
-	"crypto/tls"
+	"cmp"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,6 +36,71 @@ const (
 	PortManagement
 )
 
+// runError sends an error from running a program, passing on its class
+func runError(w http.ResponseWriter, kind string, err error) {
+	c := ErrorClassOf(err)
+	w.Header().Set(ErrorClassHeader, c.String())
+	http.Error(w, fmt.Sprintf("Failed to run %s program: %v", kind, err), c.Status())
+}
+
+// requestQuorum returns the quorum a request asks for, if any
+func requestQuorum(r *http.Request) (q Quorum, err error) {
+	if s := r.Header.Get(QuorumHeader); s != "" {
+		return ParseQuorum(s)
+	}
+	return
+}
+
+// serveRun decodes program args from a request, and runs the program with them
+func serveRun[A ProgramArgs, R ProgramRets](kind string, run func(keys.PK, string, A, bool, Quorum, CallChain) (R, net.QuorumReport, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pks, name := r.PathValue("pk"), r.PathValue("name")
+		pk, err := keys.DecodePKNoPrefix(pks)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode public key: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		q, err := requestQuorum(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid quorum: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		// programs calling other programs send what's running, so calls across nodes can't go round in cycles
+		call, err := CallChainFromHeaders(r.Header)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid call chain: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		bodybytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		args, err := DecodeArgs[A](bodybytes)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		rets, rep, err := run(pk, name, args, true, q, call)
+		if rep.Quorum.Enabled() {
+			w.Header().Set(QuorumResultHeader, rep.Result())
+		}
+		if err != nil {
+			runError(w, kind, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(rets.Encode())
+	}
+}
+
 func gatewayServer(n *net.Node) {
 	mux := http.NewServeMux()
 
@@ -59,14 +128,23 @@ func gatewayServer(n *net.Node) {
 		}
 	})
 
-	mux.HandleFunc("POST /web/{pk}/{name}", func(w http.ResponseWriter, r *http.Request) {
-		pks, name := r.PathValue("pk"), r.PathValue("name")
-		pk, err := keys.DecodePKNoPrefix(pks)
+	mux.HandleFunc("POST /web/{pk}/{name}", serveRun("web", n.RunWebProgramQuorum))
+	mux.HandleFunc("POST /library/{pk}/{name}", serveRun("library", n.RunLibraryProgramQuorum))
+
+	// web programs, with the body sent as it's written
+	mux.HandleFunc("POST /webstream/{pk}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		pk, err := keys.DecodePKNoPrefix(r.PathValue("pk"))
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to decode public key: %v", err), http.StatusBadRequest)
 			return
 		}
 
+		q, err := requestQuorum(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid quorum: %v", err), http.StatusBadRequest)
+			return
+		}
+
 		bodybytes, err := io.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusBadRequest)
@@ -79,22 +157,189 @@ func gatewayServer(n *net.Node) {
 			return
 		}
 
-		rets, err := n.RunWebProgram(pk, name, args, true)
+		if err = n.StreamWebProgram(w, pk, r.PathValue("name"), args, q); err != nil {
+			runError(w, "web", err)
+		}
+	})
+
+	// results of scheduled programs, as ticks
+	mux.HandleFunc("GET /scheduled/{pk}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		pk, err := keys.DecodePKNoPrefix(r.PathValue("pk"))
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to run web program: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to decode public key: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		results := n.ScheduledResults(pk, r.PathValue("name"))
+		if len(results) == 0 {
+			http.Error(w, "No scheduled results found", http.StatusNotFound)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		w.Write(rets.Encode())
+		for _, res := range results {
+			fmt.Fprintln(w, res.Tick)
+		}
+	})
+
+	// a result of a scheduled program, at a tick or the latest
+	mux.HandleFunc("GET /scheduled/{pk}/{name}/{tick}", func(w http.ResponseWriter, r *http.Request) {
+		pk, err := keys.DecodePKNoPrefix(r.PathValue("pk"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode public key: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		results := n.ScheduledResults(pk, r.PathValue("name"))
+		if len(results) == 0 {
+			http.Error(w, "No scheduled results found", http.StatusNotFound)
+			return
+		}
+
+		res := results[len(results)-1]
+		if ticks := r.PathValue("tick"); ticks != "latest" {
+			tick, err := strconv.ParseInt(ticks, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid tick", http.StatusBadRequest)
+				return
+			}
+
+			i := slices.IndexFunc(results, func(res net.ScheduledResult) bool { return res.Tick == tick })
+			if i == -1 {
+				http.Error(w, "No scheduled result for tick", http.StatusNotFound)
+				return
+			}
+			res = results[i]
+		}
+
+		w.Header().Set("Coputer-Tick", strconv.FormatInt(res.Tick, 10))
+		w.Header().Set("Coputer-Ran-By", res.From.Encode())
+		w.WriteHeader(http.StatusOK)
+		w.Write(res.Rets.Body)
 	})
 
 	fmt.Println("Listening for gateway on port", PortGateway)
 	http.ListenAndServe(fmt.Sprintf(":%d", PortGateway), mux)
 }
 
-func managementServer() {}
+func managementServer(n *net.Node) {
+	mux := http.NewServeMux()
+
+	// scheduled programs, with their schedule and latest tick
+	mux.HandleFunc("GET /scheduled", func(w http.ResponseWriter, r *http.Request) {
+		programs := n.ScheduledPrograms()
+		names := slices.SortedFunc(maps.Keys(programs), func(a, b net.ProgramName) int {
+			return strings.Compare(a.Pk.Encode()+a.Name, b.Pk.Encode()+b.Name)
+		})
+
+		w.WriteHeader(http.StatusOK)
+		for _, pn := range names {
+			spec := programs[pn]
+			latest := "none"
+			if results := n.ScheduledResults(pn.Pk, pn.Name); len(results) > 0 {
+				res := results[len(results)-1]
+				latest = fmt.Sprintf("%d (ran by %s)", res.Tick, res.From.Encode())
+			}
+			fmt.Fprintf(w, "%s %s\t%s\tlatest %s\n", pn.Pk.Encode(), pn.Name, spec, latest)
+		}
+	})
+
+	// history of one of our program names, oldest first
+	mux.HandleFunc("GET /versions/{name}", func(w http.ResponseWriter, r *http.Request) {
+		vs, err := net.GetVersions(n.Pk, r.PathValue("name"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get versions: %v", err), http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		for _, v := range vs {
+			fmt.Fprintf(w, "%s\t%s\n", time.UnixMilli(v.Time).UTC().Format(time.RFC3339), v.Hash)
+		}
+	})
+
+	// point one of our program names back to a program from its history, given its hash
+	mux.HandleFunc("POST /rollback/{name}", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		hash, err := hex.DecodeString(strings.TrimSpace(string(body)))
+		if err != nil || len(hash) != 32 {
+			http.Error(w, "Invalid hash", http.StatusBadRequest)
+			return
+		}
+
+		if err = n.Rollback(r.PathValue("name"), [32]byte(hash)); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to roll back program: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// messages dropped by replay protection
+	mux.HandleFunc("GET /replays", func(w http.ResponseWriter, r *http.Request) {
+		s := n.ReplayStats()
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "replayed\t%d\nout of window\t%d\n", s.Replayed, s.OutOfWindow)
+	})
+
+	// our programs, with how many peers should have them and which do
+	mux.HandleFunc("GET /replication", func(w http.ResponseWriter, r *http.Request) {
+		status := n.Replicas()
+		names := slices.Sorted(maps.Keys(status))
+
+		w.WriteHeader(http.StatusOK)
+		for _, name := range names {
+			s := status[name]
+			fmt.Fprintf(w, "%s\t%s\t%d of %d replicas\n", name, hex.EncodeToString(s.Hash[:]), len(s.Holders), s.Replicas)
+			for _, pk := range s.Holders {
+				pinned := ""
+				if slices.Contains(s.Pinned, pk) {
+					pinned = " (pinned)"
+				}
+				fmt.Fprintf(w, "    %s%s\n", pk.Encode(), pinned)
+			}
+		}
+	})
+
+	// what we remember about peers, most reputable first
+	mux.HandleFunc("GET /reputation", func(w http.ResponseWriter, r *http.Request) {
+		scores := n.Reputations()
+		pks := slices.SortedFunc(maps.Keys(scores), func(a, b keys.PK) int {
+			return cmp.Compare(scores[b].Score(), scores[a].Score())
+		})
+
+		now := time.Now()
+		w.WriteHeader(http.StatusOK)
+		for _, pk := range pks {
+			s := scores[pk]
+			status := "ok"
+			if s.Banned(now) {
+				status = "banned until " + s.BannedUntil.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%.3f\t%d ok, %d failed, %d disagreed, %d invalid\t%s\t%s\n",
+				pk.Encode(), s.Score(), s.Successes, s.Failures, s.Disagreements, s.Invalid, s.Latency.Round(time.Millisecond), status)
+		}
+	})
+
+	// forget a peer's reputation, which unbans it
+	mux.HandleFunc("DELETE /reputation/{pk}", func(w http.ResponseWriter, r *http.Request) {
+		pk, err := keys.DecodePK(r.PathValue("pk"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode public key: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		n.ForgetPeer(pk)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	fmt.Println("Listening for management on port", PortManagement)
+	http.ListenAndServe(fmt.Sprintf(":%d", PortManagement), mux)
+}
 
 const msgChunk = 2 << 19
 
@@ -166,6 +411,7 @@ func getAddrs() (addrs []keys.Address) {
 	return
 }
 
+// getPeers reads the find strings of seed peers, one per line. The rest of the network is learned from them.
 func getPeers() (peers []*keys.Peer) {
 	// open the peers file
 	const peersFile = "peers"
@@ -204,6 +450,138 @@ func getPeers() (peers []*keys.Peer) {
 	return
 }
 
+const (
+	reputationFile = "reputation"
+	replicasFile   = "replicas"
+	// how often peers' reputations and our replicas are saved
+	saveInterval = time.Minute
+)
+
+// loadFile reads what a previous run saved to a file, if there is one
+func loadFile(path string, load func(io.Reader) error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		fmt.Printf("Failed to open %s file: %v\n", path, err)
+		return
+	}
+	defer file.Close()
+
+	if err = load(file); err != nil {
+		fmt.Printf("Failed to load %s file: %v\n", path, err)
+	}
+}
+
+// saveFile saves to a file every so often, replacing it whole so it's never left half-written
+func saveFile(path string, save func(io.Writer) error) {
+	for {
+		time.Sleep(saveInterval)
+
+		tmp := path + ".tmp"
+		file, err := os.Create(tmp)
+		if err != nil {
+			fmt.Printf("Failed to create %s file %s: %v\n", path, tmp, err)
+			continue
+		}
+
+		err = save(file)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+		if err != nil {
+			fmt.Printf("Failed to save %s file: %v\n", path, err)
+		}
+	}
+}
+
+type programQuorum struct {
+	Pk     keys.PK
+	Name   string
+	Quorum Quorum
+}
+
+// getQuorums reads the quorums programs are run with, one per line as "<public key> <name> <m>/<k>"
+func getQuorums() (quorums []programQuorum) {
+	const quorumsFile = "quorums"
+	b, err := os.ReadFile(quorumsFile)
+	if os.IsNotExist(err) {
+		return // programs are run on the first peer that answers
+	} else if err != nil {
+		fmt.Printf("Failed to read quorums file %s: %v\n", quorumsFile, err)
+		os.Exit(1)
+	}
+
+	for line := range strings.SplitSeq(strings.TrimSpace(string(b)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			fmt.Printf(`Invalid quorum line "%s"\n`, line)
+			continue
+		}
+
+		pk, err := keys.DecodePK(fields[0])
+		if err != nil {
+			fmt.Printf(`Failed to decode public key on line "%s": %v\n`, line, err)
+			continue
+		}
+		q, err := ParseQuorum(fields[2])
+		if err != nil {
+			fmt.Printf(`Failed to parse quorum on line "%s": %v\n`, line, err)
+			continue
+		}
+
+		quorums = append(quorums, programQuorum{pk, fields[1], q})
+	}
+	return
+}
+
+type programReplication struct {
+	Name        string
+	Replication net.Replication
+}
+
+// getReplication reads how our programs are replicated, one per line as "<name> <replicas> [pinned public keys...]"
+func getReplication() (rs []programReplication) {
+	const replicationFile = "replication"
+	b, err := os.ReadFile(replicationFile)
+	if os.IsNotExist(err) {
+		return // programs are sent to the default number of peers
+	} else if err != nil {
+		fmt.Printf("Failed to read replication file %s: %v\n", replicationFile, err)
+		os.Exit(1)
+	}
+
+	for line := range strings.SplitSeq(strings.TrimSpace(string(b)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			fmt.Printf(`Invalid replication line "%s"\n`, line)
+			continue
+		}
+
+		replicas, err := strconv.Atoi(fields[1])
+		if err != nil || replicas < 0 {
+			fmt.Printf(`Invalid replica count on line "%s"\n`, line)
+			continue
+		}
+
+		r := net.Replication{Replicas: replicas}
+		for _, pks := range fields[2:] {
+			pk, err := keys.DecodePK(pks)
+			if err != nil {
+				fmt.Printf(`Failed to decode pinned public key on line "%s": %v\n`, line, err)
+				continue
+			}
+			r.Pinned = append(r.Pinned, pk)
+		}
+
+		rs = append(rs, programReplication{fields[0], r})
+	}
+	return
+}
+
 type loadedProgram struct {
 	Name    string
 	Bundled []byte
@@ -254,6 +632,8 @@ func start() {
 	addrs := getAddrs()
 	peers := getPeers()
 	programs := getPrograms()
+	quorums := getQuorums()
+	replication := getReplication()
 
 	// generate local IP address
 	// lip, err := gnet.ResolveIPAddr("ip6", "::1")
@@ -262,24 +642,16 @@ func start() {
 	// 	os.Exit(1)
 	// }
 
-	// make a self-signed TLS certificate
-	tlsCert, err := kp.Sk.TLS()
+	// certificates are bound to our key, and peers are checked against theirs
+	tlsConf, err := kp.TLSConfig()
 	if err != nil {
-		fmt.Println("Failed to create TLS certificate:", err)
+		fmt.Println("Failed to create TLS config:", err)
 		os.Exit(1)
 	}
-
-	tlsConf := &tls.Config{
-		Certificates:       []tls.Certificate{tlsCert},
-		NextProtos:         []string{"quic"},
-		MinVersion:         tls.VersionTLS13,
-		InsecureSkipVerify: true, // "tls: failed to verify certificate: x509: certificate signed by unknown authority"
-		// i've been in TLS hell for long enough today
-	}
+	tlsConf.NextProtos = []string{"quic"}
 
 	quicConf := &quic.Config{
 		Versions:             []quic.Version{quic.Version2},
-		Allow0RTT:            true,
 		KeepAlivePeriod:      15 * time.Second,
 		HandshakeIdleTimeout: time.Second, // just 4 speed
 	}
@@ -291,10 +663,20 @@ func start() {
 	}
 
 	n := net.NewNode(kp, addrs[0], addrs[1:]...)
+	loadFile(reputationFile, n.LoadReputations)
+	loadFile(replicasFile, n.LoadReplicas) // before the replication file, which overrides it
 
 	for _, peer := range peers {
 		n.AddPeer(peer)
 	}
+	for _, pq := range quorums {
+		fmt.Println("Running", pq.Pk.Encode(), pq.Name, "with a quorum of", pq.Quorum)
+		n.SetQuorum(pq.Pk, pq.Name, pq.Quorum)
+	}
+	for _, pr := range replication {
+		fmt.Println("Keeping", pr.Name, "on", pr.Replication.Replicas, "peers,", len(pr.Replication.Pinned), "pinned")
+		n.SetReplication(pr.Name, pr.Replication)
+	}
 
 	fmt.Println("Public key", kp.Pk.Encode())
 	fmt.Println(len(addrs), "public network addresses found")
@@ -307,11 +689,13 @@ func start() {
 	qnet.AddNode(n)
 	n.Start()
 	go gatewayServer(n)
-	go managementServer()
+	go managementServer(n)
+	go saveFile(reputationFile, n.SaveReputations)
+	go saveFile(replicasFile, n.SaveReplicas)
 
 	for _, prog := range programs {
 		fmt.Printf("Loading program %s (%d bytes)...\n", prog.Name, len(prog.Bundled))
-		if err := n.StoreProgram(kp.Pk, prog.Name, kp.Sk.SignHash(prog.Bundled), prog.Bundled); err != nil {
+		if err := n.StoreProgram(prog.Name, prog.Bundled); err != nil {
 			fmt.Printf("Failed to store program %s: %v\n", prog.Name, err)
 			continue
 		}
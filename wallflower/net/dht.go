@@ -0,0 +1,442 @@
+package net
+
+import (
+	"crypto/sha3"
+	"errors"
+	"math/bits"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Heliodex/coputer/wallflower/keys"
+)
+
+// finding which peers have a program
+// A Kademlia-style DHT: every peer has an ID, and keeps more peers with IDs close to its own (by XOR distance) than far away. Peers that have a program tell the peers with IDs closest to the program's keys, so anyone can find them by asking peers closer and closer to the key.
+// Programs have two keys, one for the hash of their bundle and one for their public key and name.
+
+const (
+	// peers per bucket, and how many peers store each provider record
+	dhtK = 8
+	// peers asked at the same time in a lookup
+	dhtAlpha = 3
+	// how long to wait for a peer to answer
+	dhtTimeout = 5 * time.Second
+	// provider records are dropped if they aren't republished
+	ProviderTTL = 24 * time.Hour
+	// how often we republish our records, and look ourselves up to find new peers
+	dhtRepublish = time.Hour
+)
+
+type dhtID [32]byte
+
+func peerID(pk keys.PK) dhtID {
+	return sha3.Sum256(pk[:])
+}
+
+// nameKey is the key of a program name
+func nameKey(pk keys.PK, name string) dhtID {
+	b := append([]byte("coputer name\x00"), pk[:]...)
+	return sha3.Sum256(append(b, name...))
+}
+
+// hashKey is the key of a program's bundle, which is already a hash
+func hashKey(hash [32]byte) dhtID {
+	return hash
+}
+
+// distCmp compares how close a and b are to id
+func (id dhtID) distCmp(a, b dhtID) int {
+	for i := range id {
+		if c := int(id[i]^a[i]) - int(id[i]^b[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// bucket returns how many leading bits two IDs share
+func (id dhtID) bucket(other dhtID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(id) * 8
+}
+
+type provider struct {
+	keys.Peer
+	expires time.Time
+}
+
+type dht struct {
+	mu        sync.Mutex
+	me        keys.Peer // with our find string
+	id        dhtID
+	buckets   [256][]keys.Peer // least recently seen first
+	providers map[dhtID]map[keys.PK]provider
+	local     map[dhtID]bool // keys we provide
+
+	queryMu sync.Mutex
+	nextID  uint64
+	queries map[uint64]chan mNodes
+}
+
+func newDHT(me keys.Peer) *dht {
+	return &dht{
+		me:        me,
+		id:        peerID(me.Pk),
+		providers: make(map[dhtID]map[keys.PK]provider),
+		local:     make(map[dhtID]bool),
+		queries:   make(map[uint64]chan mNodes),
+	}
+}
+
+// add records a peer we've seen, which has to have a find string so it can be shared. Full buckets keep the peers they have, as peers that have been around longest are most likely to stay.
+func (d *dht) add(p keys.Peer) {
+	if p.Find == "" || p.Pk == d.me.Pk {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	i := d.id.bucket(peerID(p.Pk))
+	b := slices.DeleteFunc(d.buckets[i], func(e keys.Peer) bool {
+		return e.Pk == p.Pk
+	})
+	if len(b) >= dhtK {
+		return
+	}
+	d.buckets[i] = append(b, p)
+}
+
+func (d *dht) remove(pk keys.PK) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	i := d.id.bucket(peerID(pk))
+	d.buckets[i] = slices.DeleteFunc(d.buckets[i], func(e keys.Peer) bool {
+		return e.Pk == pk
+	})
+}
+
+func sortByDistance(ps []keys.Peer, target dhtID) {
+	slices.SortFunc(ps, func(a, b keys.Peer) int {
+		return target.distCmp(peerID(a.Pk), peerID(b.Pk))
+	})
+}
+
+// closest returns the peers we know closest to a target
+func (d *dht) closest(target dhtID, count int) (ps []keys.Peer) {
+	d.mu.Lock()
+	for _, b := range d.buckets {
+		ps = append(ps, b...)
+	}
+	d.mu.Unlock()
+
+	sortByDistance(ps, target)
+	return ps[:min(len(ps), count)]
+}
+
+func (d *dht) addProvider(key dhtID, p keys.Peer, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ps, ok := d.providers[key]
+	if !ok {
+		ps = make(map[keys.PK]provider)
+		d.providers[key] = ps
+	}
+	ps[p.Pk] = provider{p, now.Add(ProviderTTL)}
+}
+
+// providersOf returns the peers we know have a key, including ourselves
+func (d *dht) providersOf(key dhtID, now time.Time) (ps []keys.Peer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.local[key] {
+		ps = append(ps, d.me)
+	}
+	for pk, p := range d.providers[key] {
+		if now.After(p.expires) {
+			delete(d.providers[key], pk)
+			continue
+		}
+		ps = append(ps, p.Peer)
+	}
+	if len(d.providers[key]) == 0 {
+		delete(d.providers, key)
+	}
+	return
+}
+
+// findFunc asks a peer for the peers it knows closest to a target, and the providers it knows of
+type findFunc func(p keys.Peer, target dhtID, providers bool) (closest, provs []keys.Peer, err error)
+
+// lookup finds the peers closest to a target, by asking the closest peers we know for closer ones until there aren't any. If providers are wanted, it stops once some are found.
+func (d *dht) lookup(target dhtID, providers bool, find findFunc) (closest, provs []keys.Peer) {
+	found := make(map[keys.PK]keys.Peer)
+	if providers {
+		for _, p := range d.providersOf(target, time.Now()) {
+			if p.Pk != d.me.Pk { // we're looking for someone else
+				found[p.Pk] = p
+			}
+		}
+	}
+
+	cands := d.closest(target, dhtK)
+	seen := map[keys.PK]bool{d.me.Pk: true}
+	for _, c := range cands {
+		seen[c.Pk] = true
+	}
+	queried := make(map[keys.PK]bool)
+
+	type reply struct {
+		from           keys.Peer
+		closest, provs []keys.Peer
+		err            error
+	}
+
+	for len(found) == 0 || !providers {
+		// the closest peers we haven't asked yet
+		var ask []keys.Peer
+		for _, c := range cands[:min(len(cands), dhtK)] {
+			if !queried[c.Pk] && len(ask) < dhtAlpha {
+				ask = append(ask, c)
+			}
+		}
+		if len(ask) == 0 {
+			break // the closest peers have all answered
+		}
+
+		replies := make(chan reply, len(ask))
+		for _, p := range ask {
+			queried[p.Pk] = true
+			go func() {
+				c, ps, err := find(p, target, providers)
+				replies <- reply{p, c, ps, err}
+			}()
+		}
+
+		for range ask {
+			r := <-replies
+			if r.err != nil {
+				d.remove(r.from.Pk)
+				cands = slices.DeleteFunc(cands, func(c keys.Peer) bool {
+					return c.Pk == r.from.Pk
+				})
+				continue
+			}
+
+			d.add(r.from)
+			for _, c := range r.closest {
+				if !seen[c.Pk] {
+					seen[c.Pk] = true
+					cands = append(cands, c)
+				}
+			}
+			for _, p := range r.provs {
+				if p.Pk != d.me.Pk {
+					found[p.Pk] = p
+				}
+			}
+		}
+		sortByDistance(cands, target)
+	}
+
+	for _, c := range cands {
+		if queried[c.Pk] && len(closest) < dhtK {
+			closest = append(closest, c)
+		}
+	}
+	for _, p := range found {
+		provs = append(provs, p)
+	}
+	return
+}
+
+// provide tells the peers closest to a key that we have it
+func (d *dht) provide(key dhtID, find findFunc, announce func(p keys.Peer) error) (told int) {
+	d.mu.Lock()
+	d.local[key] = true
+	d.mu.Unlock()
+
+	closest, _ := d.lookup(key, false, find)
+	for _, p := range closest {
+		if announce(p) == nil {
+			told++
+		}
+	}
+	return
+}
+
+// handleFind answers a peer's lookup
+func (d *dht) handleFind(target dhtID, providers bool) (closest, provs []keys.Peer) {
+	closest = d.closest(target, dhtK)
+	if providers {
+		provs = d.providersOf(target, time.Now())
+	}
+	return
+}
+
+// provides reports whether we provide a key
+func (d *dht) provides(key dhtID) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.local[key]
+}
+
+func (d *dht) localKeys() (ks []dhtID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for k := range d.local {
+		ks = append(ks, k)
+	}
+	return
+}
+
+// newQuery returns an ID for a lookup request, and where its answer will be sent
+func (d *dht) newQuery() (id uint64, ch chan mNodes) {
+	d.queryMu.Lock()
+	defer d.queryMu.Unlock()
+
+	d.nextID++
+	ch = make(chan mNodes, 1)
+	d.queries[d.nextID] = ch
+	return d.nextID, ch
+}
+
+func (d *dht) endQuery(id uint64) {
+	d.queryMu.Lock()
+	defer d.queryMu.Unlock()
+
+	delete(d.queries, id)
+}
+
+// answer passes on an answer to a lookup request, if we're still waiting for it
+func (d *dht) answer(m mNodes) bool {
+	d.queryMu.Lock()
+	defer d.queryMu.Unlock()
+
+	ch, ok := d.queries[m.Query]
+	if !ok {
+		return false
+	}
+	delete(d.queries, m.Query)
+	ch <- m
+	return true
+}
+
+// the DHT, over the network
+
+var (
+	errDHTTimeout = errors.New("peer didn't answer in time")
+	errBanned     = errors.New("peer is banned")
+)
+
+func (n *Node) peerFind(p keys.Peer, target dhtID, providers bool) (closest, provs []keys.Peer, err error) {
+	if n.rep.banned(p.Pk, time.Now()) {
+		return nil, nil, errBanned
+	}
+
+	id, ch := n.dht.newQuery()
+	defer n.dht.endQuery(id)
+
+	start := time.Now()
+	if err = n.send(n.knownPeer(p), mFindNode{id, target, providers}); err != nil {
+		return
+	}
+
+	select {
+	case m := <-ch:
+		n.rep.success(p.Pk, time.Since(start), time.Now())
+		closest, provs = peersFromFinds(m.Peers), peersFromFinds(m.Providers)
+		return
+	case <-time.After(dhtTimeout):
+		n.penalise(p.Pk, n.rep.failure)
+		return nil, nil, errDHTTimeout
+	}
+}
+
+func peersFromFinds(finds []string) (ps []keys.Peer) {
+	for _, f := range finds {
+		if p, err := PeerFromFindString(f); err == nil {
+			ps = append(ps, *p)
+		}
+	}
+	return
+}
+
+func findsFromPeers(ps []keys.Peer) (finds []string) {
+	for _, p := range ps {
+		if p.Find != "" {
+			finds = append(finds, p.Find)
+		}
+	}
+	return
+}
+
+// knownPeer returns the peer we know with the same key, which might know more (like their session)
+func (n *Node) knownPeer(p keys.Peer) *keys.Peer {
+	n.peersMu.RLock()
+	defer n.peersMu.RUnlock()
+
+	if known, ok := n.Peers[p.Pk]; ok {
+		return known
+	}
+	return &p
+}
+
+// FindProviders finds peers other than us that have a program.
+func (n *Node) FindProviders(pk keys.PK, name string) []keys.Peer {
+	_, provs := n.dht.lookup(nameKey(pk, name), true, n.peerFind)
+	return provs
+}
+
+// announcer returns how we tell a peer we have a key
+func (n *Node) announcer(key dhtID) func(p keys.Peer) error {
+	return func(p keys.Peer) error {
+		return n.send(n.knownPeer(p), mProvide{key, n.dht.me.Find})
+	}
+}
+
+// provide tells the network we have a program. It waits for lookups, so it can't be run while receiving messages.
+func (n *Node) provide(pk keys.PK, name string, hash [32]byte) {
+	for _, key := range [...]dhtID{nameKey(pk, name), hashKey(hash)} {
+		n.dht.provide(key, n.peerFind, n.announcer(key))
+	}
+}
+
+func (n *Node) receiveFindNode(from *keys.Peer, m mFindNode) {
+	closest, provs := n.dht.handleFind(m.Target, m.Providers)
+	res := mNodes{m.Query, findsFromPeers(closest), findsFromPeers(provs)}
+	if err := n.send(from, res); err != nil {
+		n.log("Failed to send DHT answer\n", err)
+	}
+}
+
+func (n *Node) receiveProvide(from *keys.Peer, m mProvide) {
+	p, err := PeerFromFindString(m.Find)
+	if err != nil || p.Pk != from.Pk {
+		n.log("Invalid provider record from peer\n", from.Pk.Encode())
+		n.penalise(from.Pk, n.rep.invalid)
+		return
+	}
+	n.dht.addProvider(m.Key, *p, time.Now())
+}
+
+// runDHT republishes our provider records before they expire, and looks ourselves up to fill our buckets
+func (n *Node) runDHT() {
+	for n.running.Load() {
+		n.dht.lookup(n.dht.id, false, n.peerFind)
+		for _, key := range n.dht.localKeys() {
+			n.dht.provide(key, n.peerFind, n.announcer(key))
+		}
+		time.Sleep(dhtRepublish)
+	}
+}
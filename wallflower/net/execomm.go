@@ -5,10 +5,13 @@ package net
 import (
 	"bytes"
 	"crypto/sha3"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 
 	. "github.com/Heliodex/coputer/litecode/types"
 	"github.com/Heliodex/coputer/wallflower/keys"
@@ -43,7 +46,8 @@ func GetProfile(pk keys.PK) (programs []string, err error) {
 	return
 }
 
-func StoreProgram(pk keys.PK, name string, b []byte) (hash [32]byte, err error) {
+// StoreProgram stores a program on the execution server as a version of a name, which must be signed by the name's owner.
+func StoreProgram(pk keys.PK, name string, v Version, b []byte) (hash [32]byte, err error) {
 	// fmt.Println("Storing program", pk.Encode(), name)
 	hash = sha3.Sum256(b)
 
@@ -57,6 +61,8 @@ func StoreProgram(pk keys.PK, name string, b []byte) (hash [32]byte, err error)
 	if err != nil {
 		return
 	}
+	req.Header.Set(VersionTimeHeader, strconv.FormatInt(v.Time, 10))
+	req.Header.Set(SignatureHeader, hex.EncodeToString(v.Sig))
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -76,25 +82,211 @@ func StoreProgram(pk keys.PK, name string, b []byte) (hash [32]byte, err error)
 	return [32]byte{}, fmt.Errorf("bad status from execution server while storing web program: %s, %s", res.Status, string(body))
 }
 
-func StartWebProgram(pk keys.PK, name string, args WebArgs) (rets WebRets, err error) {
-	res, err := http.Post(addr+"/web/"+pk.EncodeNoPrefix()+"/"+url.PathEscape(name), "", bytes.NewReader(args.Encode()))
+func versionsPath(pk keys.PK, name string) string {
+	return addr + "/versions/" + pk.EncodeNoPrefix() + "/" + url.PathEscape(name)
+}
+
+// GetVersions gets the history of a program name, oldest first.
+func GetVersions(pk keys.PK, name string) (vs []Version, err error) {
+	res, err := http.Get(versionsPath(pk, name))
+	if err != nil {
+		return nil, fmt.Errorf("get versions: %v", err)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response body while getting versions: %v", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status from execution server while getting versions: %s, %s", res.Status, b)
+	}
+	return vs, json.Unmarshal(b, &vs)
+}
+
+// GetVersionBundle gets the bundle of a version of a program name.
+func GetVersionBundle(pk keys.PK, name, hexhash string) (b []byte, err error) {
+	res, err := http.Get(versionsPath(pk, name) + "/" + hexhash)
+	if err != nil {
+		return nil, fmt.Errorf("get version: %v", err)
+	}
+	defer res.Body.Close()
+
+	if b, err = io.ReadAll(res.Body); err != nil {
+		return nil, fmt.Errorf("read response body while getting version: %v", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status from execution server while getting version: %s, %s", res.Status, b)
+	}
+	return
+}
+
+// RollbackProgram points a program name back to a version from its history.
+func RollbackProgram(pk keys.PK, name string, v Version) error {
+	res, err := http.Post(addr+"/rollback/"+pk.EncodeNoPrefix()+"/"+url.PathEscape(name), "application/json", bytes.NewReader(v.Encode()))
 	if err != nil {
-		return WebRets{}, fmt.Errorf("start web program: %v", err)
+		return fmt.Errorf("roll back program: %v", err)
 	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("read response body while rolling back program: %v", err)
+	}
+	return fmt.Errorf("bad status from execution server while rolling back program: %s, %s", res.Status, b)
+}
+
+// runFailed classifies an error response from running a program. Responses without a class, like for programs that aren't stored, are infrastructure errors.
+func runFailed(res *http.Response, err error) error {
+	return ClassifyError(ParseErrorClass(res.Header.Get(ErrorClassHeader)), err)
+}
+
+// startProgram runs a program on the execution server, returning how its state changed if it's stateful
+func startProgram[R ProgramRets](kind string, pk keys.PK, name string, args ProgramArgs, call CallChain) (rets R, st *StateTransition, err error) {
+	req, err := http.NewRequest(http.MethodPost, addr+"/"+kind+"/"+pk.EncodeNoPrefix()+"/"+url.PathEscape(name), bytes.NewReader(args.Encode()))
+	if err != nil {
+		return
+	}
+	call.SetHeaders(req.Header)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return rets, nil, fmt.Errorf("start %s program: %v", kind, err)
+	}
+	defer res.Body.Close()
 
 	// we need the body either way
 	b, err := io.ReadAll(res.Body)
 	if err != nil {
-		return WebRets{}, fmt.Errorf("read response body while starting web program: %v", err)
+		return rets, nil, fmt.Errorf("read response body while starting %s program: %v", kind, err)
 	}
 
 	if res.StatusCode != http.StatusOK {
-		return WebRets{}, fmt.Errorf("bad status from execution server while starting web program: %s, %s", res.Status, b)
+		return rets, nil, runFailed(res, fmt.Errorf("bad status from execution server while starting %s program: %s, %s", kind, res.Status, b))
 	}
 
 	// deserialise it
-	if rets, err = DecodeRets[WebRets](b); err != nil {
-		return WebRets{}, fmt.Errorf("decode response body while starting web program: %v", err)
+	if rets, err = DecodeRets[R](b); err != nil {
+		return rets, nil, fmt.Errorf("decode response body while starting %s program: %v", kind, err)
 	}
+
+	if t, ok := StateTransitionFrom(res.Header, res.Trailer); ok {
+		st = &t
+	}
+	return
+}
+
+func StartWebProgram(pk keys.PK, name string, args WebArgs) (rets WebRets, err error) {
+	rets, _, err = startProgram[WebRets]("web", pk, name, args, CallChain{})
 	return
 }
+
+func StartLibraryProgram(pk keys.PK, name string, args LibraryArgs) (rets LibraryRets, err error) {
+	rets, _, err = startProgram[LibraryRets]("library", pk, name, args, CallChain{})
+	return
+}
+
+func StartScheduledProgram(pk keys.PK, name string, args ScheduledArgs) (rets ScheduledRets, err error) {
+	rets, _, err = startProgram[ScheduledRets]("scheduled", pk, name, args, CallChain{})
+	return
+}
+
+// StartWebStream runs a web program on the execution server, returning the response once its head has been sent. The response body is in the streamed format, and must be closed.
+func StartWebStream(pk keys.PK, name string, args WebArgs) (res *http.Response, err error) {
+	res, err = http.Post(addr+"/webstream/"+pk.EncodeNoPrefix()+"/"+url.PathEscape(name), "", bytes.NewReader(args.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("start web program: %v", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("read response body while starting web program: %v", err)
+		}
+		return nil, runFailed(res, fmt.Errorf("bad status from execution server while starting web program: %s, %s", res.Status, b))
+	}
+	return
+}
+
+// StartProgram runs a program of any type on the execution server, as part of a call chain if it was called by another program. The state transition is nil unless the program is stateful.
+func StartProgram(pk keys.PK, name string, args ProgramArgs, call CallChain) (ProgramRets, *StateTransition, error) {
+	switch targs := args.(type) {
+	case WebArgs:
+		return startProgram[WebRets]("web", pk, name, targs, call)
+	case LibraryArgs:
+		return startProgram[LibraryRets]("library", pk, name, targs, call)
+	case ScheduledArgs:
+		return startProgram[ScheduledRets]("scheduled", pk, name, targs, call)
+	}
+	return nil, nil, fmt.Errorf("unknown program type %d", args.Type())
+}
+
+func statePath(pk keys.PK, name string) string {
+	return addr + "/state/" + pk.EncodeNoPrefix() + "/" + url.PathEscape(name)
+}
+
+// GetState gets the current state of a stateful program, if it has any.
+func GetState(pk keys.PK, name string) (data []byte, ok bool, err error) {
+	res, err := http.Get(statePath(pk, name))
+	if err != nil {
+		return nil, false, fmt.Errorf("get state: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+
+	if data, err = io.ReadAll(res.Body); err != nil {
+		return nil, false, fmt.Errorf("read response body while getting state: %v", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("bad status from execution server while getting state: %s, %s", res.Status, data)
+	}
+	return data, true, nil
+}
+
+// GetStateRoot gets the root of a program's current state, which is the root of an empty state if it hasn't been written to.
+func GetStateRoot(pk keys.PK, name string) (root [32]byte, err error) {
+	data, ok, err := GetState(pk, name)
+	if err != nil {
+		return
+	} else if !ok {
+		return State{}.Root(), nil
+	}
+	return sha3.Sum256(data), nil
+}
+
+// PutState replaces a program's state with one from a peer, which the execution server checks has the root given.
+func PutState(pk keys.PK, name string, root [32]byte, data []byte) error {
+	req, err := http.NewRequest(http.MethodPut, statePath(pk, name), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(StateRootHeader, hex.EncodeToString(root[:]))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("put state: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("read response body while putting state: %v", err)
+	}
+	return fmt.Errorf("bad status from execution server while putting state: %s, %s", res.Status, b)
+}
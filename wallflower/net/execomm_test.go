@@ -1,13 +1,16 @@
 package net
 
 import (
+	"bytes"
+	"crypto/sha3"
 	"testing"
 
 	"github.com/Heliodex/coputer/bundle"
-	"github.com/Heliodex/coputer/wallflower/keys"
 )
 
 func TestExec(t *testing.T) {
+	kp := getSampleKeypair()
+
 	for _, test := range webTests {
 		t.Log("-- Testing", test.Name)
 
@@ -16,12 +19,11 @@ func TestExec(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		// lel nil pk
-		if _, err = StoreProgram(keys.PK{}, test.Name, b); err != nil {
+		if _, err = StoreProgram(kp.Pk, test.Name, SignVersion(kp, test.Name, sha3.Sum256(b)), b); err != nil {
 			t.Fatal(err)
 		}
 
-		res, err := StartWebProgram(keys.PK{}, test.Name, test.Args)
+		res, err := StartWebProgram(kp.Pk, test.Name, test.Args)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -33,3 +35,29 @@ func TestExec(t *testing.T) {
 		t.Log(string(res.Body))
 	}
 }
+
+func TestExecLibrary(t *testing.T) {
+	kp := getSampleKeypair()
+
+	for _, test := range libraryTests {
+		t.Log("-- Testing", test.Name, test.Args.Function)
+
+		b, err := bundle.Bundle(testProgramPath + "/" + test.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = StoreProgram(kp.Pk, test.Name, SignVersion(kp, test.Name, sha3.Sum256(b)), b); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := StartLibraryProgram(kp.Pk, test.Name, test.Args)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(res.Rets, test.Rets.Rets) {
+			t.Fatalf("unexpected response: expected %x, got %x", test.Rets.Rets, res.Rets)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package net
+
+import (
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/Heliodex/coputer/wallflower/keys"
+)
+
+// peer exchange
+// Nodes share the find strings of peers they've seen recently, so a node that starts with a few seeds eventually learns about the rest of the network. Find strings are signed by the peer they're for, so whoever shares one can't change its addresses; how recently it was seen is only the sharer's word, so it's only used to decide which peers are worth keeping.
+
+const (
+	GossipInterval = time.Minute
+	// peers not seen for this long aren't shared or learned
+	PeerFreshness = time.Hour
+	// most peers in a peers message, including the sender
+	maxGossipPeers = 32
+	// most peers we keep, the least recently seen are forgotten first
+	maxPeers = 256
+)
+
+// hi introduces us to a peer, who'll reply with the peers they know
+func (n *Node) hi() mHi {
+	return mHi{n.FindString()}
+}
+
+// gossip returns the peers to share with a peer, most recently seen first, starting with ourselves
+func (n *Node) gossip(to keys.PK) mPeers {
+	now := time.Now()
+
+	n.peersMu.RLock()
+	var fresh []keys.Peer
+	for _, p := range n.Peers {
+		if p.Find != "" && p.Pk != to && now.Sub(p.LastSeen) < PeerFreshness {
+			fresh = append(fresh, *p)
+		}
+	}
+	n.peersMu.RUnlock()
+
+	slices.SortFunc(fresh, func(a, b keys.Peer) int {
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+
+	m := mPeers{[]gossipPeer{{n.FindString(), 0}}}
+	for _, p := range fresh[:min(len(fresh), maxGossipPeers-1)] {
+		m.Peers = append(m.Peers, gossipPeer{p.Find, uint32(now.Sub(p.LastSeen) / time.Second)})
+	}
+	return m
+}
+
+// learnPeer adds a peer we've been told about, returning whether we learned anything
+func (n *Node) learnPeer(p *keys.Peer, from keys.PK) bool {
+	if n.rep.banned(p.Pk, time.Now()) {
+		return false
+	}
+
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	if known, ok := n.Peers[p.Pk]; ok {
+		switch {
+		case p.Pk == from && !known.Equals(*p): // peers can change their own addresses, but nobody else can
+			known.MainAddr, known.AltAddrs, known.Find = p.MainAddr, p.AltAddrs, p.Find
+		case known.Find == "" && known.Equals(*p):
+			known.Find = p.Find
+		default:
+			return false
+		}
+		n.dht.add(*known)
+		return true
+	}
+
+	if !n.makeRoom(p.LastSeen) {
+		return false
+	}
+	n.Peers[p.Pk] = p
+	n.dht.add(*p)
+	return true
+}
+
+// makeRoom forgets the least recently seen peer if we know too many, unless it was seen after lastSeen. The lock must be held.
+func (n *Node) makeRoom(lastSeen time.Time) bool {
+	if len(n.Peers) < maxPeers {
+		return true
+	}
+
+	var stalest *keys.Peer
+	for _, k := range n.Peers {
+		if stalest == nil || k.LastSeen.Before(stalest.LastSeen) {
+			stalest = k
+		}
+	}
+	if !stalest.LastSeen.Before(lastSeen) {
+		return false
+	}
+
+	delete(n.Peers, stalest.Pk)
+	n.dht.remove(stalest.Pk)
+	n.replicas.wakeUp() // they might have had our programs
+	return true
+}
+
+func (n *Node) receiveHi(from *keys.Peer, m mHi) {
+	if m.Find != "" {
+		p, err := PeerFromFindString(m.Find)
+		if err != nil || p.Pk != from.Pk {
+			n.log("Invalid find string from peer\n", from.Pk.Encode())
+			n.penalise(from.Pk, n.rep.invalid)
+			return
+		}
+		n.learnPeer(p, from.Pk)
+	}
+
+	if err := n.send(from, n.gossip(from.Pk)); err != nil {
+		n.log("Failed to send peers\n", err)
+	}
+}
+
+func (n *Node) receivePeers(from *keys.Peer, m mPeers) {
+	now := time.Now()
+
+	var learned []*keys.Peer
+	for _, gp := range m.Peers {
+		age := time.Duration(gp.Age) * time.Second
+		if age >= PeerFreshness {
+			continue
+		}
+
+		p, err := PeerFromFindString(gp.Find)
+		if err != nil {
+			n.log("Invalid find string from peer\n", err)
+			continue
+		}
+		if p.Pk == n.Pk {
+			continue
+		}
+
+		p.LastSeen = now.Add(-age)
+		if n.learnPeer(p, from.Pk) {
+			learned = append(learned, p)
+		}
+	}
+
+	// introduce ourselves to who we've learned about, and they'll share their peers too
+	for _, p := range learned {
+		if p.Pk == from.Pk {
+			continue
+		}
+		if err := n.send(p, n.hi()); err != nil {
+			n.log("Failed to send hi message to peer\n", err)
+		}
+	}
+}
+
+// shareWithRandom shares our peers with a random peer
+func (n *Node) shareWithRandom() {
+	peers := n.peerList()
+	if len(peers) == 0 {
+		return
+	}
+
+	p := peers[rand.IntN(len(peers))]
+	if err := n.send(p, n.gossip(p.Pk)); err != nil {
+		n.log("Failed to send peers\n", err)
+	}
+}
+
+// runGossip shares our peers every so often, so peers that learned about us before we had their find string still end up with it
+func (n *Node) runGossip() {
+	for n.running.Load() {
+		time.Sleep(GossipInterval)
+		if n.running.Load() {
+			n.shareWithRandom()
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package net
 
 import (
+	"crypto/sha3"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"time"
 
 	. "github.com/Heliodex/coputer/litecode/types"
 	"github.com/Heliodex/coputer/wallflower/keys"
@@ -24,6 +28,26 @@ const (
 	tRun
 	// A result of a program execution, indexed by name and pubkey
 	tRunResult
+	// A result of a scheduled program run, indexed by name, pubkey, and tick
+	tScheduledResult
+	// The state of a stateful program after a run, indexed by name and pubkey
+	tState
+	// A signed version of a program name, for rolling back to a program peers already have
+	tVersion
+	// Find strings of peers the sender has seen recently
+	tPeers
+	// A request for the peers closest to a DHT key, and who provides it
+	tFindNode
+	// An answer to a DHT request
+	tNodes
+	// The sender has a program with a DHT key
+	tProvide
+	// Whether the receiver still has a program, by hash, answered with a store result
+	tHave
+	// A request for the state of a stateful program, if it's at a root
+	tStateRequest
+	// The state of a stateful program, answering a state request
+	tStateData
 )
 
 // sent messages
@@ -35,30 +59,45 @@ func addType(t MessageType, m []byte) []byte {
 	return append([]byte{t}, m...)
 }
 
-type mHi struct{}
+// the sender's find string, so we can share it (empty from older nodes)
+type mHi struct {
+	Find string
+}
 
 func (m mHi) Serialise() ([]byte, error) {
-	return []byte{tHi}, nil
+	return addType(tHi, []byte(m.Find)), nil
 }
 
-// TODO: store this in the execution server too so we can retrieve it from there
 type mStore struct {
 	Name    string
 	Pk      keys.PK
-	Sig     keys.HashSig
+	Time    int64        // of the version, unix milliseconds
+	Sig     keys.HashSig // of the version
 	Bundled []byte
 }
 
+// version returns the version of the name the program is stored as
+func (m mStore) version() Version {
+	hash := sha3.Sum256(m.Bundled)
+	return Version{
+		Hash:   hex.EncodeToString(hash[:]),
+		Time:   m.Time,
+		Signer: m.Pk.EncodeNoPrefix(),
+		Sig:    m.Sig[:],
+	}
+}
+
 func (m mStore) Serialise() ([]byte, error) {
 	nl := len(m.Name)
 	if nl > 255 {
 		return nil, errors.New("name too long")
 	}
 
-	b := make([]byte, 1, 1+nl+keys.PKSize+len(m.Sig)+len(m.Bundled))
+	b := make([]byte, 1, 1+nl+keys.PKSize+8+len(m.Sig)+len(m.Bundled))
 	b[0] = byte(nl)
 	b = append(b, m.Name...)
 	b = append(b, m.Pk[:]...)
+	b = binary.BigEndian.AppendUint64(b, uint64(m.Time))
 	b = append(b, m.Sig[:]...)
 	b = append(b, m.Bundled...)
 
@@ -77,17 +116,31 @@ type mRun struct {
 	Type  ProgramType // 1
 	Pk    keys.PK     // 29
 	Name  string      // 1 + length
+	Call  CallChain   // 1 + 32 * length, then the deadline (8, unix milliseconds, 0 if not called by another program)
 	Input ProgramArgs
 }
 
 func (m mRun) Serialise() (s []byte, err error) {
+	if len(m.Call.Hashes) > 255 {
+		return nil, errors.New("call chain too long")
+	}
 	in := m.Input.Encode()
 
-	b := make([]byte, 1, 1+keys.PKSize+1+len(m.Name)+len(in))
+	var deadline int64
+	if !m.Call.Empty() {
+		deadline = m.Call.Deadline.UnixMilli()
+	}
+
+	b := make([]byte, 1, 1+keys.PKSize+1+len(m.Name)+1+32*len(m.Call.Hashes)+8+len(in))
 	b[0] = byte(m.Type)
 	b = append(b, m.Pk[:]...)
 	b = append(b, byte(len(m.Name)))
 	b = append(b, m.Name...)
+	b = append(b, byte(len(m.Call.Hashes)))
+	for _, h := range m.Call.Hashes {
+		b = append(b, h[:]...)
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(deadline))
 	b = append(b, in...)
 
 	return addType(tRun, b), nil
@@ -99,12 +152,24 @@ type mRunResult struct {
 	Name      string      // 1 + length
 	InputHash [32]byte
 	Result    *ProgramRets // nil if failed or no program result
+	Err       *RunError    // why it failed, if it did
+}
+
+// runError gives an error from running a program a class, so it can be sent to peers
+func runError(err error) *RunError {
+	re, _ := errors.AsType[*RunError](ClassifyError(InfraError, err))
+	return re
 }
 
+// results are JSON, so can't start with a 0 byte, which marks an error instead
+const runResultErr = 0
+
 func (m mRunResult) Serialise() (s []byte, err error) {
 	var res []byte
 	if m.Result != nil {
 		res = (*m.Result).Encode()
+	} else if m.Err != nil {
+		res = append([]byte{runResultErr, byte(m.Err.Class)}, m.Err.Error()...)
 	}
 
 	b := make([]byte, 1, 1+keys.PKSize+1+len(m.Name)+len(res))
@@ -118,8 +183,256 @@ func (m mRunResult) Serialise() (s []byte, err error) {
 	return addType(tRunResult, b), nil
 }
 
+type mScheduledResult struct {
+	Pk     keys.PK // 29
+	Name   string  // 1 + length
+	Tick   int64   // 8
+	Result ScheduledRets
+}
+
+func (m mScheduledResult) Serialise() (s []byte, err error) {
+	nl := len(m.Name)
+	if nl > 255 {
+		return nil, errors.New("name too long")
+	}
+	res := m.Result.Encode()
+
+	b := make([]byte, 0, keys.PKSize+1+nl+8+len(res))
+	b = append(b, m.Pk[:]...)
+	b = append(b, byte(nl))
+	b = append(b, m.Name...)
+	b = binary.BigEndian.AppendUint64(b, uint64(m.Tick))
+	b = append(b, res...)
+
+	return addType(tScheduledResult, b), nil
+}
+
+// a change to the state of a stateful program, made by running it with an input
+type mState struct {
+	Pk    keys.PK     // 29
+	Name  string      // 1 + length
+	Base  [32]byte    // root of the state it was run on
+	Root  [32]byte    // root of the state it left
+	Input ProgramArgs // 1 (type), then the encoded input
+}
+
+func (m mState) Serialise() (s []byte, err error) {
+	nl := len(m.Name)
+	if nl > 255 {
+		return nil, errors.New("name too long")
+	}
+	in := m.Input.Encode()
+
+	b := make([]byte, 0, keys.PKSize+1+nl+32+32+1+len(in))
+	b = append(b, m.Pk[:]...)
+	b = append(b, byte(nl))
+	b = append(b, m.Name...)
+	b = append(b, m.Base[:]...)
+	b = append(b, m.Root[:]...)
+	b = append(b, byte(m.Input.Type()))
+	b = append(b, in...)
+
+	return addType(tState, b), nil
+}
+
+type mVersion struct {
+	Pk      keys.PK // 29
+	Name    string  // 1 + length
+	Version Version // hash (32), time (8), and signature, signed by the pk
+}
+
+func (m mVersion) Serialise() (s []byte, err error) {
+	nl := len(m.Name)
+	if nl > 255 {
+		return nil, errors.New("name too long")
+	}
+	if len(m.Version.Sig) != keys.HashSigLen {
+		return nil, errors.New("invalid version signature")
+	}
+
+	hash := m.Version.HashBytes()
+
+	b := make([]byte, 0, keys.PKSize+1+nl+32+8+keys.HashSigLen)
+	b = append(b, m.Pk[:]...)
+	b = append(b, byte(nl))
+	b = append(b, m.Name...)
+	b = append(b, hash[:]...)
+	b = binary.BigEndian.AppendUint64(b, uint64(m.Version.Time))
+	b = append(b, m.Version.Sig...)
+
+	return addType(tVersion, b), nil
+}
+
+type gossipPeer struct {
+	Find string
+	Age  uint32 // seconds since the sender last saw the peer
+}
+
+type mPeers struct {
+	Peers []gossipPeer
+}
+
+// --- Count [1]
+// then for each peer
+// --- Age [4]
+// --- Find string length [2]
+// --- Find string
+func (m mPeers) Serialise() ([]byte, error) {
+	if len(m.Peers) > maxGossipPeers {
+		return nil, errors.New("too many peers")
+	}
+
+	b := []byte{byte(len(m.Peers))}
+	for _, p := range m.Peers {
+		if len(p.Find) > 1<<16-1 {
+			return nil, errors.New("find string too long")
+		}
+		b = binary.BigEndian.AppendUint32(b, p.Age)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(p.Find)))
+		b = append(b, p.Find...)
+	}
+
+	return addType(tPeers, b), nil
+}
+
+type mFindNode struct {
+	Query     uint64
+	Target    dhtID
+	Providers bool
+}
+
+func (m mFindNode) Serialise() ([]byte, error) {
+	b := binary.BigEndian.AppendUint64(nil, m.Query)
+	b = append(b, m.Target[:]...)
+	if m.Providers {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	return addType(tFindNode, b), nil
+}
+
+type mNodes struct {
+	Query     uint64
+	Peers     []string // find strings
+	Providers []string
+}
+
+// --- Query [8]
+// then peers and providers, each
+// --- Count [1]
+// --- Find string length [2]
+// --- Find string
+func appendFinds(b []byte, finds []string) ([]byte, error) {
+	if len(finds) > 255 {
+		return nil, errors.New("too many find strings")
+	}
+
+	b = append(b, byte(len(finds)))
+	for _, f := range finds {
+		if len(f) > 1<<16-1 {
+			return nil, errors.New("find string too long")
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(f)))
+		b = append(b, f...)
+	}
+	return b, nil
+}
+
+func readFinds(b []byte) (finds []string, rest []byte, err error) {
+	if len(b) == 0 {
+		return nil, nil, errors.New("missing find string count")
+	}
+
+	finds, rest = make([]string, b[0]), b[1:]
+	for i := range finds {
+		if len(rest) < 2 {
+			return nil, nil, errors.New("find string too short")
+		}
+		fl := int(binary.BigEndian.Uint16(rest[:2]))
+		if len(rest) < 2+fl {
+			return nil, nil, errors.New("find string too short")
+		}
+		finds[i], rest = string(rest[2:2+fl]), rest[2+fl:]
+	}
+	return
+}
+
+func (m mNodes) Serialise() (b []byte, err error) {
+	b = binary.BigEndian.AppendUint64(nil, m.Query)
+	if b, err = appendFinds(b, m.Peers); err != nil {
+		return
+	}
+	if b, err = appendFinds(b, m.Providers); err != nil {
+		return
+	}
+	return addType(tNodes, b), nil
+}
+
+type mProvide struct {
+	Key  dhtID
+	Find string // of the sender, so the record can be given to others
+}
+
+func (m mProvide) Serialise() ([]byte, error) {
+	return addType(tProvide, append(m.Key[:], m.Find...)), nil
+}
+
+type mHave struct {
+	Hash [32]byte
+}
+
+func (m mHave) Serialise() ([]byte, error) {
+	return addType(tHave, m.Hash[:]), nil
+}
+
+// asks for a program's state when a transition doesn't start from ours, so we can catch up
+type mStateRequest struct {
+	Pk   keys.PK  // 29
+	Name string   // 1 + length
+	Root [32]byte // the state we want, which the receiver only sends if it's their current state
+}
+
+func (m mStateRequest) Serialise() ([]byte, error) {
+	nl := len(m.Name)
+	if nl > 255 {
+		return nil, errors.New("name too long")
+	}
+
+	b := make([]byte, 0, keys.PKSize+1+nl+32)
+	b = append(b, m.Pk[:]...)
+	b = append(b, byte(nl))
+	b = append(b, m.Name...)
+	b = append(b, m.Root[:]...)
+
+	return addType(tStateRequest, b), nil
+}
+
+type mStateData struct {
+	Pk   keys.PK // 29
+	Name string  // 1 + length
+	Data []byte  // the encoded state
+}
+
+func (m mStateData) Serialise() ([]byte, error) {
+	nl := len(m.Name)
+	if nl > 255 {
+		return nil, errors.New("name too long")
+	}
+
+	b := make([]byte, 0, keys.PKSize+1+nl+len(m.Data))
+	b = append(b, m.Pk[:]...)
+	b = append(b, byte(nl))
+	b = append(b, m.Name...)
+	b = append(b, m.Data...)
+
+	return addType(tStateData, b), nil
+}
+
 type AnyMsg struct {
 	From *keys.Peer
+	Time int64 // unix milliseconds, when it was sent
+	ID   msgID
 	Type MessageType
 	Body []byte
 }
@@ -132,6 +445,18 @@ func unmarshalInput(ptype ProgramType, rest []byte) (ProgramArgs, error) {
 			return nil, fmt.Errorf("decode web args: %w", err)
 		}
 		return tin, nil
+	case LibraryProgramType:
+		tin, err := DecodeArgs[LibraryArgs](rest)
+		if err != nil {
+			return nil, fmt.Errorf("decode library args: %w", err)
+		}
+		return tin, nil
+	case ScheduledProgramType:
+		tin, err := DecodeArgs[ScheduledArgs](rest)
+		if err != nil {
+			return nil, fmt.Errorf("decode scheduled args: %w", err)
+		}
+		return tin, nil
 	}
 	return nil, errors.New("unknown program args type")
 }
@@ -144,6 +469,18 @@ func unmarshalResult(ptype ProgramType, rest []byte) (ProgramRets, error) {
 			return nil, fmt.Errorf("unmarshal web result: %w", err)
 		}
 		return tres, nil
+	case LibraryProgramType:
+		tres, err := DecodeRets[LibraryRets](rest)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal library result: %w", err)
+		}
+		return tres, nil
+	case ScheduledProgramType:
+		tres, err := DecodeRets[ScheduledRets](rest)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal scheduled result: %w", err)
+		}
+		return tres, nil
 	}
 	return nil, errors.New("unknown program results type")
 }
@@ -151,57 +488,90 @@ func unmarshalResult(ptype ProgramType, rest []byte) (ProgramRets, error) {
 func (m AnyMsg) Deserialise() (SentMsg, error) {
 	switch m.Type {
 	case tHi:
-		return mHi{}, nil
+		return mHi{string(m.Body)}, nil
 	case tStore:
+		if len(m.Body) < 1 {
+			return nil, errors.New("store message too short")
+		}
+
 		nl, rest := m.Body[0], m.Body[1:]
-		if int(nl) > len(m.Body) || nl == 0 {
+		if nl == 0 {
 			return nil, errors.New("invalid name length")
 		}
 
+		if len(rest) < int(nl)+keys.PKSize+8+keys.HashSigLen {
+			return nil, errors.New("store message too short")
+		}
+
 		name, rest := rest[:nl], rest[nl:]
 		pk, rest := keys.PK(rest[:keys.PKSize]), rest[keys.PKSize:]
+		time, rest := int64(binary.BigEndian.Uint64(rest[:8])), rest[8:]
 		sig, rest := keys.HashSig(rest[:keys.HashSigLen]), rest[keys.HashSigLen:]
 		bundled := rest
 
-		return mStore{string(name), pk, sig, bundled}, nil
+		return mStore{string(name), pk, time, sig, bundled}, nil
 	case tStoreResult:
-		var hash [32]byte
-		copy(hash[:], m.Body)
-		return mStoreResult{hash}, nil
+		if len(m.Body) != 32 {
+			return nil, errors.New("store result is the wrong length")
+		}
+
+		return mStoreResult{[32]byte(m.Body)}, nil
 	case tRun:
-		ptype := ProgramType(m.Body[0])
+		if len(m.Body) < 1+keys.PKSize+1 {
+			return nil, errors.New("run message too short")
+		}
 
-		var pk keys.PK
-		copy(pk[:], m.Body[1:][:29])
-		nl, rest := m.Body[30], m.Body[31:]
-		if int(nl) > len(m.Body) || nl == 0 {
+		ptype := ProgramType(m.Body[0])
+		pk, rest := keys.PK(m.Body[1:][:keys.PKSize]), m.Body[1+keys.PKSize:]
+		nl, rest := int(rest[0]), rest[1:]
+		if nl == 0 || len(rest) < nl+1 {
 			return nil, errors.New("invalid name length")
 		}
 		name, rest := string(rest[:nl]), rest[nl:]
 
+		var call CallChain
+		cl, rest := int(rest[0]), rest[1:]
+		if len(rest) < 32*cl+8 {
+			return nil, errors.New("invalid call chain length")
+		}
+		for range cl {
+			call.Hashes = append(call.Hashes, [32]byte(rest[:32]))
+			rest = rest[32:]
+		}
+		if deadline := int64(binary.BigEndian.Uint64(rest[:8])); cl > 0 {
+			call.Deadline = time.UnixMilli(deadline)
+		}
+		rest = rest[8:]
+
 		in, err := unmarshalInput(ptype, rest)
 		if err != nil {
 			return nil, fmt.Errorf("unmarshal program args: %w", err)
 		}
 
-		return mRun{ptype, pk, name, in}, nil
+		return mRun{ptype, pk, name, call, in}, nil
 	case tRunResult:
-		ptype := ProgramType(m.Body[0])
+		if len(m.Body) < 1+keys.PKSize+1 {
+			return nil, errors.New("run result too short")
+		}
 
-		var pk keys.PK
-		copy(pk[:], m.Body[1:][:29])
-		nl, rest := m.Body[30], m.Body[31:]
-		if int(nl) > len(m.Body) || nl == 0 {
+		ptype := ProgramType(m.Body[0])
+		pk, rest := keys.PK(m.Body[1:][:keys.PKSize]), m.Body[1+keys.PKSize:]
+		nl, rest := int(rest[0]), rest[1:]
+		if nl == 0 || len(rest) < nl+32 {
 			return nil, errors.New("invalid name length")
 		}
 		name, rest := string(rest[:nl]), rest[nl:]
-
-		var inputhash [32]byte
-		copy(inputhash[:], rest[:32])
-		rest = rest[32:]
+		inputhash, rest := [32]byte(rest[:32]), rest[32:]
 
 		if len(rest) == 0 {
-			return mRunResult{ptype, pk, name, inputhash, nil}, nil
+			return mRunResult{ptype, pk, name, inputhash, nil, nil}, nil
+		}
+		if rest[0] == runResultErr {
+			if len(rest) < 2 {
+				return nil, errors.New("run error too short")
+			}
+			re := &RunError{Class: ErrorClass(rest[1]), Err: errors.New(string(rest[2:]))}
+			return mRunResult{ptype, pk, name, inputhash, nil, re}, nil
 		}
 
 		res, err := unmarshalResult(ptype, rest)
@@ -209,7 +579,153 @@ func (m AnyMsg) Deserialise() (SentMsg, error) {
 			return nil, fmt.Errorf("unmarshal program result: %w", err)
 		}
 
-		return mRunResult{ptype, pk, name, inputhash, &res}, nil
+		return mRunResult{ptype, pk, name, inputhash, &res, nil}, nil
+	case tScheduledResult:
+		if len(m.Body) < keys.PKSize+1 {
+			return nil, errors.New("scheduled result too short")
+		}
+
+		pk, rest := keys.PK(m.Body[:keys.PKSize]), m.Body[keys.PKSize:]
+		nl, rest := int(rest[0]), rest[1:]
+		if nl == 0 || len(rest) < nl+8 {
+			return nil, errors.New("invalid name length")
+		}
+		name, rest := string(rest[:nl]), rest[nl:]
+		tick, rest := int64(binary.BigEndian.Uint64(rest[:8])), rest[8:]
+
+		res, err := DecodeRets[ScheduledRets](rest)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal scheduled result: %w", err)
+		}
+
+		return mScheduledResult{pk, name, tick, res}, nil
+	case tState:
+		if len(m.Body) < keys.PKSize+1 {
+			return nil, errors.New("state too short")
+		}
+
+		pk, rest := keys.PK(m.Body[:keys.PKSize]), m.Body[keys.PKSize:]
+		nl, rest := int(rest[0]), rest[1:]
+		if nl == 0 || len(rest) < nl+32+32+1 {
+			return nil, errors.New("invalid name length")
+		}
+		name, rest := string(rest[:nl]), rest[nl:]
+		base, rest := [32]byte(rest[:32]), rest[32:]
+		root, rest := [32]byte(rest[:32]), rest[32:]
+		ptype, rest := ProgramType(rest[0]), rest[1:]
+
+		in, err := unmarshalInput(ptype, rest)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal program args: %w", err)
+		}
+
+		return mState{pk, name, base, root, in}, nil
+	case tVersion:
+		if len(m.Body) < keys.PKSize+1 {
+			return nil, errors.New("version too short")
+		}
+
+		pk, rest := keys.PK(m.Body[:keys.PKSize]), m.Body[keys.PKSize:]
+		nl, rest := int(rest[0]), rest[1:]
+		if nl == 0 || len(rest) != nl+32+8+keys.HashSigLen {
+			return nil, errors.New("invalid version length")
+		}
+		name, rest := string(rest[:nl]), rest[nl:]
+		hash, rest := rest[:32], rest[32:]
+
+		v := Version{
+			Hash:   hex.EncodeToString(hash),
+			Time:   int64(binary.BigEndian.Uint64(rest[:8])),
+			Signer: pk.EncodeNoPrefix(),
+			Sig:    rest[8:],
+		}
+		return mVersion{pk, name, v}, nil
+	case tPeers:
+		if len(m.Body) == 0 || int(m.Body[0]) > maxGossipPeers {
+			return nil, errors.New("invalid peer count")
+		}
+
+		ps := make([]gossipPeer, m.Body[0])
+		rest := m.Body[1:]
+		for i := range ps {
+			if len(rest) < 4+2 {
+				return nil, errors.New("peers message too short")
+			}
+			age, fl, r := binary.BigEndian.Uint32(rest[:4]), int(binary.BigEndian.Uint16(rest[4:6])), rest[6:]
+			if len(r) < fl {
+				return nil, errors.New("peers message too short")
+			}
+			ps[i], rest = gossipPeer{string(r[:fl]), age}, r[fl:]
+		}
+		if len(rest) != 0 {
+			return nil, errors.New("peers message too long")
+		}
+
+		return mPeers{ps}, nil
+	case tFindNode:
+		if len(m.Body) != 8+32+1 {
+			return nil, errors.New("invalid find node length")
+		}
+
+		return mFindNode{
+			binary.BigEndian.Uint64(m.Body[:8]),
+			dhtID(m.Body[8:40]),
+			m.Body[40] == 1,
+		}, nil
+	case tNodes:
+		if len(m.Body) < 8 {
+			return nil, errors.New("nodes message too short")
+		}
+
+		peers, rest, err := readFinds(m.Body[8:])
+		if err != nil {
+			return nil, err
+		}
+		provs, rest, err := readFinds(rest)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) != 0 {
+			return nil, errors.New("nodes message too long")
+		}
+
+		return mNodes{binary.BigEndian.Uint64(m.Body[:8]), peers, provs}, nil
+	case tProvide:
+		if len(m.Body) < 32 {
+			return nil, errors.New("provide message too short")
+		}
+
+		return mProvide{dhtID(m.Body[:32]), string(m.Body[32:])}, nil
+	case tHave:
+		if len(m.Body) != 32 {
+			return nil, errors.New("have message is the wrong length")
+		}
+
+		return mHave{[32]byte(m.Body)}, nil
+	case tStateRequest:
+		if len(m.Body) < keys.PKSize+1 {
+			return nil, errors.New("state request too short")
+		}
+
+		pk, rest := keys.PK(m.Body[:keys.PKSize]), m.Body[keys.PKSize:]
+		nl, rest := int(rest[0]), rest[1:]
+		if nl == 0 || len(rest) != nl+32 {
+			return nil, errors.New("invalid state request length")
+		}
+
+		return mStateRequest{pk, string(rest[:nl]), [32]byte(rest[nl:])}, nil
+	case tStateData:
+		if len(m.Body) < keys.PKSize+1 {
+			return nil, errors.New("state data too short")
+		}
+
+		pk, rest := keys.PK(m.Body[:keys.PKSize]), m.Body[keys.PKSize:]
+		nl, rest := int(rest[0]), rest[1:]
+		if nl == 0 || len(rest) < nl {
+			return nil, errors.New("invalid name length")
+		}
+
+		return mStateData{pk, string(rest[:nl]), rest[nl:]}, nil
 	}
 
 	return nil, errors.New("unknown message type")
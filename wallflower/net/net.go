@@ -7,8 +7,13 @@ type (
 		EncryptedMsg
 		*keys.Peer
 	}
+	// ReceivedMsg is a message from a peer, with the key the transport verified they connected with, or zero if it doesn't verify them
+	ReceivedMsg struct {
+		EncryptedMsg
+		From keys.PK
+	}
 	Sender   chan AddressedMsg
-	Receiver chan EncryptedMsg
+	Receiver chan ReceivedMsg
 )
 
 type Net interface {
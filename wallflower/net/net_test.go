@@ -1,10 +1,22 @@
 package net
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/rand"
+	"crypto/sha3"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	mrand "math/rand/v2"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"slices"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Heliodex/coputer/bundle"
 	. "github.com/Heliodex/coputer/litecode/types"
@@ -42,8 +54,8 @@ var webTests = [...]ProgramTest[WebArgs, WebRets]{
 		},
 		WebRets{
 			StatusCode: 200,
-			Headers: map[string]string{
-				"content-type": "text/plain; charset=utf-8",
+			Headers: Headers{
+				"content-type": {"text/plain; charset=utf-8"},
 			},
 			Body: []byte("hello GET / world! /"),
 		},
@@ -56,8 +68,8 @@ var webTests = [...]ProgramTest[WebArgs, WebRets]{
 		},
 		WebRets{
 			StatusCode: 200,
-			Headers: map[string]string{
-				"content-type": "text/plain; charset=utf-8",
+			Headers: Headers{
+				"content-type": {"text/plain; charset=utf-8"},
 			},
 			Body: []byte("hello POST /submit world! /submit?"),
 		},
@@ -70,8 +82,8 @@ var webTests = [...]ProgramTest[WebArgs, WebRets]{
 		},
 		WebRets{
 			StatusCode: 405,
-			Headers: map[string]string{
-				"content-type": "text/plain; charset=utf-8",
+			Headers: Headers{
+				"content-type": {"text/plain; charset=utf-8"},
 			},
 			Body: []byte(http.StatusText(405)),
 		},
@@ -84,8 +96,8 @@ var webTests = [...]ProgramTest[WebArgs, WebRets]{
 		},
 		WebRets{
 			StatusCode: 200,
-			Headers: map[string]string{
-				"content-type": "text/html; charset=utf-8",
+			Headers: Headers{
+				"content-type": {"text/html; charset=utf-8"},
 			},
 			Body: []byte("<h1>WELCOME TO MY WEBSITE</h1>"),
 		},
@@ -98,8 +110,8 @@ var webTests = [...]ProgramTest[WebArgs, WebRets]{
 		},
 		WebRets{
 			StatusCode: 200,
-			Headers: map[string]string{
-				"content-type": "text/html; charset=utf-8",
+			Headers: Headers{
+				"content-type": {"text/html; charset=utf-8"},
 			},
 			Body: []byte("<p>hello page</p>"),
 		},
@@ -112,8 +124,8 @@ var webTests = [...]ProgramTest[WebArgs, WebRets]{
 		},
 		WebRets{
 			StatusCode: 454,
-			Headers: map[string]string{
-				"content-type": "text/plain; charset=utf-8",
+			Headers: Headers{
+				"content-type": {"text/plain; charset=utf-8"},
 			},
 			Body: []byte("Error 454"),
 		},
@@ -126,8 +138,8 @@ var webTests = [...]ProgramTest[WebArgs, WebRets]{
 		},
 		WebRets{
 			StatusCode: 404,
-			Headers: map[string]string{
-				"content-type": "text/plain; charset=utf-8",
+			Headers: Headers{
+				"content-type": {"text/plain; charset=utf-8"},
 			},
 			Body: []byte(http.StatusText(404)),
 		},
@@ -259,6 +271,28 @@ Raw query: =b&=c`),
 	},
 }
 
+func libArgs(function string, vs ...Val) LibraryArgs {
+	args, err := NewLibraryArgs(function, vs...)
+	if err != nil {
+		panic(err)
+	}
+	return args
+}
+
+func libRets(vs ...Val) LibraryRets {
+	rets, err := SerialiseVals(vs...)
+	if err != nil {
+		panic(err)
+	}
+	return LibraryRets{Rets: rets}
+}
+
+var libraryTests = [...]ProgramTest[LibraryArgs, LibraryRets]{
+	{"library1", libArgs("add", 1.0, 2.0), libRets(3.0)},
+	{"library1", libArgs("greet", "world"), libRets("hello world", 5.0)},
+	{"library1", libArgs("sum", &Table{List: []Val{1.0, 2.0, 3.5}}), libRets(6.5)},
+}
+
 func getBundled(p string, t *testing.T) (b []byte) {
 	b, err := bundle.Bundle(p)
 	if err != nil {
@@ -307,7 +341,1119 @@ func getSampleAddress() (addr keys.Address) {
 	return
 }
 
+func TestLibraryMessage(t *testing.T) {
+	test := libraryTests[1]
+
+	call := CallChain{Hashes: [][32]byte{{1}, {2}}, Deadline: time.UnixMilli(1700000000000)}
+	b, err := mRun{LibraryProgramType, keys.PK{}, test.Name, call, test.Args}.Serialise()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := AnyMsg{Type: b[0], Body: b[1:]}.Deserialise()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run, ok := m.(mRun)
+	if !ok {
+		t.Fatalf("expected mRun, got %T", m)
+	}
+
+	in, ok := run.Input.(LibraryArgs)
+	if !ok || in.Function != "greet" || !slices.Equal(in.Args, test.Args.Args) {
+		t.Fatal("library args not equal", run.Input)
+	}
+	if !slices.Equal(run.Call.Hashes, call.Hashes) || !run.Call.Deadline.Equal(call.Deadline) {
+		t.Fatal("call chain not equal", run.Call)
+	}
+
+	rets := ProgramRets(test.Rets)
+	b, err = mRunResult{LibraryProgramType, keys.PK{}, test.Name, [32]byte{}, &rets, nil}.Serialise()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err = (AnyMsg{Type: b[0], Body: b[1:]}).Deserialise(); err != nil {
+		t.Fatal(err)
+	}
+
+	res := *m.(mRunResult).Result
+	if lres, ok := res.(LibraryRets); !ok || !slices.Equal(lres.Rets, test.Rets.Rets) {
+		t.Fatal("library rets not equal", res)
+	}
+}
+
+func TestRunErrorMessage(t *testing.T) {
+	re := runError(ClassifyError(ProgramError, errors.New("attempt to index nil")))
+
+	b, err := mRunResult{WebProgramType, keys.PK{}, "web1", [32]byte{}, nil, re}.Serialise()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := AnyMsg{Type: b[0], Body: b[1:]}.Deserialise()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := m.(mRunResult)
+	if res.Result != nil || res.Err == nil {
+		t.Fatal("expected error result", res)
+	}
+	if res.Err.Class != ProgramError || res.Err.Error() != "attempt to index nil" {
+		t.Fatal("run error not equal", res.Err.Class, res.Err)
+	}
+
+	// unclassified errors are the node's fault
+	if c := runError(errors.New("disk full")).Class; c != InfraError {
+		t.Fatal("expected infrastructure error, got", c)
+	}
+}
+
+func TestTruncatedMessages(t *testing.T) {
+	web, lib := webTests[0], libraryTests[1]
+	rets := ProgramRets(lib.Rets)
+	re := runError(ClassifyError(ProgramError, errors.New("attempt to index nil")))
+	call := CallChain{Hashes: [][32]byte{{1}}, Deadline: time.UnixMilli(1700000000000)}
+
+	// messages from peers can be cut off anywhere, and mustn't crash the node
+	for _, m := range []SentMsg{
+		mStore{"web1", keys.PK{1}, 1700000000000, keys.HashSig{2}, []byte("bundle")},
+		mStoreResult{[32]byte{3}},
+		mRun{LibraryProgramType, keys.PK{1}, lib.Name, call, lib.Args},
+		mRunResult{LibraryProgramType, keys.PK{1}, lib.Name, [32]byte{4}, &rets, nil},
+		mRunResult{WebProgramType, keys.PK{1}, "web1", [32]byte{4}, nil, re},
+		mScheduledResult{keys.PK{1}, "scheduled1", 1700000000, ScheduledRets{}},
+		mState{keys.PK{1}, "web1", [32]byte{5}, [32]byte{6}, web.Args},
+		mFindNode{7, dhtID{8}, true},
+		mHave{[32]byte{9}},
+		mStateRequest{keys.PK{1}, "web1", [32]byte{6}},
+		mStateData{keys.PK{1}, "web1", State{"count": []byte("3")}.Encode()},
+	} {
+		b, err := m.Serialise()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for l := range len(b) - 1 {
+			_, err := AnyMsg{Type: b[0], Body: b[1 : 1+l]}.Deserialise()
+			if l == 0 && err == nil {
+				t.Fatalf("expected empty %T to fail", m)
+			}
+		}
+	}
+}
+
+func TestVersionMessage(t *testing.T) {
+	n := NewNode(getSampleKeypair(), getSampleAddress())
+	b := []byte("not really a bundle")
+
+	v := n.SignVersion("web1", sha3.Sum256(b))
+	if !verifyVersion(n.Pk, "web1", v) {
+		t.Fatal("version signature invalid")
+	}
+	// signatures don't carry over to other names or keys
+	if verifyVersion(n.Pk, "web2", v) || verifyVersion(getSampleKeypair().Pk, "web1", v) {
+		t.Fatal("version signature valid for the wrong program")
+	}
+
+	s, err := mVersion{n.Pk, "web1", v}.Serialise()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := AnyMsg{Type: s[0], Body: s[1:]}.Deserialise()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mv := m.(mVersion)
+	if mv.Name != "web1" || mv.Version.Hash != v.Hash || mv.Version.Time != v.Time || !verifyVersion(mv.Pk, mv.Name, mv.Version) {
+		t.Fatal("version not equal", mv)
+	}
+
+	// stored programs carry their version
+	if s, err = (mStore{"web1", n.Pk, v.Time, keys.HashSig(v.Sig), b}).Serialise(); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = (AnyMsg{Type: s[0], Body: s[1:]}).Deserialise(); err != nil {
+		t.Fatal(err)
+	}
+
+	ms := m.(mStore)
+	if !verifyVersion(ms.Pk, ms.Name, ms.version()) {
+		t.Fatal("store version signature invalid")
+	}
+
+	ms.Bundled = []byte("a different bundle")
+	if verifyVersion(ms.Pk, ms.Name, ms.version()) {
+		t.Fatal("store version signature valid for a different bundle")
+	}
+}
+
+func TestScheduledResults(t *testing.T) {
+	n := NewNode(getSampleKeypair(), getSampleAddress())
+	peer := getSampleKeypair().Pk
+	n.Peers[peer] = &keys.Peer{Pk: peer}
+
+	pn := ProgramName{n.Pk, "scheduled1"}
+	const tick = 1700000100
+
+	// exactly one of the two nodes is authoritative
+	myRank := n.scheduleRank(pn, tick)
+	if myRank != 0 && myRank != 1 {
+		t.Fatal("invalid rank", myRank)
+	}
+
+	mine := ScheduledResult{tick, n.Pk, ScheduledRets{Body: []byte("mine")}}
+	theirs := ScheduledResult{tick, peer, ScheduledRets{Body: []byte("theirs")}}
+
+	if !n.storeScheduledResult(pn, mine) {
+		t.Fatal("first result for tick not stored")
+	}
+	// only replaced if the peer is better ranked
+	if stored := n.storeScheduledResult(pn, theirs); stored != (myRank == 1) {
+		t.Fatal("expected result from better-ranked node to be authoritative")
+	}
+
+	results := n.ScheduledResults(n.Pk, "scheduled1")
+	if len(results) != 1 {
+		t.Fatal("expected 1 result, got", len(results))
+	}
+	if authoritative := results[0].From == n.Pk; authoritative != (myRank == 0) {
+		t.Fatal("wrong authoritative result")
+	}
+
+	// older results are dropped
+	for i := range maxScheduledResults + 5 {
+		n.storeScheduledResult(pn, ScheduledResult{tick + int64(i+1)*300, n.Pk, ScheduledRets{}})
+	}
+	if results = n.ScheduledResults(n.Pk, "scheduled1"); len(results) != maxScheduledResults {
+		t.Fatal("expected results to be limited, got", len(results))
+	}
+	if n.storeScheduledResult(pn, ScheduledResult{tick - 300, n.Pk, ScheduledRets{}}) {
+		t.Fatal("expected result older than the limit not to be stored")
+	}
+	if results = n.ScheduledResults(n.Pk, "scheduled1"); len(results) != maxScheduledResults || results[0].Tick == tick-300 {
+		t.Fatal("expected old result to be dropped")
+	}
+
+	b, err := mScheduledResult{pn.Pk, pn.Name, tick, mine.Rets}.Serialise()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := AnyMsg{Type: b[0], Body: b[1:]}.Deserialise()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sm := m.(mScheduledResult); sm.Pk != pn.Pk || sm.Name != pn.Name || sm.Tick != tick || string(sm.Result.Body) != "mine" {
+		t.Fatal("scheduled result message not equal", sm)
+	}
+}
+
+func TestReceiveScheduledResult(t *testing.T) {
+	n := NewNode(getSampleKeypair(), getSampleAddress())
+	peer := &keys.Peer{Pk: getSampleKeypair().Pk}
+	n.Peers[peer.Pk] = peer
+
+	pn := ProgramName{n.Pk, "scheduled1"}
+	s, err := bundle.ParseSchedule("* * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Truncate(time.Minute)
+	due, future := now.Add(-5*time.Minute).Unix(), now.Add(5*time.Minute).Unix()
+
+	// a tick where the peer is ranked first
+	for n.scheduleFirst(pn, due) != peer.Pk {
+		due -= 60
+	}
+
+	receive := func(tick int64) {
+		n.receiveScheduledResult(peer, mScheduledResult{pn.Pk, pn.Name, tick, ScheduledRets{}})
+	}
+
+	// programs we don't run can't be checked
+	receive(due)
+	if n.hasScheduledResult(pn, due) {
+		t.Fatal("stored result for a program we don't schedule")
+	}
+
+	n.sched.programs[pn] = &scheduled{"* * * * *", s, s.Next(time.Now())}
+
+	receive(future)
+	if n.hasScheduledResult(pn, future) {
+		t.Fatal("stored result for a tick that hasn't come")
+	}
+	receive(due + 1)
+	if n.hasScheduledResult(pn, due+1) {
+		t.Fatal("stored result for a time that isn't a tick")
+	}
+	if n.rep.score(peer.Pk).Invalid != 2 {
+		t.Fatal("expected peer to be penalised for invalid ticks")
+	}
+
+	receive(due)
+	if !n.hasScheduledResult(pn, due) {
+		t.Fatal("result from the first-ranked node not stored")
+	}
+
+	// an old tick where we're ranked first, so the peer's result isn't trusted
+	mine := due - 60
+	for n.scheduleFirst(pn, mine) == peer.Pk {
+		mine -= 60
+	}
+	receive(mine)
+	if n.hasScheduledResult(pn, mine) {
+		t.Fatal("stored result from a node that wasn't ranked first")
+	}
+}
+
+func TestStateMessage(t *testing.T) {
+	n := NewNode(getSampleKeypair(), getSampleAddress())
+	pn := ProgramName{n.Pk, "counter"}
+
+	state := State{"count": []byte("3"), "name": []byte("coputer")}
+	base, root := State{}.Root(), state.Root()
+	input, err := DecodeArgs[WebArgs](webTests[0].Args.Encode()) // as it'd come from a request
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := mState{pn.Pk, pn.Name, base, root, input}.Serialise()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := AnyMsg{Type: b[0], Body: b[1:]}.Deserialise()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := m.(mState)
+	if sm.Pk != pn.Pk || sm.Name != pn.Name || sm.Base != base || sm.Root != root || InputHash(sm.Input) != InputHash(input) {
+		t.Fatal("state message not equal", sm)
+	}
+
+	// transitions without an input aren't accepted
+	short := b[:len(b)-len(input.Encode())-1]
+	if _, err = (AnyMsg{Type: short[0], Body: short[1:]}).Deserialise(); err == nil {
+		t.Fatal("expected state without input to fail")
+	}
+
+	// the same state isn't applied twice
+	if n.states.latest(pn, root) {
+		t.Fatal("expected state not to be seen before it's applied")
+	}
+	n.states.seen(pn, root)
+	if !n.states.latest(pn, root) {
+		t.Fatal("expected state to be seen once applied")
+	}
+
+	// states are only installed if we asked for them
+	n.states.want(pn, root)
+	if n.states.got(pn, base) || !n.states.got(pn, root) || n.states.got(pn, root) {
+		t.Fatal("expected only the state asked for to be installed, once")
+	}
+
+	for _, m := range []SentMsg{
+		mStateRequest{pn.Pk, pn.Name, root},
+		mStateData{pn.Pk, pn.Name, state.Encode()},
+	} {
+		b, err := m.Serialise()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dm, err := AnyMsg{Type: b[0], Body: b[1:]}.Deserialise()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(dm) != fmt.Sprint(m) {
+			t.Fatal("message not equal", dm, m)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	net := NewTestNet().(*TestNet)
+
+	n1 := NewNode(getSampleKeypair(), getSampleAddress())
+	n2 := NewNode(getSampleKeypair(), getSampleAddress())
+	net.AddNode(n2)
+	n2.Start()
+	defer n2.Stop()
+
+	to := &n2.Peer
+	now := time.Now()
+
+	deliver := func(at time.Time) EncryptedMsg {
+		ct, err := n1.seal(to, mHi{}, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		net.sendToReceiver(n2.MainAddr, n1.Pk, ct)
+		return ct
+	}
+
+	ct := deliver(now)
+	net.sendToReceiver(n2.MainAddr, n1.Pk, ct) // replayed
+	deliver(now.Add(-ReplayWindow - time.Minute))
+	deliver(now.Add(ReplayWindow + time.Minute))
+	deliver(now) // same time, different ID
+
+	want := ReplayStats{Replayed: 1, OutOfWindow: 2}
+	for range 100 {
+		if n2.ReplayStats() == want {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := n2.ReplayStats(); s != want {
+		t.Fatal("expected", want, "dropped, got", s)
+	}
+
+	// the window is per sender
+	r := newReplays()
+	id := msgID{1}
+	if r.check(n1.Pk, now.UnixMilli(), id, now) != nil || r.check(n2.Pk, now.UnixMilli(), id, now) != nil {
+		t.Fatal("expected message from each sender to be accepted")
+	}
+	if !errors.Is(r.check(n1.Pk, now.UnixMilli(), id, now), errReplayed) {
+		t.Fatal("expected replayed message to be dropped")
+	}
+
+	// IDs are forgotten once they leave the window, as the message would be dropped anyway
+	later := now.Add(ReplayWindow + time.Second)
+	r.check(n1.Pk, later.UnixMilli(), msgID{2}, later)
+	if len(r.seen[n1.Pk]) != 1 {
+		t.Fatal("expected old IDs to be forgotten, have", len(r.seen[n1.Pk]))
+	}
+	if !errors.Is(r.check(n1.Pk, now.UnixMilli(), id, later), errOutOfWindow) {
+		t.Fatal("expected old message to be dropped")
+	}
+}
+
+func TestConnectionSender(t *testing.T) {
+	net := NewTestNet().(*TestNet)
+
+	n1 := NewNode(getSampleKeypair(), getSampleAddress())
+	n2 := NewNode(getSampleKeypair(), getSampleAddress())
+	net.AddNode(n2)
+	n2.Start()
+	defer n2.Stop()
+
+	known := func() bool {
+		n2.peersMu.RLock()
+		defer n2.peersMu.RUnlock()
+		_, ok := n2.Peers[n1.Pk]
+		return ok
+	}
+	hi := func(conn keys.PK) {
+		ct, err := n1.seal(&n2.Peer, n1.hi(), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		net.sendToReceiver(n2.MainAddr, conn, ct)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// a peer passing on another's message can't have it taken as their own
+	hi(keys.PK{9})
+	if known() {
+		t.Fatal("expected message from another peer's connection to be dropped")
+	}
+
+	hi(n1.Pk)
+	if !known() {
+		t.Fatal("expected message from the sender's own connection to be accepted")
+	}
+}
+
+func TestGossip(t *testing.T) {
+	const count = 10
+	net := NewTestNet()
+
+	// each node joins knowing only one node that joined before it
+	nodes := make([]*Node, count)
+	for i := range nodes {
+		n := NewNode(getSampleKeypair(), getSampleAddress())
+		if i > 0 {
+			seed, err := PeerFromFindString(nodes[mrand.IntN(i)].FindString())
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.AddPeer(seed)
+		}
+		net.AddNode(n)
+		n.Start()
+		defer n.Stop()
+		nodes[i] = n
+	}
+
+	// every node knows every other, and can share them
+	converged := func() bool {
+		for _, n := range nodes {
+			shareable := 0
+			for _, p := range n.peerList() {
+				if p.Find != "" {
+					shareable++
+				}
+			}
+			if shareable != count-1 {
+				return false
+			}
+		}
+		return true
+	}
+
+	for round := range 20 {
+		time.Sleep(100 * time.Millisecond)
+		if converged() {
+			t.Log("Converged after", round, "gossip rounds")
+			break
+		}
+		for _, n := range nodes {
+			n.shareWithRandom()
+		}
+	}
+	if !converged() {
+		t.Fatal("network didn't converge")
+	}
+
+	// find strings can't be changed by whoever shares them
+	fs := nodes[1].FindString()
+	forged := fs[:len(fs)-2] + "AA"
+	if forged == fs {
+		forged = fs[:len(fs)-2] + "BB"
+	}
+	if _, err := PeerFromFindString(forged); err == nil {
+		t.Fatal("expected forged find string to fail")
+	}
+
+	// peers messages are limited
+	m := nodes[0].gossip(keys.PK{})
+	for len(m.Peers) <= maxGossipPeers {
+		m.Peers = append(m.Peers, m.Peers[0])
+	}
+	if _, err := m.Serialise(); err == nil {
+		t.Fatal("expected too many peers to fail")
+	}
+
+	b, err := nodes[0].gossip(keys.PK{}).Serialise()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm, err := AnyMsg{Type: b[0], Body: b[1:]}.Deserialise()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dm.(mPeers).Peers) != count {
+		t.Fatal("expected", count, "peers, got", len(dm.(mPeers).Peers))
+	}
+	b[1] = maxGossipPeers + 1
+	if _, err = (AnyMsg{Type: b[0], Body: b[1:]}).Deserialise(); err == nil {
+		t.Fatal("expected too many peers to fail")
+	}
+}
+
+func TestPeerLimit(t *testing.T) {
+	n := NewNode(getSampleKeypair(), getSampleAddress())
+	now := time.Now()
+
+	for i := range maxPeers {
+		pk := keys.PK{byte(i), byte(i >> 8), 1}
+		n.Peers[pk] = &keys.Peer{Pk: pk, LastSeen: now.Add(-time.Duration(i) * time.Second)}
+	}
+
+	// stale peers don't push out fresher ones
+	stale := &keys.Peer{Pk: keys.PK{2}, LastSeen: now.Add(-time.Hour)}
+	if n.learnPeer(stale, keys.PK{}) || len(n.Peers) != maxPeers {
+		t.Fatal("expected stale peer not to be learned")
+	}
+
+	fresh := &keys.Peer{Pk: keys.PK{3}, LastSeen: now}
+	if !n.learnPeer(fresh, keys.PK{}) || len(n.Peers) != maxPeers {
+		t.Fatal("expected fresh peer to replace the stalest")
+	}
+	if _, ok := n.Peers[keys.PK{byte(maxPeers - 1), byte((maxPeers - 1) >> 8), 1}]; ok {
+		t.Fatal("expected stalest peer to be forgotten")
+	}
+}
+
+func TestDHTSimulation(t *testing.T) {
+	// nodes need keys with proof of work, so hundreds of them would take too long to make. The DHT only needs peers' public keys, so it's simulated directly, with each find sent straight to the peer's DHT. TestDHT runs real nodes over TestNet.
+	const count = 300
+	r := mrand.New(mrand.NewPCG(1, 2)) // the same network every run
+
+	dhts := make(map[keys.PK]*dht, count)
+	var order []*dht
+	var finds atomic.Int64
+
+	find := func(from *dht) findFunc {
+		return func(p keys.Peer, target dhtID, providers bool) ([]keys.Peer, []keys.Peer, error) {
+			finds.Add(1)
+			to, ok := dhts[p.Pk]
+			if !ok {
+				return nil, nil, errDHTTimeout // left the network
+			}
+			to.add(from.me) // they've heard from us
+			c, ps := to.handleFind(target, providers)
+			return c, ps, nil
+		}
+	}
+	provide := func(d *dht, key dhtID) int {
+		return d.provide(key, find(d), func(p keys.Peer) error {
+			to, ok := dhts[p.Pk]
+			if !ok {
+				return errDHTTimeout
+			}
+			to.addProvider(key, d.me, time.Now())
+			return nil
+		})
+	}
+
+	// each node joins knowing one node that joined before it, and looks itself up
+	for i := range count {
+		var pk keys.PK
+		for j := range pk {
+			pk[j] = byte(r.Uint32())
+		}
+		d := newDHT(keys.Peer{Pk: pk, Find: "sim"})
+		dhts[pk] = d
+		order = append(order, d)
+
+		if i > 0 {
+			d.add(order[r.IntN(i)].me)
+			d.lookup(d.id, false, find(d))
+		}
+	}
+
+	// some programs are provided by some nodes
+	type program struct {
+		key dhtID
+		p   *dht
+	}
+	var programs []program
+	for i := range 20 {
+		d := order[r.IntN(count)]
+		key := nameKey(d.me.Pk, fmt.Sprint("program", i))
+		programs = append(programs, program{key, d})
+
+		if provide(d, key) == 0 {
+			t.Fatal("provider record not stored anywhere")
+		}
+	}
+
+	// every node can find them, asking far fewer peers than there are
+	lookupAll := func(from []*dht) (lookups int) {
+		for _, prog := range programs {
+			key, p := prog.key, prog.p
+			if _, ok := dhts[p.me.Pk]; !ok {
+				continue // its provider left
+			}
+			for range 10 {
+				d := from[r.IntN(len(from))]
+				if d == p {
+					continue
+				}
+
+				_, provs := d.lookup(key, true, find(d))
+				lookups++
+				if len(provs) != 1 || provs[0].Pk != p.me.Pk {
+					t.Fatal("expected to find provider, found", len(provs))
+				}
+			}
+		}
+		return
+	}
+
+	finds.Store(0)
+	lookups := lookupAll(order)
+	perLookup := float64(finds.Load()) / float64(lookups)
+	t.Logf("%.1f finds per lookup among %d nodes", perLookup, count)
+	if perLookup > count/10 {
+		t.Fatal("lookups ask too many peers")
+	}
+
+	// nodes leaving are forgotten, and once the providers left republish their records, as they do every dhtRepublish, lookups still succeed
+	for _, d := range order[:count/10] {
+		delete(dhts, d.me.Pk)
+	}
+	for _, prog := range programs {
+		if _, ok := dhts[prog.p.me.Pk]; ok && provide(prog.p, prog.key) == 0 {
+			t.Fatal("provider record not stored anywhere after churn")
+		}
+	}
+	lookupAll(order[count/10:])
+}
+
+func TestDHT(t *testing.T) {
+	const count = 16
+	net := NewTestNet()
+
+	nodes := make([]*Node, count)
+	for i := range nodes {
+		n := NewNode(getSampleKeypair(), getSampleAddress())
+		if i > 0 {
+			seed, err := PeerFromFindString(nodes[i-1].FindString())
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.AddPeer(seed)
+		}
+		net.AddNode(n)
+		n.Start()
+		nodes[i] = n
+	}
+	defer func() {
+		for _, n := range nodes {
+			if n.running.Load() { // some leave
+				n.Stop()
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond) // let gossip settle
+
+	hash := sha3.Sum256([]byte("bundle"))
+	provider := nodes[2]
+	provider.provide(provider.Pk, "web1", hash)
+
+	provs := nodes[count-1].FindProviders(provider.Pk, "web1")
+	if len(provs) != 1 || provs[0].Pk != provider.Pk {
+		t.Fatal("expected to find provider, found", len(provs))
+	}
+	if provs := nodes[count-1].FindProviders(provider.Pk, "web2"); len(provs) != 0 {
+		t.Fatal("expected no providers for another name, found", len(provs))
+	}
+
+	// the provider can be found from its bundle's hash too
+	_, provs = nodes[0].dht.lookup(hashKey(hash), true, nodes[0].peerFind)
+	if len(provs) != 1 || provs[0].Pk != provider.Pk {
+		t.Fatal("expected to find provider by hash, found", len(provs))
+	}
+
+	// provider records have to be from the provider
+	fake := nodes[5]
+	fake.receiveProvide(&nodes[4].Peer, mProvide{nameKey(provider.Pk, "web3"), fake.dht.me.Find})
+	if ps := fake.dht.providersOf(nameKey(provider.Pk, "web3"), time.Now()); len(ps) != 0 {
+		t.Fatal("expected provider record from someone else to be rejected")
+	}
+
+	// the nodes holding the record leave, and once the provider republishes, it can still be found
+	key := nameKey(provider.Pk, "web1")
+	holders := slices.Clone(nodes[1 : count-1])
+	slices.SortFunc(holders, func(a, b *Node) int {
+		return key.distCmp(peerID(a.Pk), peerID(b.Pk))
+	})
+	left := 0
+	for _, n := range holders {
+		if n != provider && left < dhtK/2 {
+			n.Stop()
+			left++
+		}
+	}
+	provider.dht.provide(key, provider.peerFind, provider.announcer(key)) // lookups wait out the nodes that left, so this takes a few dhtTimeouts
+
+	if provs := nodes[count-1].FindProviders(provider.Pk, "web1"); len(provs) != 1 || provs[0].Pk != provider.Pk {
+		t.Fatal("expected to find provider after churn, found", len(provs))
+	}
+
+	for _, m := range []SentMsg{
+		mFindNode{7, nameKey(provider.Pk, "web1"), true},
+		mNodes{7, []string{provider.dht.me.Find}, []string{nodes[1].dht.me.Find, nodes[3].dht.me.Find}},
+		mProvide{hash, provider.dht.me.Find},
+	} {
+		b, err := m.Serialise()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dm, err := AnyMsg{Type: b[0], Body: b[1:]}.Deserialise()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(dm) != fmt.Sprint(m) {
+			t.Fatal("message not equal", dm, m)
+		}
+	}
+}
+
+func TestResultWaiters(t *testing.T) {
+	n := NewNode(getSampleKeypair(), getSampleAddress())
+	h := InputName{keys.PK{1}, "web1", [32]byte{2}}
+	r := peerResult{keys.PK{3}, mRunResult{WebProgramType, h.Pk, h.Name, h.InputHash, nil, nil}}
+
+	// identical runs at the same time both get the result
+	ch1, stop1 := n.waitFor(h, 1)
+	ch2, stop2 := n.waitFor(h, 1)
+	if !n.resultReceived(r) || len(ch1) != 1 || len(ch2) != 1 {
+		t.Fatal("expected both runs to get the result")
+	}
+	<-ch1
+	<-ch2
+
+	stop1()
+	if !n.resultReceived(r) || len(ch1) != 0 || len(ch2) != 1 {
+		t.Fatal("expected only the run still waiting to get the result")
+	}
+
+	stop2()
+	if n.resultReceived(r) {
+		t.Fatal("expected no runs waiting")
+	}
+}
+
+func TestNestedRun(t *testing.T) {
+	net := NewTestNet()
+
+	// a asks b to run a program, which calls a library only c has
+	nodes := make([]*Node, 3)
+	for i := range nodes {
+		n := NewNode(getSampleKeypair(), getSampleAddress())
+		if i > 0 {
+			seed, err := PeerFromFindString(nodes[i-1].FindString())
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.AddPeer(seed)
+		}
+		net.AddNode(n)
+		n.Start()
+		nodes[i] = n
+	}
+	defer func() {
+		for _, n := range nodes {
+			n.Stop()
+		}
+	}()
+	time.Sleep(200 * time.Millisecond) // let gossip settle
+
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	owner := a.Pk
+	want := LibraryRets{Rets: []byte("sum")}
+
+	// the execution server is shared, so each node's runs are faked
+	b.startBundle = func(pk keys.PK, name string, _ ProgramArgs, call CallChain) (ProgramRets, *StateTransition, error) {
+		rets, _, err := b.RunLibraryProgramQuorum(pk, "maths", LibraryArgs{Function: "add"}, false, Quorum{}, call)
+		return rets, nil, err
+	}
+	c.startBundle = func(keys.PK, string, ProgramArgs, CallChain) (ProgramRets, *StateTransition, error) {
+		return want, nil, nil
+	}
+	b.provide(owner, "caller", sha3.Sum256([]byte("caller")))
+	c.provide(owner, "maths", sha3.Sum256([]byte("maths")))
+
+	done := make(chan error, 1)
+	go func() {
+		rets, err := a.RunLibraryProgram(owner, "caller", LibraryArgs{Function: "main"}, false)
+		if err == nil && !bytes.Equal(rets.Rets, want.Rets) {
+			err = fmt.Errorf("unexpected result %s", rets.Rets)
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("nested run didn't finish")
+	}
+}
+
 // signet lel
+func TestQuorum(t *testing.T) {
+	peers := make([]keys.Peer, 5)
+	for i := range peers {
+		peers[i].Pk[0] = byte(i + 1)
+	}
+
+	result := func(from int, body string) peerResult {
+		rets := ProgramRets(WebRets{StatusCode: 200, Body: []byte(body)})
+		return peerResult{peers[from].Pk, mRunResult{WebProgramType, keys.PK{}, "web1", [32]byte{}, &rets, nil}}
+	}
+	failure := func(from int, c ErrorClass, msg string) peerResult {
+		re, _ := errors.AsType[*RunError](ClassifyError(c, errors.New(msg)))
+		return peerResult{peers[from].Pk, mRunResult{WebProgramType, keys.PK{}, "web1", [32]byte{}, nil, re}}
+	}
+
+	// one liar out of three
+	tl := newTally(Quorum{M: 2, K: 3}, peers[:3])
+	if tl.add(result(0, "hello")) || tl.add(result(1, "goodbye")) {
+		t.Fatal("quorum decided too early")
+	}
+	if tl.add(result(1, "hello")) {
+		t.Fatal("second result from the same peer counted")
+	}
+	if tl.add(result(3, "goodbye")) {
+		t.Fatal("result from a peer we didn't ask counted")
+	}
+	if !tl.add(result(2, "hello")) {
+		t.Fatal("expected quorum to be reached")
+	}
+
+	res, err := tl.result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.(WebRets).Body) != "hello" {
+		t.Fatal("expected the majority result, got", res)
+	}
+	if rep := tl.report(); rep.Agreed != 2 || rep.Asked != 3 || len(rep.Dissent) != 1 || rep.Dissent[0] != peers[1].Pk {
+		t.Fatal("unexpected report", rep)
+	}
+
+	// everyone disagrees, so it's given up on before the last peer answers
+	td := newTally(Quorum{M: 3, K: 4}, peers[:4])
+	td.add(result(0, "a"))
+	td.add(result(1, "b"))
+	if !td.add(result(2, "c")) {
+		t.Fatal("expected quorum to be impossible")
+	}
+	if _, err = td.result(); err == nil || ErrorClassOf(err) != InfraError {
+		t.Fatal("expected disagreement error, got", err)
+	}
+
+	// program errors are results too, but infrastructure errors aren't
+	te := newTally(Quorum{M: 2, K: 3}, peers[:3])
+	te.add(failure(0, InfraError, "disk on fire"))
+	te.add(failure(1, ProgramError, "attempt to index nil"))
+	if !te.add(failure(2, ProgramError, "attempt to index nil")) {
+		t.Fatal("expected quorum to be reached")
+	}
+	if _, err = te.result(); ErrorClassOf(err) != ProgramError {
+		t.Fatal("expected program error, got", err)
+	}
+	if rep := te.report(); len(rep.Failed) != 1 || rep.Failed[0] != peers[0].Pk {
+		t.Fatal("unexpected report", rep)
+	}
+
+	// without a quorum, the first result is taken
+	tf := newTally(Quorum{M: 1, K: 5}, peers)
+	tf.add(failure(4, InfraError, "disk on fire"))
+	if !tf.add(result(3, "first")) {
+		t.Fatal("expected first result to be taken")
+	}
+}
+
+func TestReputation(t *testing.T) {
+	now := time.Now()
+	r := newReputation()
+	good, slow, liar := keys.PK{1}, keys.PK{2}, keys.PK{3}
+
+	for range 20 {
+		r.success(good, 10*time.Millisecond, now)
+		r.success(slow, time.Second, now)
+	}
+	r.failure(slow, now)
+	r.success(liar, time.Millisecond, now)
+	if s := r.score(keys.PK{4}).Score(); s != 0.5 {
+		t.Fatal("expected unknown peer to score 0.5, got", s)
+	}
+
+	// a few failures don't get a peer banned before it's been judged
+	for range minJudged - 2 {
+		if r.failure(liar, now) {
+			t.Fatal("peer banned too early")
+		}
+	}
+	if !r.disagreement(liar, now) || !r.banned(liar, now) {
+		t.Fatal("expected peer to be banned")
+	}
+
+	ranked := r.rank([]keys.Peer{{Pk: liar}, {Pk: slow}, {Pk: keys.PK{4}}, {Pk: good}}, now)
+	if len(ranked) != 3 || ranked[0].Pk != good || ranked[1].Pk != slow || ranked[2].Pk != (keys.PK{4}) {
+		t.Fatal("unexpected ranking", ranked)
+	}
+
+	// bans wear off, and the peer starts again
+	later := now.Add(BanDuration + time.Second)
+	if r.banned(liar, later) {
+		t.Fatal("expected ban to be over")
+	}
+	r.success(liar, time.Millisecond, later)
+	if s := r.score(liar); s.Successes != 1 || s.Failures != 0 || s.Disagreements != 0 {
+		t.Fatal("expected reputation to start again, got", s)
+	}
+
+	// banned peers' messages are dropped
+	net := NewTestNet().(*TestNet)
+	n1 := NewNode(getSampleKeypair(), getSampleAddress())
+	n2 := NewNode(getSampleKeypair(), getSampleAddress())
+	net.AddNode(n2)
+	n2.Start()
+	defer n2.Stop()
+
+	for range minJudged {
+		n2.rep.invalid(n1.Pk, time.Now())
+	}
+
+	known := func() bool {
+		n2.peersMu.RLock()
+		defer n2.peersMu.RUnlock()
+		_, ok := n2.Peers[n1.Pk]
+		return ok
+	}
+	hi := func() {
+		ct, err := n1.seal(&n2.Peer, n1.hi(), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		net.sendToReceiver(n2.MainAddr, n1.Pk, ct)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	hi()
+	if known() {
+		t.Fatal("expected banned peer's message to be dropped")
+	}
+
+	n2.ForgetPeer(n1.Pk)
+	hi()
+	if !known() {
+		t.Fatal("expected unbanned peer's message to be received")
+	}
+
+	// reputations are saved and loaded whole
+	var b bytes.Buffer
+	if err := n2.SaveReputations(&b); err != nil {
+		t.Fatal(err)
+	}
+	n3 := NewNode(getSampleKeypair(), getSampleAddress())
+	if err := n3.LoadReputations(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(n2.Reputations(), n3.Reputations()) {
+		t.Fatal("reputations didn't round trip", n2.Reputations(), n3.Reputations())
+	}
+}
+
+func TestReplication(t *testing.T) {
+	const count = 6
+	net := NewTestNet()
+
+	nodes := make([]*Node, count)
+	stored := make([]atomic.Bool, count) // the execution server is shared, so each node's store is faked
+	running := make([]bool, count)
+	for i := range nodes {
+		n := NewNode(getSampleKeypair(), getSampleAddress())
+		n.storeBundle = func(_ keys.PK, _ string, _ Version, b []byte) ([32]byte, error) {
+			stored[i].Store(true)
+			return sha3.Sum256(b), nil
+		}
+		if i > 0 {
+			seed, err := PeerFromFindString(nodes[i-1].FindString())
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.AddPeer(seed)
+		}
+		net.AddNode(n)
+		n.Start()
+		nodes[i], running[i] = n, true
+	}
+	defer func() {
+		for i, n := range nodes {
+			if running[i] {
+				n.Stop()
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond) // let gossip settle
+
+	owner, pinned := nodes[0], nodes[count-1]
+	owner.SetReplication("prog", Replication{Replicas: 3, Pinned: []keys.PK{pinned.Pk}})
+	if err := owner.StoreProgram("prog", []byte("bundle")); err != nil {
+		t.Fatal(err)
+	}
+
+	// holders are the peers that have confirmed they have the program
+	holders := func() (hs []int) {
+		for _, pk := range owner.Replicas()["prog"].Holders {
+			hs = append(hs, slices.IndexFunc(nodes, func(n *Node) bool { return n.Pk == pk }))
+		}
+		slices.Sort(hs)
+		return
+	}
+	replicated := func() []int {
+		for range 100 {
+			if hs := holders(); len(hs) == 3 && !slices.ContainsFunc(hs, func(i int) bool { return !running[i] }) {
+				return hs
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal("program wasn't replicated, held by", holders())
+		return nil
+	}
+
+	hs := replicated()
+	if !slices.Contains(hs, count-1) {
+		t.Fatal("expected pinned peer to have the program, held by", hs)
+	}
+	for _, i := range hs {
+		if !stored[i].Load() {
+			t.Fatal("peer", i, "confirmed a program it didn't store")
+		}
+	}
+
+	// the peers that aren't pinned leave, and the program is sent to others
+	var left []int
+	for _, i := range hs {
+		if i != count-1 {
+			nodes[i].Stop()
+			running[i] = false
+			left = append(left, i)
+		}
+	}
+	owner.replicate("prog")
+
+	hs = replicated()
+	if !slices.Contains(hs, count-1) {
+		t.Fatal("expected pinned peer to keep the program, held by", hs)
+	}
+	for _, i := range hs {
+		if slices.Contains(left, i) || !stored[i].Load() {
+			t.Fatal("unexpected holder", i, "of", hs)
+		}
+	}
+	if s := owner.rep.score(nodes[left[0]].Pk); s.Failures == 0 {
+		t.Fatal("expected peer that left to be recorded as failing")
+	}
+
+	// peers we didn't ask can't claim to have it
+	hash := sha3.Sum256([]byte("bundle"))
+	if owner.replicas.confirm(keys.PK{9}, hash, time.Now()) {
+		t.Fatal("expected unasked peer not to count")
+	}
+
+	// tracking the same program again, as when it's stored on startup, keeps its holders
+	owner.replicas.track(owner.replicas.programs["prog"].store, hash)
+	if len(holders()) != 3 {
+		t.Fatal("expected holders to be kept, held by", holders())
+	}
+
+	// replicas are saved and loaded whole
+	var b bytes.Buffer
+	if err := owner.SaveReplicas(&b); err != nil {
+		t.Fatal(err)
+	}
+	n := NewNode(getSampleKeypair(), getSampleAddress())
+	if err := n.LoadReplicas(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	sorted := func(s ReplicaStatus) ReplicaStatus {
+		s.Holders = slices.SortedFunc(slices.Values(s.Holders), func(a, b keys.PK) int { return bytes.Compare(a[:], b[:]) })
+		return s
+	}
+	if want, got := sorted(owner.Replicas()["prog"]), sorted(n.Replicas()["prog"]); fmt.Sprint(want) != fmt.Sprint(got) {
+		t.Fatal("replicas didn't round trip", want, got)
+	}
+	if p := n.replicas.programs["prog"]; p.store.Time != owner.replicas.programs["prog"].store.Time || p.store.Sig != owner.replicas.programs["prog"].store.Sig {
+		t.Fatal("stored version didn't round trip")
+	}
+}
+
 func TestWeb(t *testing.T) {
 	for _, test := range webTests {
 		b := getBundled(testProgramPath+"/"+test.Name, t)
@@ -325,8 +1471,7 @@ func TestWeb(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		sig := n1.Kp.Sk.SignHash(b)
-		if err = n1.StoreProgram(n1.Pk, test.Name, sig, b); err != nil {
+		if err = n1.StoreProgram(test.Name, b); err != nil {
 			t.Fatal(err)
 		}
 
@@ -351,3 +1496,44 @@ func TestWeb(t *testing.T) {
 		t.Log("Passed!\n")
 	}
 }
+
+func TestRelayWebStream(t *testing.T) {
+	rets := WebRets{StatusCode: 200, Headers: Headers{"content-type": {"text/csv"}}}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(rets.Head().Encode())
+		w.Write([]byte("n\n1\n"))
+		http.NewResponseController(w).Flush()
+
+		if r.URL.Path == "/fail" {
+			w.Header().Set(http.TrailerPrefix+WebStreamErrorTrailer, "program timed out")
+		}
+	}))
+	defer upstream.Close()
+
+	for path, errMsg := range map[string]string{"/ok": "", "/fail": "program timed out"} {
+		res, err := http.Get(upstream.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		RelayWebStream(rec, res)
+		res.Body.Close()
+
+		br := bufio.NewReader(rec.Body)
+		h, err := ReadWebHead(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.StatusCode != 200 || h.Headers.Get("content-type") != "text/csv" {
+			t.Fatal("head not relayed", h)
+		}
+		if body, _ := io.ReadAll(br); string(body) != "n\n1\n" {
+			t.Fatalf("expected body %q, got %q", "n\n1\n", body)
+		}
+		if got := rec.Result().Trailer.Get(WebStreamErrorTrailer); got != errMsg {
+			t.Fatalf("expected error trailer %q, got %q", errMsg, got)
+		}
+	}
+}
@@ -3,10 +3,15 @@ package net
 import (
 	"crypto/sha3"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	. "github.com/Heliodex/coputer/litecode/types"
@@ -16,7 +21,7 @@ import (
 const FindStart = "cofind:"
 
 func PeerFromFindString(find string) (p *keys.Peer, err error) {
-	if !strings.HasPrefix(find, FindStart) || find[56] != '.' {
+	if len(find) < 57 || !strings.HasPrefix(find, FindStart) || find[56] != '.' {
 		return nil, errors.New("not a valid find string")
 	}
 
@@ -27,21 +32,24 @@ func PeerFromFindString(find string) (p *keys.Peer, err error) {
 
 	rest := find[57:] // after the dot
 
-	decodedAddrs, err := base64.RawURLEncoding.DecodeString(rest)
+	decoded, err := base64.RawURLEncoding.DecodeString(rest)
 	if err != nil {
 		return
 	}
 
-	addrs, ok := pk.Verify(decodedAddrs)
-	if !ok {
-		return nil, errors.New("invalid addresses signature")
+	// signature, then addresses
+	if len(decoded) < keys.SigLen+keys.AddressLen || (len(decoded)-keys.SigLen)%keys.AddressLen != 0 {
+		if len(decoded)%keys.AddressLen == 0 {
+			return nil, errors.New("find string is in the old format, and has to be regenerated")
+		}
+		return nil, errors.New("invalid addresses part length")
 	}
 
-	addrsSize := len(addrs)
-	if addrsSize%keys.AddressLen != 0 {
-		return nil, errors.New("invalid addresses part length")
+	sig, addrs := keys.Sig(decoded[:keys.SigLen]), decoded[keys.SigLen:]
+	if !pk.Verify(findMessage(addrs), sig) {
+		return nil, errors.New("invalid addresses signature")
 	}
-	addrsCount := addrsSize / keys.AddressLen
+	addrsCount := len(addrs) / keys.AddressLen
 
 	mainAddr := keys.Address{}
 	copy(mainAddr[:], addrs[:keys.AddressLen]) // first address is always the main
@@ -51,22 +59,31 @@ func PeerFromFindString(find string) (p *keys.Peer, err error) {
 		copy(altAddrs[i][:], addrs[(i+1)*keys.AddressLen:][:keys.AddressLen])
 	}
 
-	return &keys.Peer{Pk: pk, MainAddr: mainAddr, AltAddrs: altAddrs}, nil
+	return &keys.Peer{Pk: pk, MainAddr: mainAddr, AltAddrs: altAddrs, Find: find}, nil
 }
 
-func (e EncryptedMsg) Decode(kp keys.Keypair) (am AnyMsg, err error) {
-	from, body, err := keys.Decrypt(kp, e)
+func (e EncryptedMsg) Decode(p keys.ThisPeer) (am AnyMsg, err error) {
+	from, body, err := p.Decrypt(e)
 	if err != nil {
 		return
+	} else if len(body) < msgHeaderLen+1 {
+		return AnyMsg{}, errors.New("message too short")
 	}
 
 	return AnyMsg{
 		From: &from,
-		Type: body[0],
-		Body: body[1:],
+		Time: int64(binary.BigEndian.Uint64(body[:8])),
+		ID:   msgID(body[8:msgHeaderLen]),
+		Type: body[msgHeaderLen],
+		Body: body[msgHeaderLen+1:],
 	}, nil
 }
 
+var errStopped = errors.New("node has stopped")
+
+// how long to wait for peers to run a program
+const peerRunTimeout = time.Minute
+
 // struct keys > nested maps
 type InputName struct {
 	Pk        keys.PK
@@ -78,10 +95,24 @@ type Node struct {
 	keys.ThisPeer
 
 	Peers              map[keys.PK]*keys.Peer // known peers
+	peersMu            sync.RWMutex
 	SendRaw            Sender
 	ReceiveRaw         Receiver
-	resultsWaitingName map[InputName]chan *ProgramRets
-	running            bool
+	resultsWaitingName map[InputName][]chan peerResult
+	waitingMu          sync.Mutex
+	quorums            quorums
+	sched              *scheduler
+	dht                *dht
+	states             *states
+	replays            *replays
+	rep                *reputation
+	replicas           *replicas
+	storeBundle        func(keys.PK, string, Version, []byte) ([32]byte, error)                             // stores programs on the execution server
+	startBundle        func(keys.PK, string, ProgramArgs, CallChain) (ProgramRets, *StateTransition, error) // runs programs on the execution server
+	running            atomic.Bool
+	stopMu             sync.RWMutex
+	stopped            bool
+	done               chan struct{} // closed when the node stops
 }
 
 func NewNode(kp keys.Keypair, mainAddr keys.Address, altAddrs ...keys.Address) (node *Node) {
@@ -91,16 +122,30 @@ func NewNode(kp keys.Keypair, mainAddr keys.Address, altAddrs ...keys.Address) (
 		AltAddrs: altAddrs,
 	}
 
-	return &Node{
+	node = &Node{
 		ThisPeer: keys.ThisPeer{
-			Peer: peer,
-			Kp:   kp,
+			Peer:     peer,
+			Kp:       kp,
+			Sessions: &keys.Sessions{},
 		},
 		Peers:              make(map[keys.PK]*keys.Peer),
 		SendRaw:            make(Sender),
 		ReceiveRaw:         make(Receiver),
-		resultsWaitingName: make(map[InputName]chan *ProgramRets),
+		resultsWaitingName: make(map[InputName][]chan peerResult),
+		quorums:            quorums{qs: make(map[ProgramName]Quorum)},
+		sched:              newScheduler(),
+		states:             newStates(),
+		replays:            newReplays(),
+		rep:                newReputation(),
+		replicas:           newReplicas(),
+		storeBundle:        StoreProgram,
+		startBundle:        StartProgram,
+		done:               make(chan struct{}),
 	}
+
+	peer.Find = node.FindString()
+	node.dht = newDHT(peer)
+	return
 }
 
 func (n *Node) AddPeer(p *keys.Peer) {
@@ -108,20 +153,57 @@ func (n *Node) AddPeer(p *keys.Peer) {
 		return
 	}
 
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
 	if _, ok := n.Peers[p.Pk]; !ok {
 		n.Peers[p.Pk] = p
+		n.dht.add(*p)
 	}
 }
 
-func (n *Node) send(p *keys.Peer, sm SentMsg) (err error) {
+// peerList returns the peers we know, so they can be sent to without holding the lock
+func (n *Node) peerList() []*keys.Peer {
+	n.peersMu.RLock()
+	defer n.peersMu.RUnlock()
+
+	return slices.Collect(maps.Values(n.Peers))
+}
+
+// seal encrypts a message to a peer, as sent at a time
+func (n *Node) seal(p *keys.Peer, sm SentMsg, t time.Time) (ct EncryptedMsg, err error) {
 	s, err := sm.Serialise()
 	if err != nil {
-		return fmt.Errorf("serialise message: %w", err)
+		return nil, fmt.Errorf("serialise message: %w", err)
 	}
 
-	ct, err := n.Encrypt(s, p.Pk)
+	h, err := msgHeader(t)
 	if err != nil {
-		return fmt.Errorf("encrypt message: %w", err)
+		return
+	}
+
+	if ct, err = n.Encrypt(append(h, s...), *p); err != nil {
+		return nil, fmt.Errorf("encrypt message: %w", err)
+	}
+	return
+}
+
+func (n *Node) send(p *keys.Peer, sm SentMsg) (err error) {
+	// the peer might be one we know, which is updated as we hear from them
+	n.peersMu.RLock()
+	cp := *p
+	n.peersMu.RUnlock()
+	p = &cp
+
+	ct, err := n.seal(p, sm, time.Now())
+	if err != nil {
+		return
+	}
+
+	n.stopMu.RLock()
+	defer n.stopMu.RUnlock()
+	if n.stopped {
+		return errStopped
 	}
 
 	n.SendRaw <- AddressedMsg{
@@ -131,8 +213,13 @@ func (n *Node) send(p *keys.Peer, sm SentMsg) (err error) {
 	return
 }
 
+// findMessage is what's signed in a find string, so the signature can't be used for anything else
+func findMessage(addrs []byte) []byte {
+	return append([]byte("coputer find\x00"), addrs...)
+}
+
 // A find string encodes the pk and addresses
-func (n Node) FindString() string {
+func (n *Node) FindString() string {
 	pk := n.Kp.Pk.Encode()[6:]
 
 	addrs := make([]byte, (len(n.AltAddrs)+1)*keys.AddressLen)
@@ -141,13 +228,13 @@ func (n Node) FindString() string {
 		copy(addrs[(i+1)*keys.AddressLen:], addr[:])
 	}
 
-	signedAddrs := n.Kp.Sk.Sign(addrs)                                // yes, actually works now
-	encodedAddrs := base64.RawURLEncoding.EncodeToString(signedAddrs) // we might do ipv6/libp2p/port enocding or smth later
+	sig := n.Kp.Sk.Sign(findMessage(addrs))
+	encodedAddrs := base64.RawURLEncoding.EncodeToString(append(sig[:], addrs...)) // we might do ipv6/libp2p/port enocding or smth later
 	return fmt.Sprintf("cofind:%s.%s", pk, encodedAddrs)
 }
 
 // unoptimised; debug
-func (n Node) log(msg ...any) {
+func (n *Node) log(msg ...any) {
 	pke := n.Kp.Pk.Encode()
 	logId := pke[6:][:2]
 
@@ -159,58 +246,77 @@ func (n *Node) handleMessage(am AnyMsg) {
 	dm, err := am.Deserialise()
 	if err != nil {
 		n.log("Failed to deserialise message\n", err)
+		n.penalise(am.From.Pk, n.rep.invalid)
 		return
 	}
 
 	switch m := dm.(type) {
 	case mHi:
 		n.log("Received hi message from peer\n", am.From.Pk.Encode(), "\n", am.From.MainAddr)
+		n.receiveHi(am.From, m)
+
+	case mPeers:
+		n.receivePeers(am.From, m)
+
+	case mFindNode:
+		n.receiveFindNode(am.From, m)
+
+	case mNodes:
+		if !n.dht.answer(m) {
+			n.log("Received DHT answer for unexpected query\n", m.Query)
+		}
+
+	case mProvide:
+		n.receiveProvide(am.From, m)
 
 	case mStore:
-		if !m.Pk.VerifyHash(m.Sig, m.Bundled) {
+		v := m.version()
+		if !verifyVersion(m.Pk, m.Name, v) {
 			n.log("Invalid program signature\n", m.Pk.Encode())
 			break
 		}
 
-		hash, err := StoreProgram(m.Pk, m.Name, m.Bundled)
+		hash, err := n.storeBundle(m.Pk, m.Name, v, m.Bundled)
 		if err != nil {
 			n.log("Failed to store program\n", err)
 			break
 		}
 
+		n.scheduleProgram(m.Pk, m.Name, m.Bundled)
+		go n.provide(m.Pk, m.Name, hash)
+
 		// show result was successful
 		res := mStoreResult{hash}
 		n.send(am.From, res)
 
 	case mStoreResult:
 		n.log("Program storage successful\n", "Hash: ", hex.EncodeToString(m.Hash[:]))
+		n.replicas.confirm(am.From.Pk, m.Hash, time.Now())
+
+	case mHave:
+		n.receiveHave(am.From, m)
 
 	case mRun:
-		n.log("Running program\n", "PK: ", m.Pk.Encode(), "\n", "Name: ", m.Name)
-
-		switch tin := m.Input.(type) {
-		case WebArgs:
-			// serialise
-			ret, err := StartWebProgram(m.Pk, m.Name, tin)
-			if err != nil {
-				n.log("Failed to run web program\n", err)
-				n.send(am.From, mRunResult{WebProgramType, m.Pk, m.Name, sha3.Sum256(tin.Encode()), nil})
-				break
-			}
+		// programs can call programs we ask peers to run, so waiting here would stop us receiving their results
+		go n.receiveRun(am.From, m)
 
-			// return result
-			pret := ProgramRets(ret)
-			n.send(am.From, mRunResult{WebProgramType, m.Pk, m.Name, sha3.Sum256(tin.Encode()), &pret})
+	case mScheduledResult:
+		n.receiveScheduledResult(am.From, m)
 
-		default:
-			n.log("Unknown program type\n", m.Input.Type())
-		}
+	case mState:
+		go n.receiveState(am.From, m)
+
+	case mStateRequest:
+		go n.receiveStateRequest(am.From, m)
+
+	case mStateData:
+		go n.receiveStateData(am.From, m)
+
+	case mVersion:
+		n.receiveVersion(m)
 
 	case mRunResult:
-		h := InputName{m.Pk, m.Name, m.InputHash}
-		if ch, ok := n.resultsWaitingName[h]; ok {
-			ch <- m.Result
-		} else {
+		if !n.resultReceived(peerResult{am.From.Pk, m}) {
 			n.log("Received name result for unexpected program\n", m.Result)
 		}
 
@@ -221,111 +327,254 @@ func (n *Node) handleMessage(am AnyMsg) {
 }
 
 func (n *Node) seenPeer(p *keys.Peer) {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	now := time.Now()
 	if _, ok := n.Peers[p.Pk]; !ok {
+		if !n.makeRoom(now) {
+			return
+		}
 		n.Peers[p.Pk] = p
 	}
-	n.Peers[p.Pk].LastSeen = time.Now()
+	n.Peers[p.Pk].LastSeen = now
+	n.dht.add(*n.Peers[p.Pk])
+
+	// they might have started a new session
+	if p.Session.Expires > n.Peers[p.Pk].Session.Expires {
+		n.Peers[p.Pk].Session = p.Session
+	}
 }
 
-func (n *Node) StoreProgram(pk keys.PK, name string, sig keys.HashSig, b []byte) (err error) {
-	if _, err = StoreProgram(pk, name, b); err != nil {
+// StoreProgram stores one of our programs, signing a new version of its name if it doesn't already point to the program, and sends it to enough peers to keep it replicated.
+func (n *Node) StoreProgram(name string, b []byte) (err error) {
+	v := n.versionFor(name, sha3.Sum256(b))
+	if _, err = n.storeBundle(n.Pk, name, v, b); err != nil {
 		return // maybe we can still continue if this happens
 	}
+	n.scheduleProgram(n.Pk, name, b)
+	n.provide(n.Pk, name, v.HashBytes())
 
-	m := mStore{name, pk, sig, b}
-	for _, peer := range n.Peers {
-		if err = n.send(peer, m); err != nil {
-			return
+	n.replicas.track(mStore{name, n.Pk, v.Time, keys.HashSig(v.Sig), b}, v.HashBytes())
+	n.replicate(name)
+	return
+}
+
+// resultReceived passes on a result from a peer, if we're waiting for it
+func (n *Node) resultReceived(r peerResult) bool {
+	n.waitingMu.Lock()
+	defer n.waitingMu.Unlock()
+
+	chs := n.resultsWaitingName[InputName{r.Pk, r.Name, r.InputHash}]
+	for _, ch := range chs {
+		select {
+		case ch <- r:
+		default: // every peer we asked has already answered, and more can't count
 		}
 	}
+	return len(chs) > 0
+}
 
-	return
+// waitFor starts passing on results of running a program with an input, until stop is called. Identical runs at the same time each get every result.
+func (n *Node) waitFor(h InputName, size int) (ch chan peerResult, stop func()) {
+	ch = make(chan peerResult, size) // late results mustn't block receiving
+	n.waitingMu.Lock()
+	n.resultsWaitingName[h] = append(n.resultsWaitingName[h], ch)
+	n.waitingMu.Unlock()
+
+	return ch, func() {
+		n.waitingMu.Lock()
+		defer n.waitingMu.Unlock()
+
+		chs := slices.DeleteFunc(n.resultsWaitingName[h], func(c chan peerResult) bool {
+			return c == ch
+		})
+		if len(chs) == 0 {
+			delete(n.resultsWaitingName, h)
+		} else {
+			n.resultsWaitingName[h] = chs
+		}
+	}
 }
 
-// we don't have the program; ask peers for it
-func (n *Node) peerRunName(pk keys.PK, name string, inputhash [32]byte, ptype ProgramType, input ProgramArgs) (ProgramRets, error) {
-	if len(n.Peers) == 0 {
-		return nil, errors.New("no peers to run program")
+// we don't have the program; ask peers that have it, until enough of them return the same result
+func (n *Node) peerRunName(pk keys.PK, name string, inputhash [32]byte, ptype ProgramType, input ProgramArgs, q Quorum, call CallChain) (ProgramRets, QuorumReport, error) {
+	if len(n.peerList()) == 0 {
+		return nil, QuorumReport{}, errors.New("no peers to run program")
 	}
 
-	h := InputName{pk, name, inputhash}
-	ch := make(chan *ProgramRets)
-	n.resultsWaitingName[h] = ch
+	provs := n.rep.rank(n.FindProviders(pk, name), time.Now())
+	if len(provs) == 0 {
+		return nil, QuorumReport{}, errors.New("no peers have the program")
+	}
+
+	if !q.Enabled() {
+		q = Quorum{M: 1, K: len(provs)} // the first to answer
+	} else if len(provs) < q.K {
+		err := fmt.Errorf("only %d peers have the program, quorum needs %d", len(provs), q.K)
+		return nil, QuorumReport{}, ClassifyError(InfraError, err)
+	}
+	provs = provs[:q.K]
 
-	for _, peer := range n.Peers {
-		if err := n.send(peer, mRun{ptype, pk, name, input}); err != nil {
-			return nil, err
+	ch, stop := n.waitFor(InputName{pk, name, inputhash}, len(provs))
+	defer stop()
+
+	for _, p := range provs {
+		if err := n.send(n.knownPeer(p), mRun{ptype, pk, name, call, input}); err != nil {
+			return nil, QuorumReport{}, err
 		}
 	}
 
-	for range n.Peers {
-		pres := <-ch
-		if pres == nil {
-			continue
+	t := newTally(q, provs)
+	start, latency := time.Now(), make(map[keys.PK]time.Duration)
+	wait := peerRunTimeout
+	if !call.Empty() {
+		wait = min(wait, time.Until(call.Deadline)) // the first caller's time limit applies to every call it makes
+	}
+	timeout := time.After(wait)
+	for done := false; !done; {
+		select {
+		case r := <-ch:
+			if _, ok := latency[r.From]; !ok {
+				latency[r.From] = time.Since(start)
+			}
+			done = t.add(r)
+		case <-timeout:
+			n.judge(t, latency, true)
+			return nil, t.report(), ClassifyError(InfraError, errors.New("peers didn't answer in time"))
 		}
-		delete(n.resultsWaitingName, h)
-		close(ch)
-		return *pres, nil
+	}
+	n.judge(t, latency, false)
+
+	rep := t.report()
+	for _, d := range rep.Dissent {
+		n.log("Peer returned a different result\n", "Peer: ", d.Encode(), "\n", "Name: ", name)
 	}
 
-	return nil, errors.New("no peers have the program")
+	res, err := t.result()
+	return res, rep, err
+}
+
+// receiveRun runs a program for a peer, sending them the result
+func (n *Node) receiveRun(from *keys.Peer, m mRun) {
+	n.log("Running program\n", "PK: ", m.Pk.Encode(), "\n", "Name: ", m.Name)
+
+	ptype, inputhash := m.Input.Type(), InputHash(m.Input)
+
+	ret, st, err := n.startBundle(m.Pk, m.Name, m.Input, m.Call)
+	if err != nil {
+		n.log("Failed to run program\n", err)
+		n.send(from, mRunResult{ptype, m.Pk, m.Name, inputhash, nil, runError(err)})
+		return
+	}
+
+	// return result
+	n.send(from, mRunResult{ptype, m.Pk, m.Name, inputhash, &ret, nil})
+	n.replicateState(m.Pk, m.Name, m.Input, st)
 }
 
 func (n *Node) receive() {
 	for {
-		rec := <-n.ReceiveRaw
-		if !n.running {
-			break
+		var rec ReceivedMsg
+		select {
+		case rec = <-n.ReceiveRaw:
+		case <-n.done:
+			return
 		}
 
-		msg, err := rec.Decode(n.Kp)
+		msg, err := rec.Decode(n.ThisPeer)
 		if err != nil {
 			n.log("Failed to decode message\n", err)
 			continue
 		}
 
+		// peers can only send messages as themselves
+		if rec.From != (keys.PK{}) && rec.From != msg.From.Pk {
+			n.log("Dropped message from another peer's connection\n", "From: ", msg.From.Pk.Encode(), "\n", "Connection: ", rec.From.Encode())
+			continue
+		}
+
+		if n.rep.banned(msg.From.Pk, time.Now()) {
+			continue
+		}
+
+		if err = n.replays.check(msg.From.Pk, msg.Time, msg.ID, time.Now()); err != nil {
+			n.log("Dropped message\n", err, "\n", "From: ", msg.From.Pk.Encode())
+			continue
+		}
+
 		n.seenPeer(msg.From)
 		n.handleMessage(msg)
 	}
 }
 
-func (n *Node) RunWebProgram(pk keys.PK, name string, input WebArgs, useLocal bool) (res WebRets, err error) {
-	if useLocal { // testing; to prevent 2 communication servers (from realising they're) using the same execution server
-		res, err = StartWebProgram(pk, name, input)
+// runProgram runs a program locally if possible, otherwise on peers. With a quorum, it's always run on peers.
+func runProgram[R ProgramRets](n *Node, pk keys.PK, name string, input ProgramArgs, useLocal bool, q Quorum, call CallChain) (res R, rep QuorumReport, err error) {
+	q = n.quorumFor(pk, name, q)
+	if useLocal && !q.Enabled() { // testing; to prevent 2 communication servers (from realising they're) using the same execution server
+		r, st, err := n.startBundle(pk, name, input, call)
 		if err == nil {
-			return // we have the program!
+			go n.replicateState(pk, name, input, st)
+			return r.(R), rep, nil // we have the program!
 		}
-		fmt.Println("Failed to run web program locally:", err)
+		if ErrorClassOf(err) == ProgramError {
+			return res, rep, err // it'd fail the same way on peers
+		}
+		fmt.Println("Failed to run program locally:", err)
 	}
 
-	r, err := n.peerRunName(pk, name, sha3.Sum256(input.Encode()), WebProgramType, input)
+	r, rep, err := n.peerRunName(pk, name, InputHash(input), input.Type(), input, q, call)
 	if err != nil {
 		return
 	}
 
-	if r.Type() != WebProgramType {
-		return WebRets{}, errors.New("invalid program type")
+	res, ok := r.(R)
+	if !ok {
+		return res, rep, errors.New("invalid program type")
 	}
+	return
+}
+
+func (n *Node) RunWebProgram(pk keys.PK, name string, input WebArgs, useLocal bool) (res WebRets, err error) {
+	res, _, err = runProgram[WebRets](n, pk, name, input, useLocal, Quorum{}, CallChain{})
+	return
+}
+
+func (n *Node) RunLibraryProgram(pk keys.PK, name string, input LibraryArgs, useLocal bool) (res LibraryRets, err error) {
+	res, _, err = runProgram[LibraryRets](n, pk, name, input, useLocal, Quorum{}, CallChain{})
+	return
+}
+
+// RunWebProgramQuorum runs a web program with a quorum, or the program's quorum if it's zero. The call chain is empty unless another program called it.
+func (n *Node) RunWebProgramQuorum(pk keys.PK, name string, input WebArgs, useLocal bool, q Quorum, call CallChain) (WebRets, QuorumReport, error) {
+	return runProgram[WebRets](n, pk, name, input, useLocal, q, call)
+}
 
-	return r.(WebRets), nil
+// RunLibraryProgramQuorum runs a library program with a quorum, or the program's quorum if it's zero. The call chain is empty unless another program called it.
+func (n *Node) RunLibraryProgramQuorum(pk keys.PK, name string, input LibraryArgs, useLocal bool, q Quorum, call CallChain) (LibraryRets, QuorumReport, error) {
+	return runProgram[LibraryRets](n, pk, name, input, useLocal, q, call)
 }
 
 func (n *Node) Start() {
 	pke := n.Kp.Pk.Encode()
-	n.running = true
+	n.running.Store(true)
 
 	n.log(
 		"Starting\n",
 		"I'm ", pke, "\n",
 		"My primary address is ", n.MainAddr, "\n",
-		"I know ", len(n.Peers), " peers")
+		"I know ", len(n.peerList()), " peers")
 
 	// Receiver
 	go n.receive()
+	go n.runScheduler()
+	go n.runGossip()
+	go n.runDHT()
+	go n.runReplication()
 
-	for _, peer := range n.Peers {
+	for _, peer := range n.peerList() {
 		n.log("Sending hi message to peer\n", peer.Pk.Encode())
-		if err := n.send(peer, mHi{}); err != nil {
+		if err := n.send(peer, n.hi()); err != nil {
 			n.log("Failed to send hi message to peer\n", err)
 		}
 	}
@@ -333,7 +582,13 @@ func (n *Node) Start() {
 
 func (n *Node) Stop() {
 	n.log("Stopping")
-	n.running = false
+	n.running.Store(false)
+
+	// wait for anything sending, so the sender isn't closed underneath it
+	n.stopMu.Lock()
+	n.stopped = true
 	close(n.SendRaw)
-	close(n.ReceiveRaw)
+	n.stopMu.Unlock()
+
+	close(n.done)
 }
@@ -0,0 +1,192 @@
+package net
+
+import (
+	"crypto/sha3"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/Heliodex/coputer/litecode/types"
+	"github.com/Heliodex/coputer/wallflower/keys"
+)
+
+// redundant execution
+// Programs are deterministic, so peers running the same program with the same input should return byte-identical results. With a quorum, a program is run on k peers, and a result is only accepted once m of them have returned it.
+
+// QuorumReport says how a program run on peers went.
+type QuorumReport struct {
+	Quorum  Quorum
+	Asked   int       // peers the program was run on
+	Agreed  int       // peers that returned the accepted result, or the most common one if none was accepted
+	Dissent []keys.PK // peers that returned a different result
+	Failed  []keys.PK // peers that failed to run the program
+}
+
+// Result returns how many peers agreed, of how many were asked, as sent in the quorum result header.
+func (r QuorumReport) Result() string {
+	return fmt.Sprintf("%d/%d", r.Agreed, r.Asked)
+}
+
+// peerResult is a result from a peer we asked to run a program
+type peerResult struct {
+	From keys.PK
+	mRunResult
+}
+
+// resultKey is what results are compared by. Program errors happen wherever a program is run, so they're compared too.
+func resultKey(m mRunResult) (key [32]byte, ok bool) {
+	switch {
+	case m.Result != nil:
+		return sha3.Sum256((*m.Result).Encode()), true
+	case ErrorClassOf(m.Err) == ProgramError:
+		return sha3.Sum256(append([]byte("coputer error\x00"), m.Err.Error()...)), true
+	}
+	return
+}
+
+// tally counts results from peers until a quorum is reached, or can't be
+type tally struct {
+	q        Quorum
+	asked    map[keys.PK]bool
+	answered map[keys.PK]bool
+	groups   map[[32]byte][]keys.PK
+	results  map[[32]byte]mRunResult
+	failed   []keys.PK
+	err      error // the last failure, if nothing can be accepted
+}
+
+func newTally(q Quorum, asked []keys.Peer) *tally {
+	t := &tally{
+		q:        q,
+		asked:    make(map[keys.PK]bool, len(asked)),
+		answered: make(map[keys.PK]bool, len(asked)),
+		groups:   make(map[[32]byte][]keys.PK),
+		results:  make(map[[32]byte]mRunResult),
+	}
+	for _, p := range asked {
+		t.asked[p.Pk] = true
+	}
+	return t
+}
+
+// add counts a result, returning whether the run is decided. Only the first result from each peer we asked counts.
+func (t *tally) add(r peerResult) (done bool) {
+	if !t.asked[r.From] || t.answered[r.From] {
+		return false
+	}
+	t.answered[r.From] = true
+
+	key, ok := resultKey(r.mRunResult)
+	if !ok {
+		t.failed = append(t.failed, r.From)
+		if r.Err != nil {
+			t.err = r.Err
+		}
+	} else {
+		t.groups[key] = append(t.groups[key], r.From)
+		t.results[key] = r.mRunResult
+	}
+
+	_, best := t.best()
+	return best >= t.q.M || best+len(t.asked)-len(t.answered) < t.q.M
+}
+
+// best returns the most common result
+func (t *tally) best() (key [32]byte, count int) {
+	for k, g := range t.groups {
+		if len(g) > count {
+			key, count = k, len(g)
+		}
+	}
+	return
+}
+
+func (t *tally) report() (rep QuorumReport) {
+	key, best := t.best()
+	rep = QuorumReport{t.q, len(t.asked), best, nil, t.failed}
+	for k, g := range t.groups {
+		if k != key {
+			rep.Dissent = append(rep.Dissent, g...)
+		}
+	}
+	return
+}
+
+// result returns the accepted result, or why none was
+func (t *tally) result() (ProgramRets, error) {
+	key, best := t.best()
+	if best < t.q.M {
+		switch {
+		case len(t.groups) > 1:
+			return nil, ClassifyError(InfraError, fmt.Errorf("peers disagreed: %d of %d returned the same result, %d needed", best, len(t.asked), t.q.M))
+		case t.err != nil && best == 0:
+			return nil, t.err
+		}
+		return nil, ClassifyError(InfraError, fmt.Errorf("only %d of %d peers returned a result, %d needed", best, len(t.asked), t.q.M))
+	}
+
+	m := t.results[key]
+	if m.Result == nil {
+		return nil, m.Err
+	}
+	return *m.Result, nil
+}
+
+// judge records how each peer we asked did. If no result was accepted, we can't tell which of the disagreeing peers are wrong.
+func (n *Node) judge(t *tally, latency map[keys.PK]time.Duration, timedOut bool) {
+	now := time.Now()
+	key, best := t.best()
+	undecided := best < t.q.M && len(t.groups) > 1
+
+	for k, g := range t.groups {
+		for _, pk := range g {
+			switch {
+			case undecided:
+			case k == key:
+				n.rep.success(pk, latency[pk], now)
+			default:
+				n.penalise(pk, n.rep.disagreement)
+			}
+		}
+	}
+	for _, pk := range t.failed {
+		n.penalise(pk, n.rep.failure)
+	}
+
+	if timedOut {
+		for pk := range t.asked {
+			if !t.answered[pk] {
+				n.penalise(pk, n.rep.failure)
+			}
+		}
+	}
+}
+
+// quorums are the quorums programs are run with by default
+type quorums struct {
+	mu sync.RWMutex
+	qs map[ProgramName]Quorum
+}
+
+// SetQuorum sets the quorum a program is run with when a request doesn't ask for one. A zero quorum runs it on the first peer that answers.
+func (n *Node) SetQuorum(pk keys.PK, name string, q Quorum) {
+	n.quorums.mu.Lock()
+	defer n.quorums.mu.Unlock()
+
+	if q == (Quorum{}) {
+		delete(n.quorums.qs, ProgramName{pk, name})
+		return
+	}
+	n.quorums.qs[ProgramName{pk, name}] = q
+}
+
+// quorumFor returns the quorum to run a program with, if a request didn't ask for one
+func (n *Node) quorumFor(pk keys.PK, name string, q Quorum) Quorum {
+	if q != (Quorum{}) {
+		return q
+	}
+
+	n.quorums.mu.RLock()
+	defer n.quorums.mu.RUnlock()
+	return n.quorums.qs[ProgramName{pk, name}]
+}
@@ -0,0 +1,100 @@
+package net
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Heliodex/coputer/wallflower/keys"
+)
+
+// replay protection
+// Every message starts with the time it was sent and a random ID. Messages sent too long ago (or too far in the future) are dropped, and the IDs of messages inside the window are remembered per sender, so a captured message can't be sent again.
+
+// --- Time [8] (unix milliseconds)
+// --- ID [8]
+// then the message type and body
+
+const (
+	ReplayWindow = 2 * time.Minute
+	msgHeaderLen = 8 + 8
+)
+
+type msgID [8]byte
+
+func msgHeader(t time.Time) (b []byte, err error) {
+	var id msgID
+	if _, err = rand.Read(id[:]); err != nil {
+		return
+	}
+
+	b = make([]byte, 0, msgHeaderLen)
+	b = binary.BigEndian.AppendUint64(b, uint64(t.UnixMilli()))
+	return append(b, id[:]...), nil
+}
+
+// ReplayStats counts messages dropped by replay protection.
+type ReplayStats struct {
+	Replayed    uint64 // already received
+	OutOfWindow uint64 // sent too long ago, or too far in the future
+}
+
+var (
+	errReplayed    = errors.New("message was already received")
+	errOutOfWindow = errors.New("message is outside the replay window")
+)
+
+type replays struct {
+	mu   sync.Mutex
+	seen map[keys.PK]map[msgID]int64 // message IDs in the window, with when they were sent
+
+	replayed, outOfWindow atomic.Uint64
+}
+
+func newReplays() *replays {
+	return &replays{seen: make(map[keys.PK]map[msgID]int64)}
+}
+
+// check records a message, returning an error if it should be dropped
+func (r *replays) check(from keys.PK, t int64, id msgID, now time.Time) error {
+	start, end := now.Add(-ReplayWindow).UnixMilli(), now.Add(ReplayWindow).UnixMilli()
+	if t < start || t > end {
+		r.outOfWindow.Add(1)
+		return errOutOfWindow
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen, ok := r.seen[from]
+	if !ok {
+		seen = make(map[msgID]int64)
+		r.seen[from] = seen
+	}
+
+	if _, ok := seen[id]; ok {
+		r.replayed.Add(1)
+		return errReplayed
+	}
+
+	// anything older has left the window, and would be dropped anyway
+	for sid, st := range seen {
+		if st < start {
+			delete(seen, sid)
+		}
+	}
+	seen[id] = t
+	return nil
+}
+
+func (r *replays) stats() ReplayStats {
+	return ReplayStats{r.replayed.Load(), r.outOfWindow.Load()}
+}
+
+// ReplayStats returns how many messages have been dropped by replay protection.
+func (n *Node) ReplayStats() ReplayStats {
+	return n.replays.stats()
+}
@@ -0,0 +1,401 @@
+package net
+
+import (
+	"crypto/sha3"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Heliodex/coputer/wallflower/keys"
+)
+
+// replicating our programs
+// Peers come and go, so a program sent to peers once may not be anywhere after a while. We keep track of which peers have confirmed they have each of our programs, ask them every so often whether they still do, and send the program to other peers when there aren't enough left.
+
+const (
+	// peers that should have each of our programs, unless their owner says otherwise
+	DefaultReplicas = 3
+	// how often we check peers still have our programs
+	ReplicationInterval = 10 * time.Minute
+	// how long to wait for peers to say they still have a program
+	replicaTimeout = 5 * time.Second
+)
+
+// Replication is how an owner wants one of their programs kept on the network.
+type Replication struct {
+	Replicas int       // peers that should have the program
+	Pinned   []keys.PK // peers that should always have it, counted towards Replicas
+}
+
+type replicated struct {
+	store   mStore // what's sent to peers to store it
+	hash    [32]byte
+	holders map[keys.PK]time.Time // peers that have said they have it, and when they last did
+	asked   map[keys.PK]bool      // peers we've sent it to, or asked whether they have it, that haven't answered
+	acked   chan struct{}
+}
+
+func newReplicated(m mStore, hash [32]byte) *replicated {
+	return &replicated{
+		store:   m,
+		hash:    hash,
+		holders: make(map[keys.PK]time.Time),
+		asked:   make(map[keys.PK]bool),
+		acked:   make(chan struct{}, 1),
+	}
+}
+
+type replicas struct {
+	mu       sync.Mutex
+	programs map[string]*replicated // our programs, by name
+	policies map[string]Replication // set by the owner, otherwise the default
+	wake     chan struct{}          // checks replicas early, when peers leave
+	checkMu  sync.Mutex             // so checks don't send programs to more peers than they need to
+}
+
+func newReplicas() *replicas {
+	return &replicas{
+		programs: make(map[string]*replicated),
+		policies: make(map[string]Replication),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func (r *replicas) policy(name string) Replication {
+	if p, ok := r.policies[name]; ok {
+		return p
+	}
+	return Replication{Replicas: DefaultReplicas}
+}
+
+// track starts replicating a version of one of our programs. Peers with an older version don't count, but peers with the version we're already replicating still do.
+func (r *replicas) track(m mStore, hash [32]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if p, ok := r.programs[m.Name]; ok && p.hash == hash {
+		p.store = m
+		return
+	}
+	r.programs[m.Name] = newReplicated(m, hash)
+}
+
+// ask records that we've sent a program to peers, or asked whether they have it, so their answers count
+func (r *replicas) ask(p *replicated, peers ...keys.PK) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, pk := range peers {
+		p.asked[pk] = true
+	}
+}
+
+// confirm records that a peer we asked has one of our programs, returning whether it counted. Peers can't make themselves holders by answering when they weren't asked.
+func (r *replicas) confirm(from keys.PK, hash [32]byte, now time.Time) (counted bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.programs {
+		if p.hash != hash || !p.asked[from] {
+			continue
+		}
+		delete(p.asked, from)
+		p.holders[from] = now
+		select {
+		case p.acked <- struct{}{}:
+		default:
+		}
+		counted = true
+	}
+	return
+}
+
+// wakeUp checks replicas soon, without waiting for the next interval
+func (r *replicas) wakeUp() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SetReplication sets how one of our programs is replicated.
+func (n *Node) SetReplication(name string, r Replication) {
+	n.replicas.mu.Lock()
+	n.replicas.policies[name] = r
+	n.replicas.mu.Unlock()
+
+	n.replicas.wakeUp()
+}
+
+// ReplicaStatus is how one of our programs is replicated, and which peers have it.
+type ReplicaStatus struct {
+	Replication
+	Hash    [32]byte
+	Holders []keys.PK
+}
+
+// Replicas returns how each of our programs is replicated.
+func (n *Node) Replicas() map[string]ReplicaStatus {
+	n.replicas.mu.Lock()
+	defer n.replicas.mu.Unlock()
+
+	status := make(map[string]ReplicaStatus, len(n.replicas.programs))
+	for name, p := range n.replicas.programs {
+		s := ReplicaStatus{n.replicas.policy(name), p.hash, nil}
+		for pk := range p.holders {
+			s.Holders = append(s.Holders, pk)
+		}
+		status[name] = s
+	}
+	return status
+}
+
+type savedReplicated struct {
+	Time    int64                `json:"time"`
+	Sig     []byte               `json:"sig"`
+	Bundled []byte               `json:"bundled"`
+	Holders map[string]time.Time `json:"holders"`
+}
+
+type savedReplication struct {
+	Replicas int      `json:"replicas"`
+	Pinned   []string `json:"pinned,omitempty"`
+}
+
+type savedReplicas struct {
+	Programs map[string]savedReplicated  `json:"programs"`
+	Policies map[string]savedReplication `json:"policies"`
+}
+
+// SaveReplicas writes our programs, which peers have them, and how they're replicated, as JSON.
+func (n *Node) SaveReplicas(w io.Writer) error {
+	n.replicas.mu.Lock()
+	saved := savedReplicas{
+		Programs: make(map[string]savedReplicated, len(n.replicas.programs)),
+		Policies: make(map[string]savedReplication, len(n.replicas.policies)),
+	}
+	for name, p := range n.replicas.programs {
+		sp := savedReplicated{p.store.Time, p.store.Sig[:], p.store.Bundled, make(map[string]time.Time, len(p.holders))}
+		for pk, t := range p.holders {
+			sp.Holders[pk.Encode()] = t
+		}
+		saved.Programs[name] = sp
+	}
+	for name, r := range n.replicas.policies {
+		sr := savedReplication{Replicas: r.Replicas}
+		for _, pk := range r.Pinned {
+			sr.Pinned = append(sr.Pinned, pk.Encode())
+		}
+		saved.Policies[name] = sr
+	}
+	n.replicas.mu.Unlock()
+
+	return json.NewEncoder(w).Encode(saved)
+}
+
+// LoadReplicas reads replicas written by SaveReplicas, replacing any we have for the same programs.
+func (n *Node) LoadReplicas(r io.Reader) error {
+	var saved savedReplicas
+	if err := json.NewDecoder(r).Decode(&saved); err != nil {
+		return fmt.Errorf("decode replicas: %w", err)
+	}
+
+	decode := func(pks string) (keys.PK, error) {
+		pk, err := keys.DecodePK(pks)
+		if err != nil {
+			return keys.PK{}, fmt.Errorf("decode public key: %w", err)
+		}
+		return pk, nil
+	}
+
+	programs := make(map[string]*replicated, len(saved.Programs))
+	for name, sp := range saved.Programs {
+		if len(sp.Sig) != keys.HashSigLen {
+			return fmt.Errorf("invalid signature for %s", name)
+		}
+
+		p := newReplicated(mStore{name, n.Pk, sp.Time, keys.HashSig(sp.Sig), sp.Bundled}, sha3.Sum256(sp.Bundled))
+		for pks, t := range sp.Holders {
+			pk, err := decode(pks)
+			if err != nil {
+				return err
+			}
+			p.holders[pk] = t
+		}
+		programs[name] = p
+	}
+
+	policies := make(map[string]Replication, len(saved.Policies))
+	for name, sr := range saved.Policies {
+		r := Replication{Replicas: sr.Replicas}
+		for _, pks := range sr.Pinned {
+			pk, err := decode(pks)
+			if err != nil {
+				return err
+			}
+			r.Pinned = append(r.Pinned, pk)
+		}
+		policies[name] = r
+	}
+
+	n.replicas.mu.Lock()
+	maps.Copy(n.replicas.programs, programs)
+	maps.Copy(n.replicas.policies, policies)
+	n.replicas.mu.Unlock()
+	return nil
+}
+
+// replicate checks which peers still have one of our programs, and sends it to more peers if there aren't enough
+func (n *Node) replicate(name string) {
+	n.replicas.checkMu.Lock()
+	defer n.replicas.checkMu.Unlock()
+
+	n.replicas.mu.Lock()
+	p, ok := n.replicas.programs[name]
+	if !ok {
+		n.replicas.mu.Unlock()
+		return
+	}
+	policy, store := n.replicas.policy(name), p.store
+	holders := slices.Collect(maps.Keys(p.holders))
+	n.replicas.mu.Unlock()
+
+	// ask everyone who had it whether they still do
+	start := time.Now()
+	n.replicas.ask(p, holders...)
+	for _, pk := range holders {
+		if peer, ok := n.peer(pk); ok {
+			if err := n.send(peer, mHave{p.hash}); err != nil {
+				n.log("Failed to send have message\n", err)
+			}
+		}
+	}
+	if len(holders) > 0 {
+		n.awaitReplicas(p, start, len(holders))
+	}
+
+	n.replicas.mu.Lock()
+	have := make(map[keys.PK]bool)
+	for pk, t := range p.holders {
+		if t.Before(start) {
+			delete(p.holders, pk)
+			n.log("Lost replica\n", "Name: ", name, "\n", "Peer: ", pk.Encode())
+			n.penalise(pk, n.rep.failure)
+			continue
+		}
+		have[pk] = true
+	}
+	n.replicas.mu.Unlock()
+
+	// pinned peers always get a copy, then the most reputable peers make up the rest
+	var send []*keys.Peer
+	for _, pk := range policy.Pinned {
+		if have[pk] {
+			continue
+		}
+		if peer, ok := n.peer(pk); ok {
+			send = append(send, peer)
+		} else {
+			n.log("Pinned peer isn't known\n", "Name: ", name, "\n", "Peer: ", pk.Encode())
+		}
+	}
+
+	if need := policy.Replicas - len(have) - len(send); need > 0 {
+		cands := n.replicaCandidates(holders, send)
+		for _, c := range cands[:min(need, len(cands))] {
+			send = append(send, n.knownPeer(c))
+		}
+	}
+
+	for _, peer := range send {
+		n.replicas.ask(p, peer.Pk)
+		if err := n.send(peer, store); err != nil {
+			n.log("Failed to send program\n", err)
+		}
+	}
+}
+
+// awaitReplicas waits for peers to confirm they have a program, until enough have since a time
+func (n *Node) awaitReplicas(p *replicated, since time.Time, count int) {
+	timeout := time.After(replicaTimeout)
+	for {
+		n.replicas.mu.Lock()
+		confirmed := 0
+		for _, t := range p.holders {
+			if !t.Before(since) {
+				confirmed++
+			}
+		}
+		n.replicas.mu.Unlock()
+		if confirmed >= count {
+			return
+		}
+
+		select {
+		case <-p.acked:
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// replicaCandidates returns recently seen peers that could be sent a program, best first. Peers that had it, even if they didn't answer, aren't sent it again until the next check.
+func (n *Node) replicaCandidates(had []keys.PK, sending []*keys.Peer) []keys.Peer {
+	now := time.Now()
+
+	n.peersMu.RLock()
+	var cands []keys.Peer
+	for _, peer := range n.Peers {
+		switch {
+		case slices.Contains(had, peer.Pk):
+		case slices.ContainsFunc(sending, func(s *keys.Peer) bool { return s.Pk == peer.Pk }):
+		case now.Sub(peer.LastSeen) < PeerFreshness:
+			cands = append(cands, *peer)
+		}
+	}
+	n.peersMu.RUnlock()
+
+	return n.rep.rank(cands, now)
+}
+
+// peer returns a peer we know
+func (n *Node) peer(pk keys.PK) (*keys.Peer, bool) {
+	n.peersMu.RLock()
+	defer n.peersMu.RUnlock()
+
+	p, ok := n.Peers[pk]
+	return p, ok
+}
+
+func (n *Node) receiveHave(from *keys.Peer, m mHave) {
+	if !n.dht.provides(hashKey(m.Hash)) {
+		return // they'll find out when we don't answer
+	}
+	if err := n.send(from, mStoreResult{m.Hash}); err != nil {
+		n.log("Failed to send store result\n", err)
+	}
+}
+
+// runReplication checks our programs are replicated every so often, or sooner when peers leave
+func (n *Node) runReplication() {
+	for n.running.Load() {
+		select {
+		case <-time.After(ReplicationInterval):
+		case <-n.replicas.wake:
+		case <-n.done:
+			return
+		}
+
+		n.replicas.mu.Lock()
+		names := slices.Collect(maps.Keys(n.replicas.programs))
+		n.replicas.mu.Unlock()
+
+		for _, name := range names {
+			n.replicate(name)
+		}
+	}
+}
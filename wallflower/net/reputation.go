@@ -0,0 +1,204 @@
+package net
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Heliodex/coputer/wallflower/keys"
+)
+
+// peer reputation
+// We remember how each peer has treated us: whether they answered, whether they ran programs, and whether their results agreed with other peers'. Programs are run on the most reputable peers first, and peers with bad enough reputations are banned for a while, so their messages are dropped and they aren't asked for anything.
+
+const (
+	// peers scoring below this are banned, once they've done enough to be judged
+	BanScore = 0.1
+	// how long a ban lasts, after which the peer starts again with a clean reputation
+	BanDuration = 24 * time.Hour
+	// how many things a peer has to have done before it can be banned
+	minJudged = 10
+	// a wrong result counts this many times as much as a failure, as it's either a lie or a bug
+	disagreementWeight = 10
+	// how much each new latency sample counts towards the average
+	latencyWeight = 0.2
+)
+
+// PeerScore is what we remember about a peer.
+type PeerScore struct {
+	Successes     uint64        `json:"successes"`     // answered, or ran a program
+	Failures      uint64        `json:"failures"`      // didn't answer, or failed to run a program
+	Disagreements uint64        `json:"disagreements"` // returned a result a quorum disagreed with
+	Invalid       uint64        `json:"invalid"`       // sent messages that couldn't be understood
+	Latency       time.Duration `json:"latency"`       // average time to answer
+	BannedUntil   time.Time     `json:"bannedUntil,omitzero"`
+}
+
+// judged is how many things a peer has done, weighted by how much they count
+func (s PeerScore) judged() uint64 {
+	return s.Successes + s.Failures + s.Invalid + disagreementWeight*s.Disagreements
+}
+
+// Score is between 0 and 1, starting at 0.5 for peers we know nothing about.
+func (s PeerScore) Score() float64 {
+	return float64(s.Successes+1) / float64(s.judged()+2)
+}
+
+// Banned reports whether the peer is banned at a time.
+func (s PeerScore) Banned(now time.Time) bool {
+	return now.Before(s.BannedUntil)
+}
+
+type reputation struct {
+	mu     sync.Mutex
+	scores map[keys.PK]*PeerScore
+}
+
+func newReputation() *reputation {
+	return &reputation{scores: make(map[keys.PK]*PeerScore)}
+}
+
+// update changes a peer's score, banning it if it's now bad enough. It returns whether the peer was just banned.
+func (r *reputation) update(pk keys.PK, now time.Time, f func(s *PeerScore)) (banned bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.scores[pk]
+	if !ok {
+		s = &PeerScore{}
+		r.scores[pk] = s
+	}
+	if !s.BannedUntil.IsZero() && !s.Banned(now) {
+		*s = PeerScore{} // the ban is over, so start again
+	}
+
+	f(s)
+	if !s.Banned(now) && s.judged() >= minJudged && s.Score() < BanScore {
+		s.BannedUntil = now.Add(BanDuration)
+		return true
+	}
+	return false
+}
+
+func (r *reputation) success(pk keys.PK, latency time.Duration, now time.Time) {
+	r.update(pk, now, func(s *PeerScore) {
+		s.Successes++
+		if s.Latency == 0 {
+			s.Latency = latency
+		} else {
+			s.Latency += time.Duration(latencyWeight * float64(latency-s.Latency))
+		}
+	})
+}
+
+func (r *reputation) failure(pk keys.PK, now time.Time) bool {
+	return r.update(pk, now, func(s *PeerScore) { s.Failures++ })
+}
+
+func (r *reputation) disagreement(pk keys.PK, now time.Time) bool {
+	return r.update(pk, now, func(s *PeerScore) { s.Disagreements++ })
+}
+
+func (r *reputation) invalid(pk keys.PK, now time.Time) bool {
+	return r.update(pk, now, func(s *PeerScore) { s.Invalid++ })
+}
+
+func (r *reputation) score(pk keys.PK) (s PeerScore) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if sp, ok := r.scores[pk]; ok {
+		s = *sp
+	}
+	return
+}
+
+func (r *reputation) banned(pk keys.PK, now time.Time) bool {
+	return r.score(pk).Banned(now)
+}
+
+// rank sorts peers best first, by score then latency, and leaves out banned peers
+func (r *reputation) rank(ps []keys.Peer, now time.Time) []keys.Peer {
+	scores := make(map[keys.PK]PeerScore, len(ps))
+	for _, p := range ps {
+		scores[p.Pk] = r.score(p.Pk)
+	}
+
+	ps = slices.DeleteFunc(ps, func(p keys.Peer) bool {
+		return scores[p.Pk].Banned(now)
+	})
+	slices.SortStableFunc(ps, func(a, b keys.Peer) int {
+		sa, sb := scores[a.Pk], scores[b.Pk]
+		if c := cmp.Compare(sb.Score(), sa.Score()); c != 0 {
+			return c
+		}
+		return cmp.Compare(sa.Latency, sb.Latency)
+	})
+	return ps
+}
+
+// forget clears a peer's reputation, which also lifts any ban
+func (r *reputation) forget(pk keys.PK) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.scores, pk)
+}
+
+// Reputations returns what we remember about each peer.
+func (n *Node) Reputations() map[keys.PK]PeerScore {
+	n.rep.mu.Lock()
+	defer n.rep.mu.Unlock()
+
+	scores := make(map[keys.PK]PeerScore, len(n.rep.scores))
+	for pk, s := range n.rep.scores {
+		scores[pk] = *s
+	}
+	return scores
+}
+
+// ForgetPeer clears a peer's reputation, unbanning it.
+func (n *Node) ForgetPeer(pk keys.PK) {
+	n.rep.forget(pk)
+}
+
+// SaveReputations writes peers' reputations, as JSON keyed by public key.
+func (n *Node) SaveReputations(w io.Writer) error {
+	scores := make(map[string]PeerScore)
+	for pk, s := range n.Reputations() {
+		scores[pk.Encode()] = s
+	}
+	return json.NewEncoder(w).Encode(scores)
+}
+
+// LoadReputations reads peers' reputations written by SaveReputations, replacing any we have for the same peers.
+func (n *Node) LoadReputations(r io.Reader) error {
+	var scores map[string]PeerScore
+	if err := json.NewDecoder(r).Decode(&scores); err != nil {
+		return fmt.Errorf("decode reputations: %w", err)
+	}
+
+	n.rep.mu.Lock()
+	defer n.rep.mu.Unlock()
+
+	for pks, s := range scores {
+		pk, err := keys.DecodePK(pks)
+		if err != nil {
+			return fmt.Errorf("decode public key: %w", err)
+		}
+		n.rep.scores[pk] = &s
+	}
+	return nil
+}
+
+// penalise records something bad a peer did, logging if they're banned for it
+func (n *Node) penalise(pk keys.PK, record func(keys.PK, time.Time) bool) {
+	if record(pk, time.Now()) {
+		n.log("Banned peer\n", pk.Encode())
+		n.replicas.wakeUp() // they might have had our programs
+	}
+}
@@ -0,0 +1,281 @@
+package net
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha3"
+	"encoding/binary"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Heliodex/coputer/bundle"
+	. "github.com/Heliodex/coputer/litecode/types"
+	"github.com/Heliodex/coputer/wallflower/keys"
+)
+
+// running scheduled programs
+// Every node with a scheduled program ranks itself and its peers for each tick. The best-ranked node runs the program and sends the result to its peers, and the others only run it if they haven't received a result after waiting their turn.
+
+const (
+	// how long each rank waits for better-ranked nodes to send a result
+	scheduleGrace = 10 * time.Second
+	// results kept per scheduled program
+	maxScheduledResults = 100
+)
+
+type ProgramName struct {
+	Pk   keys.PK
+	Name string
+}
+
+type scheduled struct {
+	Spec     string
+	schedule bundle.Schedule
+	Next     time.Time
+}
+
+// ScheduledResult is the authoritative result of a scheduled program for a tick.
+type ScheduledResult struct {
+	Tick int64
+	From keys.PK // node that ran the program
+	Rets ScheduledRets
+}
+
+type scheduler struct {
+	sync.Mutex
+	programs map[ProgramName]*scheduled
+	results  map[ProgramName][]ScheduledResult // sorted by tick
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		programs: make(map[ProgramName]*scheduled),
+		results:  make(map[ProgramName][]ScheduledResult),
+	}
+}
+
+// scheduleProgram starts scheduling a stored program, if its metadata declares a schedule
+func (n *Node) scheduleProgram(pk keys.PK, name string, bundled []byte) {
+	meta, err := bundle.MetaFromBundle(bundled)
+	if err != nil {
+		n.log("Failed to read program metadata\n", err)
+		return
+	}
+
+	pn := ProgramName{pk, name}
+
+	n.sched.Lock()
+	defer n.sched.Unlock()
+
+	if meta.Schedule == "" {
+		delete(n.sched.programs, pn) // name may have pointed to a scheduled program before
+		return
+	}
+
+	s, err := bundle.ParseSchedule(meta.Schedule)
+	if err != nil {
+		n.log("Invalid program schedule\n", err)
+		return
+	}
+
+	if old, ok := n.sched.programs[pn]; ok && old.Spec == meta.Schedule {
+		return
+	}
+	n.sched.programs[pn] = &scheduled{meta.Schedule, s, s.Next(time.Now())}
+}
+
+// scheduleScore orders nodes for a tick; the lowest score is authoritative
+func scheduleScore(node keys.PK, pn ProgramName, tick int64) [32]byte {
+	b := append(node[:], pn.Pk[:]...)
+	b = append(b, pn.Name...)
+	return sha3.Sum256(binary.BigEndian.AppendUint64(b, uint64(tick)))
+}
+
+// scheduleRank returns this node's rank for a tick among itself and its peers, starting at 0
+func (n *Node) scheduleRank(pn ProgramName, tick int64) (rank int) {
+	mine := scheduleScore(n.Kp.Pk, pn, tick)
+	for _, peer := range n.peerList() {
+		if score := scheduleScore(peer.Pk, pn, tick); bytes.Compare(score[:], mine[:]) < 0 {
+			rank++
+		}
+	}
+	return
+}
+
+// storeScheduledResult keeps a result if there isn't one for its tick yet, or if it's from a better-ranked node. Results older than every result kept aren't stored.
+func (n *Node) storeScheduledResult(pn ProgramName, res ScheduledResult) (stored bool) {
+	n.sched.Lock()
+	defer n.sched.Unlock()
+
+	results := n.sched.results[pn]
+	i, found := slices.BinarySearchFunc(results, res.Tick, func(r ScheduledResult, tick int64) int {
+		return cmp.Compare(r.Tick, tick)
+	})
+
+	if found {
+		old, new := scheduleScore(results[i].From, pn, res.Tick), scheduleScore(res.From, pn, res.Tick)
+		if bytes.Compare(new[:], old[:]) >= 0 {
+			return false
+		}
+		results[i] = res
+		return true
+	}
+
+	results = slices.Insert(results, i, res)
+	trim := max(len(results)-maxScheduledResults, 0)
+	n.sched.results[pn] = results[trim:]
+	return i >= trim
+}
+
+// scheduleFirst returns the node ranked first for a tick, among this node and its peers
+func (n *Node) scheduleFirst(pn ProgramName, tick int64) keys.PK {
+	first, best := n.Kp.Pk, scheduleScore(n.Kp.Pk, pn, tick)
+	for _, peer := range n.peerList() {
+		if score := scheduleScore(peer.Pk, pn, tick); bytes.Compare(score[:], best[:]) < 0 {
+			first, best = peer.Pk, score
+		}
+	}
+	return first
+}
+
+// receiveScheduledResult keeps a result from a peer, if it's for a tick of one of our scheduled programs that's come around. Results from the node ranked first for the tick are trusted; others are only kept for the latest tick, once running the program ourselves gives the same result.
+func (n *Node) receiveScheduledResult(from *keys.Peer, m mScheduledResult) {
+	pn := ProgramName{m.Pk, m.Name}
+	now := time.Now()
+
+	n.sched.Lock()
+	s, ok := n.sched.programs[pn]
+	var schedule bundle.Schedule
+	if ok {
+		schedule = s.schedule
+	}
+	n.sched.Unlock()
+	if !ok {
+		return // we don't run it, so we can't tell whether the tick is real
+	}
+
+	// results for ticks that haven't come yet would stop us running them, and push out real results
+	if due := schedule.Next(time.Unix(m.Tick-1, 0)); due.Unix() != m.Tick || due.After(now) {
+		n.log("Invalid scheduled result tick\n", "Name: ", m.Name, "\n", "Tick: ", m.Tick)
+		n.penalise(from.Pk, n.rep.invalid)
+		return
+	}
+
+	res := ScheduledResult{m.Tick, from.Pk, m.Result}
+	if n.scheduleFirst(pn, m.Tick) != from.Pk {
+		if schedule.Next(time.Unix(m.Tick, 0)).After(now) {
+			go n.verifyScheduledResult(pn, res)
+		}
+		return
+	}
+
+	if n.storeScheduledResult(pn, res) {
+		n.log("Received scheduled result\n", "Name: ", m.Name, "\n", "Tick: ", m.Tick)
+	}
+}
+
+// verifyScheduledResult runs a scheduled program to check a result from a node that wasn't ranked first, keeping ours instead if they differ
+func (n *Node) verifyScheduledResult(pn ProgramName, res ScheduledResult) {
+	if n.hasScheduledResult(pn, res.Tick) {
+		return
+	}
+
+	args := ScheduledArgs{Tick: res.Tick}
+	rets, st, err := startProgram[ScheduledRets]("scheduled", pn.Pk, pn.Name, args, CallChain{})
+	if err != nil {
+		n.log("Failed to run scheduled program\n", err)
+		return
+	}
+	go n.replicateState(pn.Pk, pn.Name, args, st)
+
+	if !bytes.Equal(rets.Encode(), res.Rets.Encode()) {
+		n.log("Peer returned a different scheduled result\n", "Peer: ", res.From.Encode(), "\n", "Name: ", pn.Name)
+		n.penalise(res.From, n.rep.disagreement)
+		res = ScheduledResult{res.Tick, n.Kp.Pk, rets}
+	}
+
+	if n.storeScheduledResult(pn, res) {
+		n.log("Verified scheduled result\n", "Name: ", pn.Name, "\n", "Tick: ", res.Tick)
+	}
+}
+
+func (n *Node) hasScheduledResult(pn ProgramName, tick int64) bool {
+	n.sched.Lock()
+	defer n.sched.Unlock()
+
+	return slices.ContainsFunc(n.sched.results[pn], func(r ScheduledResult) bool {
+		return r.Tick == tick
+	})
+}
+
+func (n *Node) runScheduled(pn ProgramName, tick int64) {
+	// give better-ranked nodes a chance first
+	if rank := n.scheduleRank(pn, tick); rank > 0 {
+		time.Sleep(time.Duration(rank) * scheduleGrace)
+		if !n.running.Load() || n.hasScheduledResult(pn, tick) {
+			return
+		}
+	}
+
+	n.log("Running scheduled program\n", "PK: ", pn.Pk.Encode(), "\n", "Name: ", pn.Name, "\n", "Tick: ", tick)
+
+	args := ScheduledArgs{Tick: tick}
+	rets, st, err := startProgram[ScheduledRets]("scheduled", pn.Pk, pn.Name, args, CallChain{})
+	if err != nil {
+		n.log("Failed to run scheduled program\n", err)
+		return
+	}
+	go n.replicateState(pn.Pk, pn.Name, args, st)
+
+	if !n.storeScheduledResult(pn, ScheduledResult{tick, n.Kp.Pk, rets}) || !n.running.Load() {
+		return
+	}
+
+	m := mScheduledResult{pn.Pk, pn.Name, tick, rets}
+	for _, peer := range n.peerList() {
+		if err := n.send(peer, m); err != nil {
+			n.log("Failed to send scheduled result\n", err)
+		}
+	}
+}
+
+// runScheduler triggers scheduled programs when their next tick comes around
+func (n *Node) runScheduler() {
+	for n.running.Load() {
+		now := time.Now()
+
+		n.sched.Lock()
+		for pn, s := range n.sched.programs {
+			if s.Next.IsZero() || now.Before(s.Next) {
+				continue
+			}
+
+			go n.runScheduled(pn, s.Next.Unix())
+			s.Next = s.schedule.Next(now)
+		}
+		n.sched.Unlock()
+
+		time.Sleep(time.Second)
+	}
+}
+
+// ScheduledPrograms returns the schedules of all programs this node runs.
+func (n *Node) ScheduledPrograms() map[ProgramName]string {
+	n.sched.Lock()
+	defer n.sched.Unlock()
+
+	specs := make(map[ProgramName]string, len(n.sched.programs))
+	for pn, s := range n.sched.programs {
+		specs[pn] = s.Spec
+	}
+	return specs
+}
+
+// ScheduledResults returns the stored results of a scheduled program, oldest first.
+func (n *Node) ScheduledResults(pk keys.PK, name string) []ScheduledResult {
+	n.sched.Lock()
+	defer n.sched.Unlock()
+
+	return slices.Clone(n.sched.results[ProgramName{pk, name}])
+}
@@ -0,0 +1,186 @@
+package net
+
+import (
+	"crypto/sha3"
+	"sync"
+
+	. "github.com/Heliodex/coputer/litecode/types"
+	"github.com/Heliodex/coputer/wallflower/keys"
+)
+
+// replicating the state of stateful programs
+// After a node runs a stateful program and the run changes the program's state, it sends its peers the transition: the state it ran on, the input, and the state it left. Peers on the same state apply it by running the program with the input themselves, so no peer can make a program's state whatever it likes.
+// Peers that have missed a transition can't apply the next, so they ask the sender for the state it left, and install it if it has the root the transition said.
+
+// states tracks the last state root each program was changed to, so a transition sent by several peers is only run once
+type states struct {
+	sync.Mutex
+	roots  map[ProgramName][32]byte
+	wanted map[ProgramName][32]byte // roots of states we've asked peers for
+	locks  map[ProgramName]*sync.Mutex
+}
+
+func newStates() *states {
+	return &states{
+		roots:  make(map[ProgramName][32]byte),
+		wanted: make(map[ProgramName][32]byte),
+		locks:  make(map[ProgramName]*sync.Mutex),
+	}
+}
+
+// latest reports whether a root is the last state a program was changed to
+func (s *states) latest(pn ProgramName, root [32]byte) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	old, ok := s.roots[pn]
+	return ok && old == root
+}
+
+// seen records a program's state root, once it's been changed to it
+func (s *states) seen(pn ProgramName, root [32]byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.roots[pn] = root
+}
+
+// want records that we've asked a peer for a program's state
+func (s *states) want(pn ProgramName, root [32]byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.wanted[pn] = root
+}
+
+// got reports whether we asked for a program's state with a root, forgetting that we did
+func (s *states) got(pn ProgramName, root [32]byte) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if want, ok := s.wanted[pn]; !ok || want != root {
+		return false
+	}
+	delete(s.wanted, pn)
+	return true
+}
+
+// lock stops other transitions of a program's state from being applied until unlocked
+func (s *states) lock(pn ProgramName) (unlock func()) {
+	s.Lock()
+	mu, ok := s.locks[pn]
+	if !ok {
+		mu = &sync.Mutex{}
+		s.locks[pn] = mu
+	}
+	s.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+// replicateState sends peers how a run changed a program's state, if it did
+func (n *Node) replicateState(pk keys.PK, name string, input ProgramArgs, st *StateTransition) {
+	if st == nil || !st.Changed() || !n.running.Load() {
+		return
+	}
+	n.states.seen(ProgramName{pk, name}, st.Root)
+
+	m := mState{pk, name, st.Base, st.Root, input}
+	for _, peer := range n.peerList() {
+		if err := n.send(peer, m); err != nil {
+			n.log("Failed to send program state\n", err)
+		}
+	}
+}
+
+// receiveState applies a state transition from a peer, if it starts from the state we have, by running the program with the same input and checking we get the same state. If it doesn't, we ask the peer for the state it left.
+func (n *Node) receiveState(from *keys.Peer, m mState) {
+	pn := ProgramName{m.Pk, m.Name}
+	if m.Base == m.Root || n.states.latest(pn, m.Root) {
+		return
+	}
+
+	unlock := n.states.lock(pn)
+	defer unlock()
+	if n.states.latest(pn, m.Root) {
+		return // applied while we waited
+	}
+
+	current, err := GetStateRoot(m.Pk, m.Name)
+	if err != nil {
+		n.log("Failed to get program state\n", err)
+		return
+	}
+
+	switch current {
+	case m.Root:
+		n.states.seen(pn, m.Root)
+		return
+	case m.Base:
+	default:
+		// we've missed a transition, or they have
+		if vs, err := GetVersions(m.Pk, m.Name); err != nil || len(vs) == 0 {
+			return // we don't have the program, so its state is no use to us
+		}
+
+		n.log("State transition doesn't start from our state, asking for theirs\n", "PK: ", m.Pk.Encode(), "\n", "Name: ", m.Name)
+		n.states.want(pn, m.Root)
+		if err := n.send(from, mStateRequest{m.Pk, m.Name, m.Root}); err != nil {
+			n.log("Failed to request program state\n", err)
+		}
+		return
+	}
+
+	_, st, err := n.startBundle(m.Pk, m.Name, m.Input, CallChain{})
+	switch {
+	case err != nil:
+		n.log("Failed to run program for state transition\n", err)
+	case st == nil:
+		n.log("State transition for a program that isn't stateful\n", "Peer: ", from.Pk.Encode())
+		n.penalise(from.Pk, n.rep.invalid)
+	case st.Base != m.Base:
+		// another run got there first, so we can't tell who's right
+		n.log("State changed while applying transition\n", "Name: ", m.Name)
+	case st.Root != m.Root:
+		n.log("Peer sent a state transition we didn't get\n", "Peer: ", from.Pk.Encode(), "\n", "Name: ", m.Name)
+		n.penalise(from.Pk, n.rep.disagreement)
+	default:
+		n.states.seen(pn, m.Root)
+		n.log("Applied program state\n", "PK: ", m.Pk.Encode(), "\n", "Name: ", m.Name)
+	}
+}
+
+// receiveStateRequest sends a peer a program's state, if it's still at the root they asked for
+func (n *Node) receiveStateRequest(from *keys.Peer, m mStateRequest) {
+	data, ok, err := GetState(m.Pk, m.Name)
+	if err != nil {
+		n.log("Failed to get program state\n", err)
+		return
+	} else if !ok || sha3.Sum256(data) != m.Root {
+		return // it's changed since, and they'll hear about that
+	}
+
+	if err = n.send(from, mStateData{m.Pk, m.Name, data}); err != nil {
+		n.log("Failed to send program state\n", err)
+	}
+}
+
+// receiveStateData installs a program's state from a peer, if it's one we asked for
+func (n *Node) receiveStateData(from *keys.Peer, m mStateData) {
+	pn, root := ProgramName{m.Pk, m.Name}, sha3.Sum256(m.Data)
+	if !n.states.got(pn, root) {
+		n.log("Received program state we didn't ask for\n", "Peer: ", from.Pk.Encode(), "\n", "Name: ", m.Name)
+		return
+	}
+
+	unlock := n.states.lock(pn)
+	defer unlock()
+
+	if err := PutState(m.Pk, m.Name, root, m.Data); err != nil {
+		n.log("Failed to install program state\n", err)
+		return
+	}
+	n.states.seen(pn, root)
+	n.log("Installed program state\n", "PK: ", m.Pk.Encode(), "\n", "Name: ", m.Name)
+}
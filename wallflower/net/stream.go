@@ -0,0 +1,73 @@
+package net
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	. "github.com/Heliodex/coputer/litecode/types"
+	"github.com/Heliodex/coputer/wallflower/keys"
+)
+
+// streaming web program responses
+// Only programs run on our own execution server are streamed as they're written. Results from peers arrive whole, and are sent in the same format.
+
+// RelayWebStream sends a streamed web response on, flushing each chunk as it arrives.
+func RelayWebStream(w http.ResponseWriter, res *http.Response) {
+	w.Header().Set("Content-Type", WebStreamContentType)
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n])
+			rc.Flush()
+		}
+		if err != nil {
+			// the trailer is only available once the body has been read
+			if msg := res.Trailer.Get(WebStreamErrorTrailer); msg != "" {
+				w.Header().Set(http.TrailerPrefix+WebStreamErrorTrailer, msg)
+			} else if !errors.Is(err, io.EOF) {
+				w.Header().Set(http.TrailerPrefix+WebStreamErrorTrailer, err.Error())
+			}
+			return
+		}
+	}
+}
+
+// StreamWebProgram runs a web program and writes its response to w in the streamed format. Errors are only returned if nothing has been written yet. With a quorum, results have to be compared whole, so nothing is streamed.
+func (n *Node) StreamWebProgram(w http.ResponseWriter, pk keys.PK, name string, input WebArgs, q Quorum) error {
+	if q = n.quorumFor(pk, name, q); !q.Enabled() {
+		res, err := StartWebStream(pk, name, input)
+		if err == nil {
+			defer res.Body.Close()
+
+			RelayWebStream(w, res)
+			// streamed runs send their state transition as trailers
+			if st, ok := StateTransitionFrom(res.Header, res.Trailer); ok {
+				go n.replicateState(pk, name, input, &st)
+			}
+			return nil
+		}
+		if ErrorClassOf(err) == ProgramError {
+			return err // it'd fail the same way on peers
+		}
+		n.log("Failed to stream program locally\n", err)
+	}
+
+	rets, rep, err := n.RunWebProgramQuorum(pk, name, input, false, q, CallChain{})
+	if q.Enabled() {
+		w.Header().Set(QuorumResultHeader, rep.Result())
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", WebStreamContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(rets.Head().Encode())
+	w.Write(rets.Body)
+	return nil
+}
@@ -1,8 +1,13 @@
 package net
 
-import "github.com/Heliodex/coputer/wallflower/keys"
+import (
+	"sync"
+
+	"github.com/Heliodex/coputer/wallflower/keys"
+)
 
 type TestNet struct {
+	mu    sync.Mutex
 	peers map[keys.Address]*Node // known peers
 }
 
@@ -12,24 +17,37 @@ func NewTestNet() Net {
 	}
 }
 
-func (n *TestNet) sendToReceiver(addr keys.Address, msg EncryptedMsg) {
-	if node, ok := n.peers[addr]; ok {
-		node.ReceiveRaw <- msg
+func (n *TestNet) sendToReceiver(addr keys.Address, from keys.PK, msg EncryptedMsg) {
+	n.mu.Lock()
+	node, ok := n.peers[addr]
+	n.mu.Unlock()
+	if !ok {
+		return
 	}
+
+	// nodes send replies while receiving, so two nodes replying to each other would block each other
+	go func() {
+		select {
+		case node.ReceiveRaw <- ReceivedMsg{msg, from}:
+		case <-node.done: // the node has stopped
+		}
+	}()
 }
 
-func (n *TestNet) receiveFromSender(s Sender) {
+func (n *TestNet) receiveFromSender(from keys.PK, s Sender) {
 	for msg := range s {
 		addr := msg.Peer.MainAddr // TestNet only uses main addresses
-		n.sendToReceiver(addr, msg.EncryptedMsg)
+		n.sendToReceiver(addr, from, msg.EncryptedMsg)
 	}
 }
 
 func (n *TestNet) AddNode(node *Node) {
+	n.mu.Lock()
 	n.peers[node.MainAddr] = node
 	for _, addr := range node.AltAddrs {
 		n.peers[addr] = node
 	}
+	n.mu.Unlock()
 
-	go n.receiveFromSender(node.SendRaw)
+	go n.receiveFromSender(node.Pk, node.SendRaw)
 }
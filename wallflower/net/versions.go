@@ -0,0 +1,94 @@
+package net
+
+import (
+	"encoding/hex"
+	"time"
+
+	. "github.com/Heliodex/coputer/litecode/types"
+	"github.com/Heliodex/coputer/wallflower/keys"
+)
+
+// signed versions of program names
+// Each time a name is pointed to a program, its owner signs a version with the program's hash and the time. Peers keep every version they're sent, and point the name to the latest one.
+
+// SignVersion signs a version of one of our program names, at the current time.
+func (n *Node) SignVersion(name string, hash [32]byte) Version {
+	return SignVersion(n.Kp, name, hash)
+}
+
+// SignVersion signs a version of a program name, at the current time. Execution servers only store programs with a version signed by the program's owner.
+func SignVersion(kp keys.Keypair, name string, hash [32]byte) Version {
+	pk, t := kp.Pk.EncodeNoPrefix(), time.Now().UnixMilli()
+	sig := kp.Sk.SignHash(VersionMessage(pk, name, hash, t))
+
+	return Version{
+		Hash:   hex.EncodeToString(hash[:]),
+		Time:   t,
+		Signer: pk,
+		Sig:    sig[:],
+	}
+}
+
+// versionFor returns the version one of our program names should point to a program with. If the name already points to it, as after a restart, its current version is reused rather than signing a new one.
+func (n *Node) versionFor(name string, hash [32]byte) Version {
+	if vs, err := GetVersions(n.Pk, name); err == nil && len(vs) > 0 {
+		if v := vs[len(vs)-1]; v.Hash == hex.EncodeToString(hash[:]) {
+			return v
+		}
+	}
+	return n.SignVersion(name, hash)
+}
+
+// verifyVersion checks a version of a program name was signed by its owner
+func verifyVersion(pk keys.PK, name string, v Version) bool {
+	return v.Verify(pk.EncodeNoPrefix(), name) == nil
+}
+
+// Rollback points one of our program names back to a program from its history, and tells peers to do the same.
+func (n *Node) Rollback(name string, hash [32]byte) (err error) {
+	v := n.SignVersion(name, hash)
+	if err = RollbackProgram(n.Pk, name, v); err != nil {
+		return
+	}
+
+	if b, err := GetVersionBundle(n.Pk, name, v.Hash); err != nil {
+		n.log("Failed to get program version\n", err)
+	} else {
+		n.scheduleProgram(n.Pk, name, b)
+		// new replicas get the program we rolled back to, with the version pointing to it
+		n.replicas.track(mStore{name, n.Pk, v.Time, keys.HashSig(v.Sig), b}, hash)
+	}
+
+	m := mVersion{n.Pk, name, v}
+	for _, peer := range n.peerList() {
+		if err = n.send(peer, m); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// reschedule updates the schedule of a program name after it's pointed to a different program
+func (n *Node) reschedule(pk keys.PK, name, hexhash string) {
+	b, err := GetVersionBundle(pk, name, hexhash)
+	if err != nil {
+		n.log("Failed to get program version\n", err)
+		return
+	}
+	n.scheduleProgram(pk, name, b)
+}
+
+func (n *Node) receiveVersion(m mVersion) {
+	if !verifyVersion(m.Pk, m.Name, m.Version) {
+		n.log("Invalid version signature\n", m.Pk.Encode())
+		return
+	}
+
+	// we can only roll back to programs we've been sent before
+	if err := RollbackProgram(m.Pk, m.Name, m.Version); err != nil {
+		n.log("Failed to roll back program\n", err)
+		return
+	}
+	n.reschedule(m.Pk, m.Name, m.Version.Hash)
+	n.log("Rolled back program\n", "Name: ", m.Name, "\n", "Hash: ", m.Version.Hash)
+}
@@ -31,7 +31,13 @@ type QuicNet struct {
 	tlsConf  *tls.Config
 	quicConf *quic.Config
 	listener *quic.Listener
-	streams  map[keys.Address]*quic.SendStream
+	streams  map[keys.Address]peerStream
+}
+
+// a stream to the peer we verified we're connected to
+type peerStream struct {
+	*quic.SendStream
+	pk keys.PK
 }
 
 func NewQuicNet(tlsConf *tls.Config, quicConf *quic.Config) (n net.Net, err error) {
@@ -58,7 +64,7 @@ func NewQuicNet(tlsConf *tls.Config, quicConf *quic.Config) (n net.Net, err erro
 		tlsConf:  tlsConf,
 		quicConf: quicConf,
 		listener: ln,
-		streams:  make(map[keys.Address]*quic.SendStream),
+		streams:  make(map[keys.Address]peerStream),
 	}, nil
 }
 
@@ -75,26 +81,27 @@ func sendMsg(stream *quic.SendStream, msg []byte) (ok bool) {
 	return err == nil
 }
 
-func (n *QuicNet) sendTo(addr keys.Address, msg net.EncryptedMsg) (ok bool) {
+func (n *QuicNet) sendTo(addr keys.Address, pk keys.PK, msg net.EncryptedMsg) (ok bool) {
 	stream, ok := n.streams[addr]
-	if !ok {
+	if !ok || stream.pk != pk {
 		fmt.Println("No stream for   ", addrToReadable(addr))
-		return // no stream for this address
+		return false // no stream to this peer at this address
 	}
 
 	fmt.Println("Sending message ", addrToReadable(addr), "(existing)  length", len(msg))
 
 	// send message on existing stream
-	if !sendMsg(stream, msg) {
+	if !sendMsg(stream.SendStream, msg) {
 		delete(n.streams, addr) // remove broken stream
 		return
 	}
 	return true
 }
 
-func (n *QuicNet) dialStream(addr keys.Address) (err error) {
+func (n *QuicNet) dialStream(addr keys.Address, pk keys.PK) (err error) {
 	fmt.Println("Dialing         ", addrToReadable(addr))
-	qc, err := n.tr.DialEarly(context.TODO(), addrToUdp(addr), n.tlsConf, n.quicConf)
+	// the handshake fails unless whoever's at the address has the peer's key
+	qc, err := n.tr.DialEarly(context.TODO(), addrToUdp(addr), keys.TLSConfigFor(n.tlsConf, pk), n.quicConf)
 	if err != nil {
 		return fmt.Errorf("dial QUIC connection: %w", err)
 	}
@@ -104,7 +111,7 @@ func (n *QuicNet) dialStream(addr keys.Address) (err error) {
 		return fmt.Errorf("open QUIC stream: %w", err)
 	}
 
-	n.streams[addr] = stream
+	n.streams[addr] = peerStream{stream, pk}
 	return
 }
 
@@ -115,15 +122,15 @@ mainloop:
 		addrs := append([]keys.Address{msg.MainAddr}, msg.AltAddrs...)
 
 		for _, addr := range addrs {
-			if n.sendTo(addr, msg.EncryptedMsg) {
+			if n.sendTo(addr, msg.Pk, msg.EncryptedMsg) {
 				continue mainloop // found and sent message on existing stream
 			}
 		}
 
 		for _, addr := range addrs {
-			if err := n.dialStream(addr); err != nil {
+			if err := n.dialStream(addr, msg.Pk); err != nil {
 				fmt.Println("Dialing failed  ", addrToReadable(addr), ":", err)
-			} else if n.sendTo(addr, msg.EncryptedMsg) {
+			} else if n.sendTo(addr, msg.Pk, msg.EncryptedMsg) {
 				continue mainloop // sent message on newly created stream
 			}
 		}
@@ -145,7 +152,8 @@ func readChunks(stream *quic.ReceiveStream, chunkChan chan<- []byte) {
 	}
 }
 
-func readMsgs(chunkChan <-chan []byte, msgChan chan<- net.EncryptedMsg) {
+// readMsgs sends on the messages in a stream from a peer, with the key they connected with, so messages claiming to be from someone else are dropped
+func readMsgs(from keys.PK, chunkChan <-chan []byte, msgChan chan<- net.ReceivedMsg) {
 	const minMsgSize = 4 // well not really, as a message can't be just a length and 0 bytes, but whatever
 
 	b := make([]byte, 0, minMsgSize)
@@ -168,15 +176,15 @@ func readMsgs(chunkChan <-chan []byte, msgChan chan<- net.EncryptedMsg) {
 			b = append(b, <-chunkChan...)
 		}
 
-		msgChan <- b[:il] // send it off!!!!!!!
-		b = b[il:]        // remaining bytes are for the next message
+		msgChan <- net.ReceivedMsg{EncryptedMsg: b[:il], From: from} // send it off!!!!!!!
+		b = b[il:]                                                   // remaining bytes are for the next message
 	}
 }
 
-func parseStream(stream *quic.ReceiveStream, r net.Receiver) {
+func parseStream(from keys.PK, stream *quic.ReceiveStream, r net.Receiver) {
 	chunkChan := make(chan []byte)
 	go readChunks(stream, chunkChan)
-	go readMsgs(chunkChan, r)
+	go readMsgs(from, chunkChan, r)
 }
 
 func (n *QuicNet) serveToReceiver(ln *quic.Listener, r net.Receiver) {
@@ -187,7 +195,15 @@ func (n *QuicNet) serveToReceiver(ln *quic.Listener, r net.Receiver) {
 			continue
 		}
 
-		fmt.Println("Accepted connection from", qc.RemoteAddr())
+		// they've already been verified by the handshake
+		pk, err := keys.VerifyTLS([][]byte{qc.ConnectionState().TLS.PeerCertificates[0].Raw})
+		if err != nil {
+			fmt.Println("Error verifying connection:", err)
+			qc.CloseWithError(0, "")
+			continue
+		}
+
+		fmt.Println("Accepted connection from", pk.Encode(), "at", qc.RemoteAddr())
 
 		stream, err := qc.AcceptUniStream(context.TODO())
 		if err != nil {
@@ -195,7 +211,7 @@ func (n *QuicNet) serveToReceiver(ln *quic.Listener, r net.Receiver) {
 			continue
 		}
 
-		go parseStream(stream, r)
+		go parseStream(pk, stream, r)
 	}
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/sha3"
 	"fmt"
 	"path/filepath"
 	"time"
@@ -19,7 +20,7 @@ func changed(n *net.Node, path, name string) {
 		return
 	}
 
-	if _, err = net.StoreProgram(n.Pk, name, b); err != nil {
+	if _, err = net.StoreProgram(n.Pk, name, n.SignVersion(name, sha3.Sum256(b)), b); err != nil {
 		fmt.Println("Failed to store dev program:", err)
 		return
 	}